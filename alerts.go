@@ -0,0 +1,281 @@
+package main
+
+// Flashing lights to alert, like for the doorbell or a finished washing machine, when a message arrives on an MQTT topic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+const (
+	alertFlashOn  = 400 * time.Millisecond // how long each flash is on
+	alertFlashOff = 300 * time.Millisecond // and off
+)
+
+// Alert flashes some lights in a pattern of colours whenever a message arrives on an MQTT topic
+type Alert struct {
+	ID       string
+	Name     string   // like "Doorbell"
+	Topic    string   // MQTT topic that triggers the alert
+	LightIDs []string // lights and groups (like "group:Lounge") to flash
+	Colors   []string // colours (hex or R,G,B) used for each flash in turn
+	Flashes  int
+}
+
+// pattern returns the colours to flash, checking they are valid
+func (a *Alert) pattern() ([][3]int, error) {
+	if len(a.Colors) == 0 {
+		return nil, fmt.Errorf("Alert %v has no colours", a.Name)
+	}
+	pattern := make([][3]int, len(a.Colors))
+	for i, color := range a.Colors {
+		r, g, b, err := sunflower.ParseColor(color)
+		if err != nil {
+			return nil, err
+		}
+		pattern[i] = [3]int{r, g, b}
+	}
+	return pattern, nil
+}
+
+// subscribeFunc subscribes to an MQTT topic, calling handler with the payload of each message,
+// and returns a function that unsubscribes
+type subscribeFunc func(topic string, handler func(payload []byte)) (func(), error)
+
+// subscribeMQTT subscribes through the driver's connection to the Sphere's MQTT broker
+func (d *YeelightDriver) subscribeMQTT(topic string, handler func(payload []byte)) (func(), error) {
+	subscription, err := d.Conn.Subscribe(topic, func(params *json.RawMessage, values map[string]string) bool {
+		var payload []byte
+		if params != nil {
+			payload = *params
+		}
+		handler(payload)
+		// stay subscribed
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscription.Cancel, nil
+}
+
+// alertPlayer plays alerts one at a time, so overlapping alerts don't restore each other's flashes
+type alertPlayer struct {
+	playing sync.Mutex // held while an alert plays
+
+	mu   sync.Mutex
+	subs map[string]func() // unsubscribe functions, keyed by alert ID
+}
+
+func newAlertPlayer() *alertPlayer {
+	return &alertPlayer{subs: make(map[string]func())}
+}
+
+// subscribeAlert starts listening for an alert's topic
+func (d *YeelightDriver) subscribeAlert(alert *Alert) error {
+	d.unsubscribeAlert(alert.ID)
+	id := alert.ID
+	topic := alert.Topic
+	unsubscribe, err := d.subscribe(topic, func(payload []byte) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		log.Printf("Alert %v triggered by %v: %s", id, topic, payload)
+		if err := d.PlayAlert(id); err != nil {
+			log.Printf("Unable to play alert: %v", err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("Could not subscribe to %v: %v", alert.Topic, err)
+	}
+	d.alerts.mu.Lock()
+	d.alerts.subs[id] = unsubscribe
+	d.alerts.mu.Unlock()
+	return nil
+}
+
+// unsubscribeAlert stops listening for an alert's topic
+func (d *YeelightDriver) unsubscribeAlert(id string) {
+	d.alerts.mu.Lock()
+	defer d.alerts.mu.Unlock()
+	if unsubscribe, ok := d.alerts.subs[id]; ok {
+		unsubscribe()
+		delete(d.alerts.subs, id)
+	}
+}
+
+// unsubscribeAlerts stops listening for every alert
+func (d *YeelightDriver) unsubscribeAlerts() {
+	d.alerts.mu.Lock()
+	defer d.alerts.mu.Unlock()
+	for id, unsubscribe := range d.alerts.subs {
+		unsubscribe()
+		delete(d.alerts.subs, id)
+	}
+}
+
+// SubscribeAlerts listens for the topics of all alerts in the config
+func (d *YeelightDriver) SubscribeAlerts() {
+	for _, alert := range d.config.Alerts {
+		if err := d.subscribeAlert(alert); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+}
+
+// AddAlert checks and saves a new alert, and starts listening for its topic
+func (d *YeelightDriver) AddAlert(alert *Alert) error {
+	alert.Name = strings.TrimSpace(alert.Name)
+	alert.Topic = strings.TrimSpace(alert.Topic)
+	if alert.Name == "" || alert.Topic == "" {
+		return fmt.Errorf("Alerts need a name and an MQTT topic")
+	}
+	if len(alert.LightIDs) == 0 {
+		return fmt.Errorf("Choose at least one light")
+	}
+	if alert.Flashes < 1 {
+		return fmt.Errorf("Alerts need at least one flash")
+	}
+	if _, err := alert.pattern(); err != nil {
+		return err
+	}
+	alert.ID = d.nextAlertID()
+	d.config.Alerts = append(d.config.Alerts, alert)
+	if err := d.subscribeAlert(alert); err != nil {
+		return err
+	}
+	// save the new configuration
+	return d.saveConfig()
+}
+
+// DeleteAlert removes an alert and stops listening for its topic
+func (d *YeelightDriver) DeleteAlert(id string) error {
+	for i, alert := range d.config.Alerts {
+		if alert.ID == id {
+			d.unsubscribeAlert(id)
+			d.config.Alerts = append(d.config.Alerts[:i], d.config.Alerts[i+1:]...)
+			// save the new configuration
+			return d.saveConfig()
+		}
+	}
+	return fmt.Errorf("Unknown alert %v", id)
+}
+
+// alertByID returns the alert with the given ID, or nil
+func (d *YeelightDriver) alertByID(id string) *Alert {
+	for _, alert := range d.config.Alerts {
+		if alert.ID == id {
+			return alert
+		}
+	}
+	return nil
+}
+
+// nextAlertID returns an ID not used by any alert
+func (d *YeelightDriver) nextAlertID() string {
+	for n := len(d.config.Alerts) + 1; ; n++ {
+		id := strconv.Itoa(n)
+		if d.alertByID(id) == nil {
+			return id
+		}
+	}
+}
+
+// PlayAlert flashes an alert's lights in the background. Each light's colour and level is snapshotted first
+// and put back afterwards, and any fade or effect on the lights is stopped. Lights given a command while the alert
+// is playing are left to it: they stop flashing and aren't put back
+func (d *YeelightDriver) PlayAlert(id string) error {
+	alert := d.alertByID(id)
+	if alert == nil {
+		return fmt.Errorf("Unknown alert %v", id)
+	}
+	pattern, err := alert.pattern()
+	if err != nil {
+		return err
+	}
+	ids := d.expandGroups(alert.LightIDs)
+	if containsString(alert.LightIDs, "all") {
+		ids = d.config.LightIDs
+	}
+	flashes := alert.Flashes
+	ctx := d.ctx
+	go func() {
+		d.alerts.playing.Lock()
+		defer d.alerts.playing.Unlock()
+		for _, id := range ids {
+			d.fader.cancel(id)
+			d.effects.stop(id)
+		}
+		// the alert runs outside the driver lock, so take the lock for each step
+		d.mu.Lock()
+		started := d.commands
+		current, err := d.hub.GetLights()
+		d.mu.Unlock()
+		if err != nil {
+			log.Printf("Unable to play alert %v: %v", alert.Name, err)
+			return
+		}
+		var snapshot []yeelight.Light
+		for _, id := range ids {
+			if light, found := findLight(current, id); found {
+				snapshot = append(snapshot, light)
+			}
+		}
+		// set sets the lights that haven't been given a command since the alert started
+		set := func(color [3]int, level int) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for _, light := range snapshot {
+				if !d.commandedSince(light.ID, started) {
+					d.hub.SetLight(light.ID, color[0], color[1], color[2], level)
+				}
+			}
+		}
+		// put the lights back however the flashing ends
+		defer func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			for _, light := range snapshot {
+				if d.commandedSince(light.ID, started) {
+					log.Printf("Not restoring light %v after alert, it was changed during the alert", light.ID)
+					continue
+				}
+				if err := d.hub.SetLight(light.ID, light.R, light.G, light.B, light.Level); err != nil {
+					log.Printf("Unable to restore light %v after alert: %v", light.ID, err)
+				}
+			}
+		}()
+		for flash := 0; flash < flashes; flash++ {
+			color := pattern[flash%len(pattern)]
+			set(color, 100)
+			if !sleepUnlessDone(ctx, alertFlashOn) {
+				return
+			}
+			set(color, 0)
+			if !sleepUnlessDone(ctx, alertFlashOff) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// sleepUnlessDone waits for duration, returning false if ctx is cancelled first
+func sleepUnlessDone(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// fakeBroker stands in for the MQTT broker, keeping the handler subscribed to each topic
+type fakeBroker struct {
+	mu       sync.Mutex
+	handlers map[string]func(payload []byte)
+}
+
+// useFakeBroker makes the driver subscribe to topics on a fake broker instead of the Sphere's
+func useFakeBroker(d *YeelightDriver) *fakeBroker {
+	b := &fakeBroker{handlers: make(map[string]func(payload []byte))}
+	d.subscribe = func(topic string, handler func(payload []byte)) (func(), error) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.handlers[topic] = handler
+		return func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.handlers, topic)
+		}, nil
+	}
+	return b
+}
+
+// publish delivers a message to whatever is subscribed to topic, returning false if nothing is
+func (b *fakeBroker) publish(topic string, payload []byte) bool {
+	b.mu.Lock()
+	handler, ok := b.handlers[topic]
+	b.mu.Unlock()
+	if ok {
+		handler(payload)
+	}
+	return ok
+}
+
+// waitForCommand waits for a fake hub to be sent a command, after the first skip commands it was sent,
+// failing the test if it isn't within a few seconds
+func waitForCommand(t *testing.T, hub *fakeHub, skip int, command string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		for _, sent := range hub.sent()[skip:] {
+			if sent == command {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("hub was not sent %q, only %q", command, hub.sent())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestPlayAlert(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	broker := useFakeBroker(d)
+	d.mu.Lock()
+	err := d.AddAlert(&Alert{Name: "Doorbell", Topic: "home/doorbell", LightIDs: []string{"A1", "B1"}, Colors: []string{"#0000ff"}, Flashes: 2})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("AddAlert: %v", err)
+	}
+
+	// the lights flash, then go back to how they were
+	if !broker.publish("home/doorbell", []byte("ding")) {
+		t.Fatalf("alert isn't subscribed to its topic")
+	}
+	waitForCommand(t, first, 0, "SetLight A1 0,0,255,100")
+	waitForCommand(t, first, 0, "SetLight A1 0,0,255,0")
+	waitForCommand(t, second, 0, "SetLight B1 0,0,255,0")
+	waitForCommand(t, first, 0, "SetLight A1 255,0,0,50")
+	// the rest of the lights are put back before the next alert can play
+	d.alerts.playing.Lock()
+	d.alerts.playing.Unlock()
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, Level: 50}) {
+		t.Errorf("A1 = %+v after the alert", got)
+	}
+	if got := second.light("B1"); got != (yeelight.Light{ID: "B1", B: 255, Level: 100}) {
+		t.Errorf("B1 = %+v after the alert", got)
+	}
+
+	// a light turned off during the alert stays off, while the others are still put back
+	skip := len(first.sent())
+	broker.publish("home/doorbell", []byte("ding"))
+	waitForCommand(t, first, skip, "SetLight A1 0,0,255,100")
+	off := false
+	if err := d.devices["B1"].ninjaLight.(*testLight).apply(&devices.LightDeviceState{OnOff: &off}); err != nil {
+		t.Fatalf("turning B1 off: %v", err)
+	}
+	commanded := len(second.sent())
+	waitForCommand(t, first, skip, "SetLight A1 255,0,0,50")
+	d.alerts.playing.Lock()
+	d.alerts.playing.Unlock()
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, Level: 50}) {
+		t.Errorf("A1 = %+v after the alert", got)
+	}
+	if got := second.light("B1"); got.Level != 0 {
+		t.Errorf("B1 = %+v after being turned off during the alert", got)
+	}
+	if more := second.sent()[commanded:]; len(more) != 0 {
+		t.Errorf("B1 was sent %q after being turned off", more)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+// A local HTTP API with JSON endpoints, so scripts and dashboards can control the lights without the Ninja stack:
+//
+//	GET    /api/lights                   lights and their live state
+//	GET    /api/lights/{id}              one light
+//	PUT    /api/lights/{id}              change a light, with any of {"on", "brightness" (0-100), "color", "name"}
+//	                                     (the colour's hue and saturation are used, at the light's brightness,
+//	                                     so the reply has the colour at full value, like "#0000ff" for "#000080")
+//	GET    /api/presets                  presets and their lights
+//	POST   /api/presets                  save the current state of lights as a preset, with {"name", "lightIDs"}
+//	POST   /api/presets/{name}/activate  activate a preset, optionally with {"fadeSeconds"}
+//	DELETE /api/presets/{name}           delete a preset
+//	POST   /api/off                      turn off all lights
+//	GET    /api/hubs                     hub status
+//	GET    /metrics                      Prometheus metrics (see metrics.go), also served on their own with MetricsAddress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+// apiError is an error with the HTTP status to send for it
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func apiErrorf(status int, format string, args ...interface{}) error {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// apiLight is a light and its live state
+type apiLight struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Hub        string `json:"hub"`
+	Missing    bool   `json:"missing"` // not found on its hub at the last scan
+	Online     bool   `json:"online"`  // reported by its hub just now
+	On         bool   `json:"on"`
+	Brightness int    `json:"brightness"` // 0-100
+	Color      string `json:"color"`      // like "#ff8800"
+	Effect     string `json:"effect,omitempty"`
+}
+
+// apiLightUpdate changes a light, leaving out anything that shouldn't change
+type apiLightUpdate struct {
+	On         *bool   `json:"on"`
+	Brightness *int    `json:"brightness"` // 0-100
+	Color      *string `json:"color"`      // hex ("#ff8800") or R,G,B ("255,136,0"); its brightness is ignored
+	Name       *string `json:"name"`
+}
+
+// apiPreset is a preset and the values it stores for each light
+type apiPreset struct {
+	Name   string           `json:"name"`
+	Lights []apiPresetLight `json:"lights"`
+}
+
+type apiPresetLight struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Brightness int    `json:"brightness"`
+	Color      string `json:"color"`
+}
+
+// apiActivate is the optional body for activating a preset
+type apiActivate struct {
+	FadeSeconds *int `json:"fadeSeconds"` // the Labs fade time if left out
+}
+
+// apiHub is a hub and its status from the background monitor
+type apiHub struct {
+	ID       string    `json:"id"`
+	IP       string    `json:"ip"`
+	Online   bool      `json:"online"`
+	Since    time.Time `json:"since"`
+	Failures int       `json:"failures"`
+	LightIDs []string  `json:"lightIDs"`
+}
+
+// apiShutdownTimeout is how long requests in progress get to finish when the HTTP API stops
+const apiShutdownTimeout = 5 * time.Second
+
+// apiListenAddress is the address the HTTP API listens on for the configured address. The API has no authentication,
+// so an address without a host (like ":8089") only listens on this machine; give a host (like "0.0.0.0:8089") to open it up
+func apiListenAddress(address string) string {
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return address
+}
+
+// startAPI starts the HTTP API if an address is configured. The driver lock must be held
+func (d *YeelightDriver) startAPI() error {
+	if d.config.HTTPAddress == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", apiListenAddress(d.config.HTTPAddress))
+	if err != nil {
+		return fmt.Errorf("Could not start HTTP API on %v: %v", d.config.HTTPAddress, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{Handler: d.apiHandler(ctx)}
+	go func() {
+		// stopAPI closes the listener itself, so only errors before it's stopped are worth logging
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed && ctx.Err() == nil {
+			log.Printf("HTTP API stopped: %v", err)
+		}
+	}()
+	d.api, d.apiListener, d.apiCancel = server, listener, cancel
+	log.Printf("HTTP API listening on %v", listener.Addr())
+	return nil
+}
+
+// stopAPI stops the HTTP API if it's running. The driver lock must be held, so it stops listening straight away
+// (freeing the address for a restart) but doesn't wait for requests in progress: those waiting for the lock
+// give up once they get it, and the rest are given apiShutdownTimeout to finish
+func (d *YeelightDriver) stopAPI() {
+	if d.api == nil {
+		return
+	}
+	d.apiCancel()
+	if err := d.apiListener.Close(); err != nil {
+		log.Printf("Error stopping HTTP API: %v", err)
+	}
+	server := d.api
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error stopping HTTP API: %v", err)
+		}
+	}()
+	d.api, d.apiListener, d.apiCancel = nil, nil, nil
+}
+
+// SetAPIAddress changes the address the HTTP API listens on, restarting it, or turns it off if address is empty
+func (d *YeelightDriver) SetAPIAddress(address string) error {
+	address = strings.TrimSpace(address)
+	d.config.HTTPAddress = address
+	d.stopAPI()
+	err := d.startAPI()
+	// save the new configuration, even if the API couldn't start so it can be fixed
+	if saveErr := d.saveConfig(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// apiHandler routes the API's requests, refusing them once ctx is cancelled
+func (d *YeelightDriver) apiHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/lights", d.apiRoute(ctx, d.apiLights))
+	mux.HandleFunc("/api/lights/", d.apiRoute(ctx, d.apiLight))
+	mux.HandleFunc("/api/presets", d.apiRoute(ctx, d.apiPresets))
+	mux.HandleFunc("/api/presets/", d.apiRoute(ctx, d.apiPreset))
+	mux.HandleFunc("/api/off", d.apiRoute(ctx, d.apiOff))
+	mux.HandleFunc("/api/hubs", d.apiRoute(ctx, d.apiHubs))
+	mux.HandleFunc("/metrics", d.serveMetrics)
+	return mux
+}
+
+// apiRoute runs an API handler with the driver lock held, replying with its result as JSON,
+// or with {"error": message} and the error's status. Requests still waiting for the lock when the API
+// stops (ctx is cancelled) or the client goes away aren't run
+func (d *YeelightDriver) apiRoute(ctx context.Context, handler func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		var err error
+		d.mu.Lock()
+		if ctx.Err() != nil || r.Context().Err() != nil {
+			err = apiErrorf(http.StatusServiceUnavailable, "The HTTP API is stopping")
+		} else {
+			result, err = handler(r)
+		}
+		d.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+			if e, ok := err.(*apiError); ok {
+				status = e.status
+			}
+			result = map[string]string{"error": err.Error()}
+		}
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("Could not send HTTP API reply: %v", err)
+		}
+	}
+}
+
+// decodeBody reads a JSON request body into v, allowing an empty body if optional is set
+func decodeBody(r *http.Request, v interface{}, optional bool) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil && !(optional && err == io.EOF) {
+		return apiErrorf(http.StatusBadRequest, "Bad request body: %v", err)
+	}
+	return nil
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return apiErrorf(http.StatusMethodNotAllowed, "%v is not allowed here", r.Method)
+}
+
+// apiLights lists the lights with their live state
+func (d *YeelightDriver) apiLights(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, methodNotAllowed(r)
+	}
+	current, err := d.hub.GetLights()
+	if err != nil && len(current) == 0 {
+		return nil, apiErrorf(http.StatusBadGateway, "Could not get lights: %v", err)
+	}
+	running := d.effects.runningOn()
+	lights := make([]apiLight, 0, len(d.config.LightIDs))
+	for _, id := range d.config.LightIDs {
+		lights = append(lights, d.describeLight(id, current, running))
+	}
+	return lights, nil
+}
+
+// describeLight returns a light's state, given the lights reported by the hubs and the effects running
+func (d *YeelightDriver) describeLight(id string, current []yeelight.Light, running map[string]string) apiLight {
+	light := apiLight{
+		ID:      id,
+		Name:    d.config.Names[id],
+		Missing: d.IsMissing(id),
+		Effect:  running[id],
+	}
+	if hub := d.hubForLight(id); hub != nil {
+		light.Hub = hub.ID
+	}
+	if state, found := findLight(current, id); found {
+		light.Online = true
+		light.On = state.Level > 0
+		light.Brightness = state.Level
+		light.Color = sunflower.HexColor(state.R, state.G, state.B)
+	}
+	return light
+}
+
+// apiLight shows or changes one light
+func (d *YeelightDriver) apiLight(r *http.Request) (interface{}, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/lights/")
+	device, ok := d.devices[id]
+	if !ok {
+		return nil, apiErrorf(http.StatusNotFound, "Unknown light %v", id)
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		update := &apiLightUpdate{}
+		if err := decodeBody(r, update, false); err != nil {
+			return nil, err
+		}
+		if err := d.updateLight(device, update); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, methodNotAllowed(r)
+	}
+	current, err := d.hub.GetLights()
+	if err != nil && len(current) == 0 {
+		return nil, apiErrorf(http.StatusBadGateway, "Could not get light: %v", err)
+	}
+	return d.describeLight(id, current, d.effects.runningOn()), nil
+}
+
+// updateLight applies an API update to a light, checking all of it before changing anything
+func (d *YeelightDriver) updateLight(device *YeelightDevice, update *apiLightUpdate) error {
+	var r, g, b int
+	if update.Color != nil {
+		var err error
+		if r, g, b, err = sunflower.ParseColor(*update.Color); err != nil {
+			return apiErrorf(http.StatusBadRequest, "Bad colour: %v", err)
+		}
+	}
+	if update.Brightness != nil && (*update.Brightness < 0 || *update.Brightness > 100) {
+		return apiErrorf(http.StatusBadRequest, "Brightness should be 0-100")
+	}
+	if update.Name != nil && strings.TrimSpace(*update.Name) == "" {
+		return apiErrorf(http.StatusBadRequest, "Name can't be blank")
+	}
+
+	if update.Name != nil {
+		names := make(map[string]string)
+		for id, name := range d.config.Names {
+			names[id] = name
+		}
+		names[device.id] = strings.TrimSpace(*update.Name)
+		if err := d.Rename(names); err != nil {
+			return err
+		}
+	}
+	// changes go through the device, like changes from the app.
+	// Brightness turns the light on or off too, so it takes the place of on/off if both are given
+	state := &devices.LightDeviceState{OnOff: update.On}
+	if update.Brightness != nil {
+		brightness := float64(*update.Brightness) / 100
+		state.OnOff, state.Brightness = nil, &brightness
+	}
+	if update.Color != nil {
+		// the Yeelight sets how bright a light is with its level, not its colour, so a dark colour
+		// is the same hue at the light's brightness; brightness changes that
+		hue, saturation := rgbToHueSaturation(r, g, b)
+		state.Color = &channels.ColorState{Mode: "hue", Hue: &hue, Saturation: &saturation}
+	}
+	if update.On != nil || update.Brightness != nil || update.Color != nil {
+		if err := device.applyLightState(state); err != nil {
+			return apiErrorf(http.StatusBadGateway, "Could not change light: %v", err)
+		}
+	}
+	return nil
+}
+
+// apiPresets lists the presets, or saves a new one from the current state of some lights
+func (d *YeelightDriver) apiPresets(r *http.Request) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		presets := make([]apiPreset, 0, len(d.config.PresetNames))
+		for _, name := range d.config.PresetNames {
+			presets = append(presets, d.describePreset(name))
+		}
+		return presets, nil
+	case http.MethodPost:
+		values := &savePresetData{}
+		if err := decodeBody(r, values, false); err != nil {
+			return nil, err
+		}
+		values.Name = strings.TrimSpace(values.Name)
+		if values.Name == "" {
+			return nil, apiErrorf(http.StatusBadRequest, "Presets need a name")
+		}
+		if len(values.LightIDs) == 0 {
+			return nil, apiErrorf(http.StatusBadRequest, "Choose at least one light")
+		}
+		if err := d.SavePreset(values); err != nil {
+			return nil, apiErrorf(http.StatusBadGateway, "Could not save preset: %v", err)
+		}
+		return d.describePreset(values.Name), nil
+	default:
+		return nil, methodNotAllowed(r)
+	}
+}
+
+// describePreset returns a preset with its light values
+func (d *YeelightDriver) describePreset(name string) apiPreset {
+	preset := apiPreset{Name: name, Lights: []apiPresetLight{}}
+	if stored, ok := d.config.Presets[name]; ok {
+		for _, light := range stored.Lights {
+			preset.Lights = append(preset.Lights, apiPresetLight{
+				ID:         light.ID,
+				Name:       d.config.Names[light.ID],
+				Brightness: light.Level,
+				Color:      sunflower.HexColor(light.R, light.G, light.B),
+			})
+		}
+	}
+	return preset
+}
+
+// apiPreset activates or deletes a preset
+func (d *YeelightDriver) apiPreset(r *http.Request) (interface{}, error) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/presets/")
+	activate := strings.HasSuffix(name, "/activate")
+	name = strings.TrimSuffix(name, "/activate")
+	if _, ok := d.config.Presets[name]; !ok {
+		return nil, apiErrorf(http.StatusNotFound, "Unknown preset %v", name)
+	}
+	switch {
+	case activate && r.Method == http.MethodPost:
+		values := &apiActivate{}
+		if err := decodeBody(r, values, true); err != nil {
+			return nil, err
+		}
+		seconds := d.config.FadeSeconds
+		if values.FadeSeconds != nil {
+			seconds = *values.FadeSeconds
+		}
+		if err := d.ActivatePreset(name, time.Duration(seconds)*time.Second); err != nil {
+			return nil, apiErrorf(http.StatusBadGateway, "Could not activate preset: %v", err)
+		}
+		return d.describePreset(name), nil
+	case !activate && r.Method == http.MethodDelete:
+		if err := d.DeletePreset(name); err != nil {
+			return nil, err
+		}
+		return map[string]string{"deleted": name}, nil
+	default:
+		return nil, methodNotAllowed(r)
+	}
+}
+
+// apiOff turns off all lights
+func (d *YeelightDriver) apiOff(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, methodNotAllowed(r)
+	}
+	if err := d.TurnOffAllLights(); err != nil {
+		return nil, apiErrorf(http.StatusBadGateway, "Could not turn lights off: %v", err)
+	}
+	// update the state of all lights for the UI
+	onOff := false
+	for _, device := range d.devices {
+		device.UpdateLightState(&devices.LightDeviceState{OnOff: &onOff})
+	}
+	return map[string]bool{"off": true}, nil
+}
+
+// apiHubs lists the hubs with their status
+func (d *YeelightDriver) apiHubs(r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, methodNotAllowed(r)
+	}
+	hubs := make([]apiHub, 0, len(d.config.Hubs))
+	for _, hub := range d.config.Hubs {
+		status := d.HubStatus(hub.ID)
+		hubs = append(hubs, apiHub{
+			ID:       hub.ID,
+			IP:       hub.IP,
+			Online:   status.Online,
+			Since:    status.Since,
+			Failures: status.Failures,
+			LightIDs: hub.LightIDs,
+		})
+	}
+	return hubs, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// apiRequest sends a request to the driver's API, returning the status and decoding the reply into reply
+func apiRequest(t *testing.T, d *YeelightDriver, method, path, body string, reply interface{}) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	d.apiHandler(context.Background()).ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	if err := json.NewDecoder(recorder.Body).Decode(reply); err != nil {
+		t.Fatalf("%v %v: bad reply: %v", method, path, err)
+	}
+	return recorder.Code
+}
+
+func TestAPIUpdateLightColor(t *testing.T) {
+	d, first, _ := newFakeHubDriver(t)
+	light := d.devices["A1"].ninjaLight.(*testLight)
+
+	// a colour on its own goes through the device, so the UI sees it too
+	reply := apiLight{}
+	if status := apiRequest(t, d, http.MethodPut, "/api/lights/A1", `{"color": "#00ff00"}`, &reply); status != http.StatusOK {
+		t.Fatalf("PUT colour = %d", status)
+	}
+	if reply.Color != "#00ff00" || reply.Brightness != 50 {
+		t.Errorf("light is %+v after changing its colour", reply)
+	}
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", G: 255, Level: 50}) {
+		t.Errorf("A1 = %+v after changing its colour", got)
+	}
+	light.mu.Lock()
+	states := light.states
+	light.mu.Unlock()
+	if len(states) != 1 || states[0].Color == nil || states[0].OnOff != nil || states[0].Brightness != nil {
+		t.Errorf("UI was sent %+v, want just the colour", states)
+	}
+
+	// and along with brightness
+	if status := apiRequest(t, d, http.MethodPut, "/api/lights/A1", `{"color": "255,0,0", "brightness": 80}`, &reply); status != http.StatusOK {
+		t.Fatalf("PUT colour and brightness = %d", status)
+	}
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, Level: 80}) {
+		t.Errorf("A1 = %+v after changing its colour and brightness", got)
+	}
+
+	// a dark colour is its hue at the light's brightness, and the reply has the colour the light was set to
+	for color, want := range map[string]string{"#000080": "#0000ff", "#404040": "#ffffff"} {
+		if status := apiRequest(t, d, http.MethodPut, "/api/lights/A1", `{"color": "`+color+`"}`, &reply); status != http.StatusOK {
+			t.Fatalf("PUT %v = %d", color, status)
+		}
+		if reply.Color != want || reply.Brightness != 80 {
+			t.Errorf("light is %+v after changing its colour to %v, want %v at brightness 80", reply, color, want)
+		}
+	}
+
+	// nothing changes if the colour is bad
+	if status := apiRequest(t, d, http.MethodPut, "/api/lights/A1", `{"color": "green", "on": false}`, &reply); status != http.StatusBadRequest {
+		t.Errorf("PUT bad colour = %d, want %d", status, http.StatusBadRequest)
+	}
+	if got := first.light("A1"); got.Level != 80 {
+		t.Errorf("A1 = %+v after a bad colour", got)
+	}
+}
+
+func TestAPIListenAddress(t *testing.T) {
+	tests := []struct {
+		address, want string
+	}{
+		{":8089", "127.0.0.1:8089"},
+		{"localhost:8089", "localhost:8089"},
+		{"0.0.0.0:8089", "0.0.0.0:8089"},
+		{"192.168.1.5:8089", "192.168.1.5:8089"},
+		{"[::]:8089", "[::]:8089"},
+		{"8089", "8089"}, // left for net.Listen to refuse
+	}
+	for _, test := range tests {
+		if got := apiListenAddress(test.address); got != test.want {
+			t.Errorf("apiListenAddress(%q) = %q, want %q", test.address, got, test.want)
+		}
+	}
+}
+
+func TestStopAPI(t *testing.T) {
+	d, _, _ := newFakeHubDriver(t)
+	d.mu.Lock()
+	err := d.SetAPIAddress("127.0.0.1:0")
+	url := "http://" + d.apiListener.Addr().String() + "/api/lights"
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("SetAPIAddress: %v", err)
+	}
+
+	// a request waiting for the lock when the API stops is refused, rather than holding up the stop
+	d.mu.Lock()
+	replies := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			t.Errorf("GET during stop: %v", err)
+			close(replies)
+			return
+		}
+		replies <- response
+	}()
+	// wait for the request to reach the lock
+	time.Sleep(200 * time.Millisecond)
+	d.stopAPI()
+	d.mu.Unlock()
+	if response, ok := <-replies; ok {
+		response.Body.Close()
+		if response.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("GET during stop = %d, want %d", response.StatusCode, http.StatusServiceUnavailable)
+		}
+	}
+
+	// and it has stopped listening
+	if response, err := http.Get(url); err == nil {
+		response.Body.Close()
+		t.Errorf("GET after stop = %d, want the connection refused", response.StatusCode)
+	}
+}
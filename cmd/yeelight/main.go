@@ -0,0 +1,157 @@
+// Command yeelight talks to a Yeelight Sunflower hub directly, for debugging without editing and redeploying the driver.
+// It uses the driver's hub client and preset code, so lights are set the same way the driver sets them.
+//
+// Commands discover the hub, list bulbs, set a bulb, heartbeat the hub, turn everything off and apply presets
+// from an exported presets file. Run yeelight -h for the details. Without -hub, the hub is found with SSDP.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+const usage = `usage: yeelight [-hub ip] [-timeout duration] [-attempts n] <command> [arguments]
+
+commands:
+  discover                    find a hub with SSDP and print its IP address and USN
+  list                        list the bulbs with ID, RGB, level and LQI
+  set <id> <colour> <level>   set a bulb's colour (like #ff8800 or 255,136,0) and brightness (0-100)
+  heartbeat                   check the hub is responding
+  off                         turn off all bulbs
+  preset <file> [name]        apply a preset from a presets file exported from Labs
+                              (name can be left out if the file has one preset)
+`
+
+func main() {
+	hubIP := flag.String("hub", "", "IP address of the hub, found with SSDP if not given")
+	timeout := flag.Duration("timeout", sunflower.DefaultTimeout, "how long to wait for the hub to answer each command")
+	attempts := flag.Int("attempts", sunflower.DefaultAttempts, "how many times to try a command the hub drops or doesn't answer")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	options := sunflower.RetryOptions{Timeout: *timeout, Attempts: *attempts}
+	if err := run(*hubIP, options, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "yeelight: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run carries out a command on the hub at ip (or the hub found with SSDP if ip is empty),
+// with the same timeouts and retries as the driver
+func run(ip string, options sunflower.RetryOptions, command string, args []string) error {
+	if command == "discover" {
+		found, err := sunflower.Discover()
+		if err != nil {
+			return fmt.Errorf("Could not find a hub: %v", err)
+		}
+		fmt.Println(found.IP, found.USN)
+		return nil
+	}
+
+	if ip == "" {
+		found, err := sunflower.Discover()
+		if err != nil {
+			return fmt.Errorf("Could not find a hub (use -hub to give its address): %v", err)
+		}
+		ip = found.IP
+	}
+	hub := sunflower.NewRetryClient(sunflower.NewClient(func() string { return ip }), func() sunflower.RetryOptions { return options })
+
+	switch command {
+	case "list":
+		return list(hub)
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("Usage: yeelight set <id> <colour> <level>")
+		}
+		return set(hub, args[0], args[1], args[2])
+	case "heartbeat":
+		if err := hub.Heartbeat(); err != nil {
+			return fmt.Errorf("Hub %v is not responding: %v", ip, err)
+		}
+		fmt.Printf("Hub %v is responding\n", ip)
+		return nil
+	case "off":
+		return hub.TurnOffAllLights()
+	case "preset":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("Usage: yeelight preset <file> [name]")
+		}
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		}
+		return applyPreset(hub, args[0], name)
+	default:
+		return fmt.Errorf("Unknown command %q, run yeelight -h for the commands", command)
+	}
+}
+
+// list prints the hub's bulbs, in ID order
+func list(hub sunflower.Client) error {
+	lights, err := hub.GetLights()
+	if err != nil {
+		return fmt.Errorf("Could not get lights: %v", err)
+	}
+	sort.Slice(lights, func(i, j int) bool { return lights[i].ID < lights[j].ID })
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRGB\tLEVEL\tLQI")
+	for _, light := range lights {
+		fmt.Fprintf(w, "%v\t%v\t%d\t%d\n", light.ID, sunflower.HexColor(light.R, light.G, light.B), light.Level, light.LQI)
+	}
+	return w.Flush()
+}
+
+// set sets a bulb's colour and brightness
+func set(hub sunflower.Client, id, color, levelText string) error {
+	r, g, b, err := sunflower.ParseColor(color)
+	if err != nil {
+		return err
+	}
+	level, err := strconv.Atoi(levelText)
+	if err != nil || level < 0 || level > 100 {
+		return fmt.Errorf("Level should be 0-100")
+	}
+	return hub.SetLight(id, r, g, b, level)
+}
+
+// applyPreset sets the lights in a preset from an exported presets file
+func applyPreset(hub sunflower.Client, file, name string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	doc, err := sunflower.ParsePresetDocument(data)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if len(doc.PresetNames) != 1 {
+			return fmt.Errorf("Choose a preset: %v", strings.Join(doc.PresetNames, ", "))
+		}
+		name = doc.PresetNames[0]
+	}
+	preset, ok := doc.Presets[name]
+	if !ok {
+		return fmt.Errorf("Unknown preset %q, the file has: %v", name, strings.Join(doc.PresetNames, ", "))
+	}
+	if err := sunflower.ApplyPreset(hub, preset); err != nil {
+		return err
+	}
+	fmt.Printf("Applied preset %v to %d lights\n", name, len(preset.Lights))
+	return nil
+}
@@ -7,24 +7,64 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
 	"github.com/lindsaymarkward/go-ninja/devices"
-	"github.com/lindsaymarkward/go-yeelight"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/go-ninja/suit"
 )
 
-// global variable avoids hidden fields and another unmarshal call
-var presetToDelete string
-
 type configService struct {
 	driver *YeelightDriver
+
+	// state passed between screens avoids hidden fields and another unmarshal call.
+	// Requests are handled with the driver lock held, which guards these too
+	presetToDelete string
+	presetToEdit   string
+	pendingImport  *sunflower.PresetDocument
+	lightToRemove  string
+	groupToEdit    string // empty when creating a new group
+
+	mu      sync.Mutex
+	stopped bool // set while the driver is stopped, as go-ninja can't unexport the service
+}
+
+// setStopped turns the service off while the driver is stopped, and back on when it starts again
+func (c *configService) setStopped(stopped bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = stopped
 }
 
 type savePresetData struct {
-	Name     string   `json:name`
-	LightIDs []string `json:lightIDs`
+	Name     string   `json:"name"`
+	LightIDs []string `json:"lightIDs"`
+}
+
+type saveGroupData struct {
+	Name     string   `json:"name"`
+	LightIDs []string `json:"lightIDs"`
+}
+
+type saveAlertData struct {
+	Name     string   `json:"name"`
+	Topic    string   `json:"topic"`
+	LightIDs []string `json:"lightIDs"`
+	Colors   string   `json:"colors"` // separated by spaces
+	Flashes  string   `json:"flashes"`
+}
+
+type saveScheduleData struct {
+	When   string   `json:"when"` // "time" or a solar event
+	Time   string   `json:"time"`
+	Offset string   `json:"offset"` // minutes from the solar event
+	Days   []string `json:"days"`
+	Action string   `json:"action"` // "off" or "preset:" followed by the preset name
 }
 
 // GetActions is called by the Ninja Sphere system and returns the actions that this driver performs
@@ -41,6 +81,15 @@ func (c *configService) GetActions(request *model.ConfigurationRequest) (*[]suit
 // Configure is the main function that is called for every action
 func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
 	log.Printf("Incoming configuration request. Action:%s Data:%s", request.Action, string(request.Data))
+	c.mu.Lock()
+	stopped := c.stopped
+	c.mu.Unlock()
+	if stopped {
+		return c.error("The Yeelight driver is stopped")
+	}
+	// requests come in on their own goroutines, so handle one at a time with the driver's state locked
+	c.driver.mu.Lock()
+	defer c.driver.mu.Unlock()
 	switch request.Action {
 	case "": // the case when coming from "main menu"
 		return c.list()
@@ -63,6 +112,43 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 			}
 		}
 
+		// the poll interval is on the same screen
+		if seconds, err := strconv.Atoi(values["pollSeconds"]); err == nil && seconds != c.driver.config.PollSeconds {
+			c.driver.SetPollInterval(seconds)
+		}
+		// and how long to wait for the hubs, which applies from the next command
+		if seconds, err := strconv.Atoi(values["hubTimeoutSeconds"]); err == nil && seconds >= 0 {
+			c.driver.config.HubTimeoutSeconds = seconds
+		}
+		if attempts, err := strconv.Atoi(values["hubAttempts"]); err == nil && attempts >= 0 {
+			c.driver.config.HubAttempts = attempts
+		}
+		// and the HTTP API address
+		if address, ok := values["httpAddress"]; ok && strings.TrimSpace(address) != c.driver.config.HTTPAddress {
+			if err := c.driver.SetAPIAddress(address); err != nil {
+				return c.error(fmt.Sprintf("Could not change the HTTP API address: %s", err))
+			}
+		}
+		// and where metrics are served
+		if address, ok := values["metricsAddress"]; ok && strings.TrimSpace(address) != c.driver.config.MetricsAddress {
+			if err := c.driver.SetMetricsAddress(address); err != nil {
+				return c.error(fmt.Sprintf("Could not change the metrics address: %s", err))
+			}
+		}
+		// and the MQTT broker
+		if broker, ok := values["mqttBroker"]; ok {
+			username, password := values["mqttUsername"], values["mqttPassword"]
+			// the password isn't shown on the form, so leaving it blank keeps it, unless the username is cleared too
+			if password == "" && strings.TrimSpace(username) != "" {
+				password = c.driver.config.MQTTPassword
+			}
+			if strings.TrimSpace(broker) != c.driver.config.MQTTBroker || strings.TrimSpace(username) != c.driver.config.MQTTUsername || password != c.driver.config.MQTTPassword {
+				if err := c.driver.SetMQTTBroker(broker, username, password); err != nil {
+					return c.error(fmt.Sprintf("Could not change the MQTT broker: %s", err))
+				}
+			}
+		}
+
 		err = c.driver.Rename(names)
 		if err != nil {
 			return c.error(fmt.Sprintf("Could not rename lights: %s", err))
@@ -94,7 +180,15 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		c.driver.ActivatePreset(values["name"])
+		// remember the fade time for next time
+		if seconds, err := strconv.Atoi(values["fade"]); err == nil && seconds >= 0 && seconds != c.driver.config.FadeSeconds {
+			c.driver.config.FadeSeconds = seconds
+			c.driver.saveConfig()
+		}
+		err = c.driver.ActivatePreset(values["name"], time.Duration(c.driver.config.FadeSeconds)*time.Second)
+		if err != nil {
+			return c.error(fmt.Sprintf("Could not activate preset %v: %s", values["name"], err))
+		}
 		return c.presets()
 
 	case "deletePreset":
@@ -103,20 +197,334 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		// set global variable then go to confirmation screen
-		presetToDelete = values["name"]
+		// remember the preset for the confirmation screen
+		c.presetToDelete = values["name"]
 		return c.confirmDeletePreset()
 
+	case "editPreset":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		// remember the preset for the edit screen and saveEditPreset
+		c.presetToEdit = values["editName"]
+		return c.editPreset()
+
+	case "saveEditPreset":
+		var include struct {
+			LightIDs []string `json:"include"`
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal(request.Data, &include); err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := json.Unmarshal(request.Data, &values); err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		preset, ok := c.driver.config.Presets[c.presetToEdit]
+		if !ok {
+			return c.error(fmt.Sprintf("Unknown preset %v", c.presetToEdit))
+		}
+		// fields named "color<id>" and "level<id>" hold the new values for each light
+		var lights []sunflower.PresetLight
+		for _, light := range preset.Lights {
+			if !containsString(include.LightIDs, light.ID) {
+				continue
+			}
+			color, _ := values["color"+light.ID].(string)
+			r, g, b, err := sunflower.ParseColor(color)
+			if err != nil {
+				return c.error(fmt.Sprintf("Bad colour for %v: %s", c.driver.config.Names[light.ID], err))
+			}
+			level, _ := values["level"+light.ID].(string)
+			light.Level, err = strconv.Atoi(level)
+			if err != nil || light.Level < 0 || light.Level > 100 {
+				return c.error(fmt.Sprintf("Brightness for %v should be 0-100", c.driver.config.Names[light.ID]))
+			}
+			light.R, light.G, light.B = r, g, b
+			lights = append(lights, light)
+		}
+		if err := c.driver.UpdatePreset(c.presetToEdit, lights); err != nil {
+			return c.error(fmt.Sprintf("Could not save preset: %s", err))
+		}
+		return c.presets()
+
+	case "exportPresets":
+		return c.exportPresets(nil)
+
+	case "exportPreset":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		return c.exportPresets([]string{values["editName"]})
+
+	case "importPresets":
+		return c.importPresets()
+
+	case "readImport":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		doc, err := sunflower.ParsePresetDocument([]byte(values["document"]))
+		if err != nil {
+			return c.error(fmt.Sprintf("Could not read presets: %s", err))
+		}
+		// remember the document for confirmImport, then ask how to map lights and handle existing presets, if needed
+		c.pendingImport = doc
+		if len(c.driver.UnknownLights(doc)) > 0 || len(c.driver.CollidingPresets(doc)) > 0 {
+			return c.importOptions()
+		}
+		if err := c.driver.ImportPresets(doc, nil, nil); err != nil {
+			return c.error(fmt.Sprintf("Could not import presets: %s", err))
+		}
+		return c.presets()
+
+	case "confirmImport":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if c.pendingImport == nil {
+			return c.error("There is nothing to import")
+		}
+		// fields named "map<light ID>" map lights, "collide<preset name>" say what to do with existing presets
+		lightMap := make(map[string]string)
+		collisions := make(map[string]string)
+		for field, value := range values {
+			if strings.HasPrefix(field, "map") {
+				lightMap[strings.TrimPrefix(field, "map")] = value
+			} else if strings.HasPrefix(field, "collide") {
+				collisions[strings.TrimPrefix(field, "collide")] = value
+			}
+		}
+		err = c.driver.ImportPresets(c.pendingImport, lightMap, collisions)
+		c.pendingImport = nil
+		if err != nil {
+			return c.error(fmt.Sprintf("Could not import presets: %s", err))
+		}
+		return c.presets()
+
 	case "rename":
 		return c.rename()
 
+	case "groups":
+		return c.groups()
+
+	case "newGroup":
+		c.groupToEdit = ""
+		return c.editGroup()
+
+	case "editGroup":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		// remember the group for the edit screen and saveGroup
+		c.groupToEdit = values["groupName"]
+		return c.editGroup()
+
+	case "saveGroup":
+		values := &saveGroupData{}
+		err := json.Unmarshal(request.Data, values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		// checked before deleting a renamed group, so a name that can't be used doesn't lose it
+		if other := c.driver.collidingGroup(strings.TrimSpace(values.Name)); other != "" && other != c.groupToEdit {
+			return c.error(fmt.Sprintf("Could not save group: %v is too like group %v, choose another name", strings.TrimSpace(values.Name), other))
+		}
+		// a renamed group replaces the old one
+		if c.groupToEdit != "" && strings.TrimSpace(values.Name) != c.groupToEdit {
+			if err := c.driver.DeleteGroup(c.groupToEdit); err != nil {
+				return c.error(fmt.Sprintf("Could not rename group: %s", err))
+			}
+		}
+		if err := c.driver.SaveGroup(values.Name, values.LightIDs); err != nil {
+			return c.error(fmt.Sprintf("Could not save group: %s", err))
+		}
+		return c.groups()
+
+	case "deleteGroup":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := c.driver.DeleteGroup(values["groupName"]); err != nil {
+			return c.error(fmt.Sprintf("Could not delete group: %s", err))
+		}
+		return c.groups()
+
+	case "effects":
+		return c.effects()
+
+	case "startEffect":
+		values := &EffectRequest{}
+		err := json.Unmarshal(request.Data, values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := c.driver.StartEffect(values.Effect, values.LightIDs); err != nil {
+			return c.error(fmt.Sprintf("Could not start effect: %s", err))
+		}
+		return c.effects()
+
+	case "stopEffects":
+		c.driver.StopEffects(nil)
+		return c.effects()
+
+	case "alerts":
+		return c.alerts()
+
+	case "newAlert":
+		return c.newAlert()
+
+	case "saveAlert":
+		values := &saveAlertData{}
+		err := json.Unmarshal(request.Data, values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		flashes, err := strconv.Atoi(values.Flashes)
+		if err != nil {
+			return c.error(fmt.Sprintf("Number of flashes should be a whole number, not %q", values.Flashes))
+		}
+		alert := &Alert{
+			Name:     values.Name,
+			Topic:    values.Topic,
+			LightIDs: values.LightIDs,
+			Colors:   strings.Fields(values.Colors),
+			Flashes:  flashes,
+		}
+		if err := c.driver.AddAlert(alert); err != nil {
+			return c.error(fmt.Sprintf("Could not save alert: %s", err))
+		}
+		return c.alerts()
+
+	case "testAlert":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := c.driver.PlayAlert(values["alertID"]); err != nil {
+			return c.error(fmt.Sprintf("Could not play alert: %s", err))
+		}
+		return c.alerts()
+
+	case "deleteAlert":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := c.driver.DeleteAlert(values["alertID"]); err != nil {
+			return c.error(fmt.Sprintf("Could not delete alert: %s", err))
+		}
+		return c.alerts()
+
+	case "schedules":
+		return c.schedules()
+
+	case "newSchedule":
+		return c.newSchedule()
+
+	case "saveSchedule":
+		values := &saveScheduleData{}
+		err := json.Unmarshal(request.Data, values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		schedule := &Schedule{Time: values.Time}
+		if values.When != "" && values.When != "time" {
+			schedule.Event = values.When
+			if values.Offset != "" {
+				if schedule.OffsetMinutes, err = strconv.Atoi(values.Offset); err != nil {
+					return c.error(fmt.Sprintf("Offset should be a number of minutes, not %v", values.Offset))
+				}
+			}
+		}
+		for _, day := range values.Days {
+			if n, err := strconv.Atoi(day); err == nil {
+				schedule.Days = append(schedule.Days, time.Weekday(n))
+			}
+		}
+		if values.Action == "off" {
+			schedule.AllOff = true
+		} else {
+			schedule.Preset = strings.TrimPrefix(values.Action, "preset:")
+		}
+		if err := c.driver.AddSchedule(schedule); err != nil {
+			return c.error(fmt.Sprintf("Could not save schedule: %s", err))
+		}
+		return c.schedules()
+
+	case "toggleSchedule":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		schedule := c.driver.scheduleByID(values["scheduleID"])
+		if schedule == nil {
+			return c.error(fmt.Sprintf("Unknown schedule %v", values["scheduleID"]))
+		}
+		if err := c.driver.SetScheduleEnabled(schedule.ID, !schedule.Enabled); err != nil {
+			return c.error(fmt.Sprintf("Could not change schedule: %s", err))
+		}
+		return c.schedules()
+
+	case "deleteSchedule":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if err := c.driver.DeleteSchedule(values["scheduleID"]); err != nil {
+			return c.error(fmt.Sprintf("Could not delete schedule: %s", err))
+		}
+		return c.schedules()
+
+	case "saveLocation":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		if values["timeZone"] != "" {
+			if _, err := time.LoadLocation(values["timeZone"]); err != nil {
+				return c.error(fmt.Sprintf("Unknown time zone %v", values["timeZone"]))
+			}
+		}
+		latitude, latErr := strconv.ParseFloat(values["latitude"], 64)
+		longitude, lonErr := strconv.ParseFloat(values["longitude"], 64)
+		if latErr != nil || lonErr != nil || math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+			return c.error("Latitude and longitude should be in degrees, e.g. -19.26 and 146.82")
+		}
+		c.driver.config.TimeZone = values["timeZone"]
+		c.driver.config.Latitude = latitude
+		c.driver.config.Longitude = longitude
+		if err := c.driver.schedulesChanged(); err != nil {
+			return c.error(fmt.Sprintf("Could not save location: %s", err))
+		}
+		return c.schedules()
+
 	case "on":
 		var values map[string]string
 		err := json.Unmarshal(request.Data, &values)
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		c.driver.devices[values["lightID"]].SetOnOff(true)
+		if err := c.setOnOff(values["lightID"], true); err != nil {
+			return c.error(fmt.Sprintf("Could not turn light on: %s", err))
+		}
 		return c.list()
 
 	case "off":
@@ -125,8 +533,9 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		c.driver.devices[values["lightID"]].SetOnOff(false)
-
+		if err := c.setOnOff(values["lightID"], false); err != nil {
+			return c.error(fmt.Sprintf("Could not turn light off: %s", err))
+		}
 		return c.list()
 
 	case "allOff":
@@ -150,13 +559,21 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		switch values["choice"] {
 		case "reset":
 			return c.confirmReset()
+		case "addHub":
+			if values["newHubIP"] == "" {
+				return c.error("Enter the IP address of the hub to add")
+			}
+			if _, err := c.driver.AddHub(values["newHubIP"], ""); err != nil {
+				return c.error(fmt.Sprintf("Could not add hub at %v: %v", values["newHubIP"], err))
+			}
+			fallthrough
 		case "scanNew":
 			if err := c.driver.ScanLightsToConfig(); err != nil {
 				return c.error(fmt.Sprintf("%v", err))
 			}
-			c.driver.SendEvent("config", c.driver.config)
-			// TODO: (as in other places) This doesn't make new devices, just config entries... Somehow need to make new devices without re-making existing devices
-			//			c.driver.CreateDevicesFromConfig()
+			c.driver.saveConfig()
+			// export devices for any new lights
+			c.driver.CreateDevicesFromConfig()
 			return c.list()
 
 		default:
@@ -167,7 +584,8 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err := c.driver.ScanLightsToConfig(); err != nil {
 			return c.error(fmt.Sprintf("%v", err))
 		}
-		c.driver.SendEvent("config", c.driver.config)
+		c.driver.saveConfig()
+		c.driver.CreateDevicesFromConfig()
 		return c.list()
 
 	case "setip":
@@ -176,9 +594,22 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		c.driver.config.IP = values["ip"]
+		// fields named "ip<hub ID>" change the address of existing hubs, "ip" adds a new hub
+		for key, ip := range values {
+			if key == "ip" || !strings.HasPrefix(key, "ip") {
+				continue
+			}
+			if err := c.driver.SetHubIP(strings.TrimPrefix(key, "ip"), ip); err != nil {
+				return c.error(fmt.Sprintf("%v", err))
+			}
+		}
+		if values["ip"] != "" {
+			if _, err := c.driver.AddHub(values["ip"], ""); err != nil {
+				return c.error(fmt.Sprintf("Could not add hub at %v: %v", values["ip"], err))
+			}
+		}
 		// ?? set initialised to true?
-		c.driver.SendEvent("config", c.driver.config)
+		c.driver.saveConfig()
 		err = c.driver.ScanLightsToConfig()
 		if err != nil {
 			return c.error(fmt.Sprintf("%v", err))
@@ -192,24 +623,69 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		if err != nil {
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
-		presetNames := c.driver.config.PresetNames
-		presets := c.driver.config.Presets
-
-		c.driver.config = DefaultConfig()
-
-		if containsString(values["options"], "keepPresets") {
-			c.driver.config.PresetNames = presetNames
-			c.driver.config.Presets = presets
-		}
+		// keep the hubs we know about (so manually added ones aren't lost) but clear their lights
+		c.driver.config = resetConfig(c.driver.config, containsString(values["options"], "keepPresets"))
 		// scan for new lights
 		if err := c.driver.ScanLightsToConfig(); err != nil {
 			return c.error(fmt.Sprintf("%v", err))
 		}
-		c.driver.SendEvent("config", c.driver.config)
+		c.driver.saveConfig()
+		c.driver.CreateDevicesFromConfig()
 		return c.list()
 
+	case "syncThingNames":
+		// overwrite names set in the phone app with the names from the config,
+		// in the background as the ThingModel service can't be called with the driver locked
+		c.driver.syncThingNamesInBackground(true)
+		return c.list()
+
+	case "calibration":
+		return c.calibration()
+
+	case "saveCalibration":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		// values that start with "cal" are the calibration fields for each light
+		for field, text := range values {
+			if !strings.HasPrefix(field, "cal") {
+				continue
+			}
+			id := strings.TrimPrefix(field, "cal")
+			table, err := parseCalibration(text)
+			if err != nil {
+				return c.error(fmt.Sprintf("Bad calibration for %v: %s", c.driver.config.Names[id], err))
+			}
+			// an unchanged default table doesn't need saving
+			if formatCalibration(table) == formatCalibration(defaultCalibration) {
+				table = nil
+			}
+			if err := c.driver.SetCalibration(id, table); err != nil {
+				return c.error(fmt.Sprintf("Could not save calibration: %s", err))
+			}
+		}
+		return c.rename()
+
+	case "removeLight":
+		var values map[string]string
+		err := json.Unmarshal(request.Data, &values)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+		// remember the light for the confirmation screen
+		c.lightToRemove = values["removeID"]
+		return c.confirmRemoveLight()
+
+	case "confirmRemoveLight":
+		if err := c.driver.RemoveLight(c.lightToRemove); err != nil {
+			return c.error(fmt.Sprintf("Could not remove light: %s", err))
+		}
+		return c.rename()
+
 	case "confirmDeletePreset":
-		c.driver.DeletePreset(presetToDelete)
+		c.driver.DeletePreset(c.presetToDelete)
 		return c.presets()
 
 	default:
@@ -223,38 +699,749 @@ func (c *configService) rename() (*suit.ConfigurationScreen, error) {
 	// create text field for each light
 	for _, lightID := range c.driver.config.LightIDs {
 		name := "id" + lightID // create name field from ID so each name is unique
+		before := lightID
+		if c.driver.IsMissing(lightID) {
+			before += " (missing)"
+		}
 		lightInputs = append(lightInputs, suit.InputText{
 			Name:        name,
-			Before:      lightID,
+			Before:      before,
 			Placeholder: "Custom name",
 			Value:       c.driver.config.Names[lightID],
 		})
 	}
-	choices := []suit.ActionListOption{}
-	choices = append(choices, suit.ActionListOption{Title: "Reset Lights", Value: "reset"})
-	choices = append(choices, suit.ActionListOption{Title: "Scan for New Lights", Value: "scanNew"})
-
+	// create remove option for each light
+	removeOptions := []suit.ActionListOption{}
+	for _, lightID := range c.driver.config.LightIDs {
+		removeOptions = append(removeOptions, suit.ActionListOption{
+			Title:    c.driver.config.Names[lightID],
+			Subtitle: lightID,
+			Value:    lightID,
+		})
+	}
+	choices := []suit.ActionListOption{}
+	choices = append(choices, suit.ActionListOption{Title: "Reset Lights", Value: "reset"})
+	choices = append(choices, suit.ActionListOption{Title: "Scan for New Lights", Value: "scanNew"})
+	choices = append(choices, suit.ActionListOption{Title: "Add Hub (enter IP above)", Value: "addHub"})
+
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Rename/Reset Lights",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Rename Lights",
+				Subtitle: "Set nice names that make you happy",
+				Contents: lightInputs,
+			},
+			suit.Section{
+				Title:    "Remove Lights",
+				Subtitle: "Removed lights are ignored when scanning and taken out of presets",
+				Contents: []suit.Typed{
+					suit.ActionList{
+						Name:    "removeID",
+						Options: removeOptions,
+						PrimaryAction: &suit.ReplyAction{
+							Name:         "removeLight",
+							Label:        "Remove",
+							DisplayIcon:  "trash",
+							DisplayClass: "danger",
+						},
+					},
+				},
+			},
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Value: "Reset clears all bulbs and (optionally) presets, then scans for current lights",
+					},
+					suit.InputText{
+						Name:   "pollSeconds",
+						Before: "Check for changes every",
+						After:  "seconds",
+						Value:  strconv.Itoa(int(c.driver.pollInterval().Seconds())),
+					},
+					suit.InputText{
+						Name:   "hubTimeoutSeconds",
+						Before: "Wait for the hub for",
+						After:  "seconds",
+						Value:  strconv.Itoa(int(c.driver.retryOptions().Timeout.Seconds())),
+					},
+					suit.InputText{
+						Name:   "hubAttempts",
+						Before: "Try each command",
+						After:  "times if the hub doesn't answer",
+						Value:  strconv.Itoa(c.driver.retryOptions().Attempts),
+					},
+					suit.InputText{
+						Name:        "httpAddress",
+						Before:      "HTTP API address",
+						Placeholder: "Like :8089 (this machine only), empty to turn the API off",
+						Value:       c.driver.config.HTTPAddress,
+					},
+					suit.InputText{
+						Name:        "metricsAddress",
+						Before:      "Metrics address",
+						Placeholder: "Like :9089, to serve just /metrics without the API",
+						Value:       c.driver.config.MetricsAddress,
+					},
+					suit.InputText{
+						Name:        "mqttBroker",
+						Before:      "MQTT broker",
+						Placeholder: "Like 192.168.1.10:1883, for Home Assistant",
+						Value:       c.driver.config.MQTTBroker,
+					},
+					suit.InputText{
+						Name:   "mqttUsername",
+						Before: "MQTT username",
+						Value:  c.driver.config.MQTTUsername,
+					},
+					suit.InputText{
+						Name:        "mqttPassword",
+						Before:      "MQTT password",
+						InputType:   "password",
+						Placeholder: mqttPasswordPlaceholder(c.driver.config.MQTTPassword),
+					},
+					suit.InputText{
+						Name:        "newHubIP",
+						Before:      "New hub IP",
+						Placeholder: "Only needed for hubs that can't be discovered",
+					},
+					suit.StaticText{
+						Value: "Driver version: " + c.driver.DriverSupport.Info.Version,
+					},
+					suit.ActionList{
+						Name:    "choice",
+						Options: choices,
+						PrimaryAction: &suit.ReplyAction{
+							Name: "resetAction",
+						},
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:       "Calibrate Whites",
+				Name:        "calibration",
+				DisplayIcon: "sliders",
+			},
+			suit.ReplyAction{
+				Label:       "Replace App Names",
+				Name:        "syncThingNames",
+				DisplayIcon: "tags",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveRename",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// mqttPasswordPlaceholder hints at whether an MQTT password is set, as the rename screen doesn't show it
+func mqttPasswordPlaceholder(password string) string {
+	if password == "" {
+		return "Not set"
+	}
+	return "Set, leave blank to keep it"
+}
+
+// calibration is a config screen for adjusting the RGB mix used for each colour temperature, per light
+func (c *configService) calibration() (*suit.ConfigurationScreen, error) {
+	inputs := []suit.Typed{}
+	for _, lightID := range c.driver.config.LightIDs {
+		table := c.driver.config.Calibrations[lightID]
+		if len(table) == 0 {
+			table = defaultCalibration
+		}
+		inputs = append(inputs, suit.InputText{
+			Name:   "cal" + lightID,
+			Before: c.driver.config.Names[lightID],
+			Value:  formatCalibration(table),
+		})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Calibrate Whites",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Colour Temperature Calibration",
+				Subtitle: "The RGB mix used for each colour temperature, as Kelvin:R,G,B separated by spaces. Temperatures in between are blended. Clear a light's field to use the default.",
+				Contents: inputs,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "rename",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveCalibration",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// newPreset is a config screen for creating new presets/scenes, including selecting which lights to include
+func (c *configService) newPreset() (*suit.ConfigurationScreen, error) {
+	onLights := c.determineOnLights()
+	lights := []suit.OptionGroupOption{suit.OptionGroupOption{Title: "All lights", Value: "all"}}
+	// whole groups can be selected too
+	for _, name := range c.driver.config.GroupNames {
+		lights = append(lights, suit.OptionGroupOption{
+			Title: "Group: " + name,
+			Value: groupPrefix + name,
+		})
+	}
+	// create option check box for each light
+	for _, lightID := range c.driver.config.LightIDs {
+		selected := false
+
+		if c.isLightOn(lightID, onLights) {
+			selected = true
+		}
+		lights = append(lights, suit.OptionGroupOption{
+			Title:    c.driver.config.Names[lightID],
+			Value:    lightID,
+			Selected: selected,
+		})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Create New Preset",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Choose Settings",
+				Subtitle: "With your lights as you want the scene, select which lights to include below, and click Save. (Lights that are currently on are pre-selected.) Including lights that are currently off will turn them off when the preset is activated.",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "name",
+						Before:      "Preset Name",
+						Placeholder: "(unique name)",
+					},
+					suit.OptionGroup{
+						Title:   "Lights to Include",
+						Name:    "lightIDs",
+						Options: lights,
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "presets",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savePreset",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// editPreset is a config screen for changing the colour and brightness of each light stored in a preset,
+// or leaving lights out of it
+func (c *configService) editPreset() (*suit.ConfigurationScreen, error) {
+	preset, ok := c.driver.config.Presets[c.presetToEdit]
+	if !ok {
+		return c.error(fmt.Sprintf("Unknown preset %v", c.presetToEdit))
+	}
+	sections := []suit.Section{}
+	include := []suit.OptionGroupOption{}
+	for _, light := range preset.Lights {
+		// presets saved by older versions can have blank entries, which are dropped when saved
+		if light.ID == "" {
+			continue
+		}
+		name := c.driver.config.Names[light.ID]
+		if name == "" {
+			name = light.ID
+		}
+		include = append(include, suit.OptionGroupOption{
+			Title:    name,
+			Value:    light.ID,
+			Selected: true,
+		})
+		sections = append(sections, suit.Section{
+			Title: name,
+			Contents: []suit.Typed{
+				suit.InputText{
+					Name:   "color" + light.ID,
+					Before: "Colour",
+					After:  "hex or R,G,B",
+					Value:  sunflower.HexColor(light.R, light.G, light.B),
+				},
+				suit.InputText{
+					Name:   "level" + light.ID,
+					Before: "Brightness",
+					After:  "0-100",
+					Value:  strconv.Itoa(light.Level),
+				},
+			},
+		})
+	}
+	sections = append(sections, suit.Section{
+		Title:    "Lights to Include",
+		Subtitle: "Unselected lights are taken out of the preset",
+		Contents: []suit.Typed{
+			suit.OptionGroup{
+				Name:    "include",
+				Options: include,
+			},
+		},
+	})
+	screen := suit.ConfigurationScreen{
+		Title:    "Yeelight - Edit Preset " + c.presetToEdit,
+		Subtitle: "Saving changes the preset only, not the lights",
+		Sections: sections,
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "presets",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveEditPreset",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// exportPresets is a config screen showing the named presets (or all presets if names is empty) as a JSON document to copy
+func (c *configService) exportPresets(names []string) (*suit.ConfigurationScreen, error) {
+	doc, err := c.driver.ExportPresets(names)
+	if err != nil {
+		return c.error(fmt.Sprintf("Could not export presets: %s", err))
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return c.error(fmt.Sprintf("Could not export presets: %s", err))
+	}
+	return &suit.ConfigurationScreen{
+		Title: "Yeelight - Export Presets",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Presets Document",
+				Subtitle: "Copy this text and paste it into Import on another Sphere",
+				Contents: []suit.Typed{
+					suit.InputTextArea{
+						Name:  "document",
+						Value: string(data),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "presets",
+			},
+		},
+	}, nil
+}
+
+// importPresets is a config screen for pasting in an exported presets document
+func (c *configService) importPresets() (*suit.ConfigurationScreen, error) {
+	return &suit.ConfigurationScreen{
+		Title: "Yeelight - Import Presets",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Presets Document",
+				Subtitle: "Paste the text from Export on another Sphere",
+				Contents: []suit.Typed{
+					suit.InputTextArea{
+						Name:        "document",
+						Placeholder: "{\"Version\": 1, ...}",
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "presets",
+			},
+			suit.ReplyAction{
+				Label:        "Next",
+				Name:         "readImport",
+				DisplayClass: "success",
+				DisplayIcon:  "arrow-right",
+			},
+		},
+	}, nil
+}
+
+// importOptions is a config screen for mapping imported lights to lights on this driver
+// and choosing what to do with imported presets whose names already exist
+func (c *configService) importOptions() (*suit.ConfigurationScreen, error) {
+	sections := []suit.Section{}
+
+	unknown := c.driver.UnknownLights(c.pendingImport)
+	if len(unknown) > 0 {
+		lights := []suit.RadioGroupOption{suit.RadioGroupOption{Title: "Leave out", Value: "", DisplayIcon: "ban"}}
+		for _, lightID := range c.driver.config.LightIDs {
+			lights = append(lights, suit.RadioGroupOption{Title: c.driver.config.Names[lightID], Value: lightID, DisplayIcon: "lightbulb-o"})
+		}
+		contents := []suit.Typed{}
+		for _, id := range unknown {
+			title := id
+			if name := c.pendingImport.LightNames[id]; name != "" {
+				title = name + " (" + id + ")"
+			}
+			contents = append(contents, suit.RadioGroup{
+				Title:   title,
+				Name:    "map" + id,
+				Value:   "",
+				Options: lights,
+			})
+		}
+		sections = append(sections, suit.Section{
+			Title:    "Map Lights",
+			Subtitle: "These lights in the presets aren't on this hub. Choose which light to use instead.",
+			Contents: contents,
+		})
+	}
+
+	colliding := c.driver.CollidingPresets(c.pendingImport)
+	if len(colliding) > 0 {
+		contents := []suit.Typed{}
+		for _, name := range colliding {
+			contents = append(contents, suit.RadioGroup{
+				Title: name,
+				Name:  "collide" + name,
+				Value: importRename,
+				Options: []suit.RadioGroupOption{
+					suit.RadioGroupOption{Title: "Import with a new name", Value: importRename, DisplayIcon: "copy"},
+					suit.RadioGroupOption{Title: "Overwrite existing", Value: importOverwrite, DisplayIcon: "exchange"},
+					suit.RadioGroupOption{Title: "Skip", Value: importSkip, DisplayIcon: "ban"},
+				},
+			})
+		}
+		sections = append(sections, suit.Section{
+			Title:    "Existing Presets",
+			Subtitle: "These presets already exist",
+			Contents: contents,
+		})
+	}
+
+	return &suit.ConfigurationScreen{
+		Title:    "Yeelight - Import Presets",
+		Sections: sections,
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "presets",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "confirmImport",
+				DisplayClass: "success",
+				DisplayIcon:  "check",
+			},
+		},
+	}, nil
+}
+
+// presets is a config screen that displays current presets and allows you to activate them,
+// plus a button to create a new preset
+func (c *configService) presets() (*suit.ConfigurationScreen, error) {
+	presets := []suit.ActionListOption{}
+
+	// create action option for each preset
+	for _, name := range c.driver.config.PresetNames {
+		presets = append(presets, suit.ActionListOption{
+			Title: name,
+			Value: name,
+		})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Presets",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Current Presets",
+				Subtitle: "Click to activate scene. To capture the lights as they are now into an existing preset, create a new one with the same name.",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:   "fade",
+						Before: "Fade in over",
+						After:  "seconds",
+						Value:  strconv.Itoa(c.driver.config.FadeSeconds),
+					},
+					suit.ActionList{
+						Name:    "name", // the field name for which preset was clicked
+						Options: presets,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "presetOn",
+							Label:       "On",
+							DisplayIcon: "toggle-on",
+						},
+						SecondaryAction: &suit.ReplyAction{
+							Name:         "deletePreset",
+							Label:        "Delete",
+							DisplayIcon:  "trash",
+							DisplayClass: "danger",
+						},
+					},
+				},
+			},
+			suit.Section{
+				Title:    "Edit Presets",
+				Subtitle: "Change the colour and brightness of each light in a preset",
+				Contents: []suit.Typed{
+					suit.ActionList{
+						Name:    "editName", // the field name for which preset was clicked
+						Options: presets,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "editPreset",
+							Label:       "Edit",
+							DisplayIcon: "pencil",
+						},
+						SecondaryAction: &suit.ReplyAction{
+							Name:        "exportPreset",
+							Label:       "Export",
+							DisplayIcon: "download",
+						},
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:       "Export All",
+				Name:        "exportPresets",
+				DisplayIcon: "download",
+			},
+			suit.ReplyAction{
+				Label:       "Import",
+				Name:        "importPresets",
+				DisplayIcon: "upload",
+			},
+			suit.ReplyAction{
+				Label:        "New Preset",
+				Name:         "newPreset",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// schedules is a config screen that lists schedules and allows you to enable/disable or delete them,
+// plus a button to create a new schedule
+func (c *configService) schedules() (*suit.ConfigurationScreen, error) {
+	schedules := []suit.ActionListOption{}
+	for _, schedule := range c.driver.config.Schedules {
+		title := schedule.Description()
+		subtitle := "Enabled - click to disable"
+		if !schedule.Enabled {
+			subtitle = "Disabled - click to enable"
+		}
+		if _, ok := c.driver.config.Presets[schedule.Preset]; !schedule.AllOff && !ok {
+			subtitle = "Preset no longer exists"
+		}
+		schedules = append(schedules, suit.ActionListOption{
+			Title:    title,
+			Subtitle: subtitle,
+			Value:    schedule.ID,
+		})
+	}
+	zone := c.driver.config.TimeZone
+	if zone == "" {
+		zone = time.Local.String()
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Schedules",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Schedules",
+				Subtitle: "Presets (or all off) that run at a time of day",
+				Contents: []suit.Typed{
+					suit.ActionList{
+						Name:    "scheduleID", // the field name for which schedule was clicked
+						Options: schedules,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "toggleSchedule",
+							Label:       "Enable/Disable",
+							DisplayIcon: "toggle-on",
+						},
+						SecondaryAction: &suit.ReplyAction{
+							Name:         "deleteSchedule",
+							Label:        "Delete",
+							DisplayIcon:  "trash",
+							DisplayClass: "danger",
+						},
+					},
+				},
+			},
+			suit.Section{
+				Title:    "Location",
+				Subtitle: "Schedules run in " + zone + " (leave blank for the Sphere's time zone). Latitude and longitude are needed for sunrise and sunset times.",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "timeZone",
+						Before:      "Time zone",
+						Placeholder: "e.g. Australia/Brisbane",
+						Value:       c.driver.config.TimeZone,
+					},
+					suit.InputText{
+						Name:        "latitude",
+						Before:      "Latitude",
+						Placeholder: "degrees, negative for south",
+						Value:       strconv.FormatFloat(c.driver.config.Latitude, 'f', -1, 64),
+					},
+					suit.InputText{
+						Name:        "longitude",
+						Before:      "Longitude",
+						Placeholder: "degrees, negative for west",
+						Value:       strconv.FormatFloat(c.driver.config.Longitude, 'f', -1, 64),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:       "Save Location",
+				Name:        "saveLocation",
+				DisplayIcon: "globe",
+			},
+			suit.ReplyAction{
+				Label:        "New Schedule",
+				Name:         "newSchedule",
+				DisplayClass: "success",
+				DisplayIcon:  "clock-o",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// effects is a config screen showing the effects that are running, and for starting one on some lights or groups
+func (c *configService) effects() (*suit.ConfigurationScreen, error) {
+	running := []suit.Typed{}
+	for _, description := range c.driver.RunningEffects() {
+		running = append(running, suit.StaticText{Value: description})
+	}
+	if len(running) == 0 {
+		running = append(running, suit.StaticText{Value: "No effects are running"})
+	}
+	options := []suit.RadioGroupOption{}
+	for _, name := range EffectNames {
+		options = append(options, suit.RadioGroupOption{Title: effects[name].title, Value: name, DisplayIcon: "magic"})
+	}
+	lights := []suit.OptionGroupOption{suit.OptionGroupOption{Title: "All lights", Value: "all"}}
+	for _, name := range c.driver.config.GroupNames {
+		lights = append(lights, suit.OptionGroupOption{
+			Title: "Group: " + name,
+			Value: groupPrefix + name,
+		})
+	}
+	for _, lightID := range c.driver.config.LightIDs {
+		lights = append(lights, suit.OptionGroupOption{
+			Title: c.driver.config.Names[lightID],
+			Value: lightID,
+		})
+	}
 	screen := suit.ConfigurationScreen{
-		Title: "Yeelight - Rename/Reset Lights",
+		Title: "Yeelight - Effects",
 		Sections: []suit.Section{
 			suit.Section{
-				Title:    "Rename Lights",
-				Subtitle: "Set nice names that make you happy",
-				Contents: lightInputs,
+				Title:    "Running",
+				Subtitle: "Effects stop when a light in them is changed",
+				Contents: running,
 			},
 			suit.Section{
+				Title: "Start an Effect",
 				Contents: []suit.Typed{
-					suit.StaticText{
-						Value: "Reset clears all bulbs and (optionally) presets, then scans for current lights",
+					suit.RadioGroup{
+						Title:   "Effect",
+						Name:    "effect",
+						Value:   EffectNames[0],
+						Options: options,
 					},
-					suit.StaticText{
-						Value: "Driver version: " + c.driver.DriverSupport.Info.Version,
+					suit.OptionGroup{
+						Title:   "Lights",
+						Name:    "lightIDs",
+						Options: lights,
 					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "list",
+			},
+			suit.ReplyAction{
+				Label:        "Stop All",
+				Name:         "stopEffects",
+				DisplayClass: "danger",
+				DisplayIcon:  "stop",
+			},
+			suit.ReplyAction{
+				Label:        "Start",
+				Name:         "startEffect",
+				DisplayClass: "success",
+				DisplayIcon:  "play",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// alerts is a config screen listing the alerts, for testing or deleting them
+func (c *configService) alerts() (*suit.ConfigurationScreen, error) {
+	alerts := []suit.ActionListOption{}
+	for _, alert := range c.driver.config.Alerts {
+		alerts = append(alerts, suit.ActionListOption{
+			Title:    alert.Name,
+			Subtitle: fmt.Sprintf("%v - %d flashes of %v", alert.Topic, alert.Flashes, strings.Join(alert.Colors, " ")),
+			Value:    alert.ID,
+		})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - Alerts",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Alerts",
+				Subtitle: "Lights flash when a message arrives on the alert's MQTT topic, then go back to how they were",
+				Contents: []suit.Typed{
 					suit.ActionList{
-						Name:    "choice",
-						Options: choices,
+						Name:    "alertID", // the field name for which alert was clicked
+						Options: alerts,
 						PrimaryAction: &suit.ReplyAction{
-							Name: "resetAction",
+							Name:        "testAlert",
+							Label:       "Test",
+							DisplayIcon: "bell",
+						},
+						SecondaryAction: &suit.ReplyAction{
+							Name:         "deleteAlert",
+							Label:        "Delete",
+							DisplayIcon:  "trash",
+							DisplayClass: "danger",
 						},
 					},
 				},
@@ -262,51 +1449,64 @@ func (c *configService) rename() (*suit.ConfigurationScreen, error) {
 		},
 		Actions: []suit.Typed{
 			suit.ReplyAction{
-				Label: "Cancel",
+				Label: "Back",
 				Name:  "list",
 			},
 			suit.ReplyAction{
-				Label:        "Save",
-				Name:         "saveRename",
+				Label:        "New Alert",
+				Name:         "newAlert",
 				DisplayClass: "success",
-				DisplayIcon:  "save",
+				DisplayIcon:  "plus",
 			},
 		},
 	}
 	return &screen, nil
 }
 
-// newPreset is a config screen for creating new presets/scenes, including selecting which lights to include
-func (c *configService) newPreset() (*suit.ConfigurationScreen, error) {
-	onLights := c.determineOnLights()
+// newAlert is a config screen for creating an alert: its topic, lights and flashing pattern
+func (c *configService) newAlert() (*suit.ConfigurationScreen, error) {
 	lights := []suit.OptionGroupOption{suit.OptionGroupOption{Title: "All lights", Value: "all"}}
-	// create option check box for each light
+	for _, name := range c.driver.config.GroupNames {
+		lights = append(lights, suit.OptionGroupOption{
+			Title: "Group: " + name,
+			Value: groupPrefix + name,
+		})
+	}
 	for _, lightID := range c.driver.config.LightIDs {
-		selected := false
-
-		if c.isLightOn(lightID, onLights) {
-			selected = true
-		}
 		lights = append(lights, suit.OptionGroupOption{
-			Title:    c.driver.config.Names[lightID],
-			Value:    lightID,
-			Selected: selected,
+			Title: c.driver.config.Names[lightID],
+			Value: lightID,
 		})
 	}
 	screen := suit.ConfigurationScreen{
-		Title: "Yeelight - Create New Preset",
+		Title: "Yeelight - New Alert",
 		Sections: []suit.Section{
 			suit.Section{
-				Title:    "Choose Settings",
-				Subtitle: "With your lights as you want the scene, select which lights to include below, and click Save. (Lights that are currently on are pre-selected.) Including lights that are currently off will turn them off when the preset is activated.",
+				Title: "Choose Settings",
 				Contents: []suit.Typed{
 					suit.InputText{
 						Name:        "name",
-						Before:      "Preset Name",
-						Placeholder: "(unique name)",
+						Before:      "Alert Name",
+						Placeholder: "e.g. Doorbell",
+					},
+					suit.InputText{
+						Name:        "topic",
+						Before:      "MQTT Topic",
+						Placeholder: "e.g. home/doorbell",
+					},
+					suit.InputText{
+						Name:        "colors",
+						Before:      "Colours",
+						After:       "hex or R,G,B, separated by spaces",
+						Placeholder: "#ff0000 #0000ff",
+					},
+					suit.InputText{
+						Name:   "flashes",
+						Before: "Flashes",
+						Value:  "3",
 					},
 					suit.OptionGroup{
-						Title:   "Lights to Include",
+						Title:   "Lights to Flash",
 						Name:    "lightIDs",
 						Options: lights,
 					},
@@ -316,11 +1516,11 @@ func (c *configService) newPreset() (*suit.ConfigurationScreen, error) {
 		Actions: []suit.Typed{
 			suit.ReplyAction{
 				Label: "Cancel",
-				Name:  "presets",
+				Name:  "alerts",
 			},
 			suit.ReplyAction{
 				Label:        "Save",
-				Name:         "savePreset",
+				Name:         "saveAlert",
 				DisplayClass: "success",
 				DisplayIcon:  "save",
 			},
@@ -329,35 +1529,41 @@ func (c *configService) newPreset() (*suit.ConfigurationScreen, error) {
 	return &screen, nil
 }
 
-// presets is a config screen that displays current presets and allows you to activate them,
-// plus a button to create a new preset
-func (c *configService) presets() (*suit.ConfigurationScreen, error) {
-	presets := []suit.ActionListOption{}
-
-	// create action option for each preset
-	for _, name := range c.driver.config.PresetNames {
-		presets = append(presets, suit.ActionListOption{
-			Title: name,
-			Value: name,
+// groups is a config screen listing the groups (rooms) of lights, for editing or deleting them
+func (c *configService) groups() (*suit.ConfigurationScreen, error) {
+	groups := []suit.ActionListOption{}
+	for _, name := range c.driver.config.GroupNames {
+		var lightNames []string
+		for _, id := range c.driver.config.Groups[name].LightIDs {
+			lightNames = append(lightNames, c.driver.config.Names[id])
+		}
+		subtitle := strings.Join(lightNames, ", ")
+		if subtitle == "" {
+			subtitle = "No lights"
+		}
+		groups = append(groups, suit.ActionListOption{
+			Title:    name,
+			Subtitle: subtitle,
+			Value:    name,
 		})
 	}
 	screen := suit.ConfigurationScreen{
-		Title: "Yeelight - Presets",
+		Title: "Yeelight - Groups",
 		Sections: []suit.Section{
 			suit.Section{
-				Title:    "Current Presets",
-				Subtitle: "Click to activate scene. To change an existing preset, create a new one with the same name.",
+				Title:    "Groups",
+				Subtitle: "Each group appears as a light that controls all the lights in it",
 				Contents: []suit.Typed{
 					suit.ActionList{
-						Name:    "name", // the field name for which preset was clicked
-						Options: presets,
+						Name:    "groupName", // the field name for which group was clicked
+						Options: groups,
 						PrimaryAction: &suit.ReplyAction{
-							Name:        "presetOn",
-							Label:       "On",
-							DisplayIcon: "toggle-on",
+							Name:        "editGroup",
+							Label:       "Edit",
+							DisplayIcon: "pencil",
 						},
 						SecondaryAction: &suit.ReplyAction{
-							Name:         "deletePreset",
+							Name:         "deleteGroup",
 							Label:        "Delete",
 							DisplayIcon:  "trash",
 							DisplayClass: "danger",
@@ -372,10 +1578,144 @@ func (c *configService) presets() (*suit.ConfigurationScreen, error) {
 				Name:  "list",
 			},
 			suit.ReplyAction{
-				Label:        "New Preset",
-				Name:         "newPreset",
+				Label:        "New Group",
+				Name:         "newGroup",
 				DisplayClass: "success",
-				DisplayIcon:  "star",
+				DisplayIcon:  "plus",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// editGroup is a config screen for naming a group and choosing its lights, for a new group if c.groupToEdit is empty
+func (c *configService) editGroup() (*suit.ConfigurationScreen, error) {
+	var members []string
+	title := "Yeelight - New Group"
+	if c.groupToEdit != "" {
+		group, ok := c.driver.config.Groups[c.groupToEdit]
+		if !ok {
+			return c.error(fmt.Sprintf("Unknown group %v", c.groupToEdit))
+		}
+		members = group.LightIDs
+		title = "Yeelight - Edit Group " + c.groupToEdit
+	}
+	lights := []suit.OptionGroupOption{}
+	for _, lightID := range c.driver.config.LightIDs {
+		lights = append(lights, suit.OptionGroupOption{
+			Title:    c.driver.config.Names[lightID],
+			Value:    lightID,
+			Selected: containsString(members, lightID),
+		})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: title,
+		Sections: []suit.Section{
+			suit.Section{
+				Title: "Choose Settings",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "name",
+						Before:      "Group Name",
+						Placeholder: "e.g. Lounge",
+						Value:       c.groupToEdit,
+					},
+					suit.OptionGroup{
+						Title:   "Lights in Group",
+						Name:    "lightIDs",
+						Options: lights,
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "groups",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveGroup",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// newSchedule is a config screen for creating a schedule: time, days and what to do
+func (c *configService) newSchedule() (*suit.ConfigurationScreen, error) {
+	days := []suit.OptionGroupOption{}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		days = append(days, suit.OptionGroupOption{
+			Title:    day.String(),
+			Value:    strconv.Itoa(int(day)),
+			Selected: true,
+		})
+	}
+	actions := []suit.RadioGroupOption{suit.RadioGroupOption{Title: "Turn all lights off", Value: "off", DisplayIcon: "toggle-off"}}
+	for _, name := range c.driver.config.PresetNames {
+		actions = append(actions, suit.RadioGroupOption{Title: "Preset: " + name, Value: "preset:" + name, DisplayIcon: "star"})
+	}
+	screen := suit.ConfigurationScreen{
+		Title: "Yeelight - New Schedule",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "When",
+				Subtitle: "At a time of day, or minutes after (negative for before) sunrise, sunset or civil dawn/dusk",
+				Contents: []suit.Typed{
+					suit.RadioGroup{
+						Name:  "when",
+						Value: "time",
+						Options: []suit.RadioGroupOption{
+							suit.RadioGroupOption{Title: "Time of day", Value: "time", DisplayIcon: "clock-o"},
+							suit.RadioGroupOption{Title: "Dawn", Value: CivilDawn, DisplayIcon: "adjust"},
+							suit.RadioGroupOption{Title: "Sunrise", Value: Sunrise, DisplayIcon: "sun-o"},
+							suit.RadioGroupOption{Title: "Sunset", Value: Sunset, DisplayIcon: "sun-o"},
+							suit.RadioGroupOption{Title: "Dusk", Value: CivilDusk, DisplayIcon: "moon-o"},
+						},
+					},
+					suit.InputTime{
+						Title: "Time of day",
+						Name:  "time",
+						Value: "07:00",
+					},
+					suit.InputText{
+						Name:   "offset",
+						Before: "Offset",
+						After:  "minutes",
+						Value:  "0",
+					},
+					suit.OptionGroup{
+						Title:          "Days",
+						Name:           "days",
+						MinimumChoices: 1,
+						Options:        days,
+					},
+				},
+			},
+			suit.Section{
+				Title: "What",
+				Contents: []suit.Typed{
+					suit.RadioGroup{
+						Name:    "action",
+						Value:   "off",
+						Options: actions,
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "schedules",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveSchedule",
+				DisplayClass: "success",
+				DisplayIcon:  "save",
 			},
 		},
 	}
@@ -385,28 +1725,40 @@ func (c *configService) presets() (*suit.ConfigurationScreen, error) {
 // list displays the main screen with lights to control, plus buttons for other main actions
 func (c *configService) list() (*suit.ConfigurationScreen, error) {
 	var screen suit.ConfigurationScreen
-	err := c.driver.CheckHub()
-	if err != nil {
-		// if hub is not responding, produce custom error screen with option to refresh/rescan
-		log.Printf("Error: %v\n", err)
+	offlineHubs := c.driver.OfflineHubs()
+	if len(offlineHubs) == len(c.driver.config.Hubs) {
+		// if no hub is responding, produce custom error screen with option to refresh/rescan
+		ipInputs := []suit.Typed{
+			suit.StaticText{
+				Value: "Driver version: " + c.driver.DriverSupport.Info.Version,
+			},
+			suit.StaticText{
+				Value: "You could try setting the IP manually...",
+			},
+		}
+		for _, hub := range c.driver.config.Hubs {
+			if status := c.driver.HubStatus(hub.ID); !status.Online {
+				ipInputs = append(ipInputs, suit.StaticText{
+					Value: fmt.Sprintf("%v offline since %v", hub.Label(), status.Since.Format("Jan 2 15:04")),
+				})
+			}
+			ipInputs = append(ipInputs, suit.InputText{
+				Title: "IP address of hub " + hub.ID,
+				Name:  "ip" + hub.ID,
+				Value: hub.IP,
+			})
+		}
+		ipInputs = append(ipInputs, suit.InputText{
+			Title:       "Add a hub",
+			Name:        "ip",
+			Placeholder: "IP address",
+		})
 		screen = suit.ConfigurationScreen{
 			Title: "Yeelight Sunflower - Error",
 			Sections: []suit.Section{
 				suit.Section{
-					Title: "Hub is not responding. Check that the Yeelight hub is connected and switched on, then click Refresh below.",
-					Contents: []suit.Typed{
-						suit.StaticText{
-							Value: "Driver version: " + c.driver.DriverSupport.Info.Version,
-						},
-						suit.StaticText{
-							Value: "You could try setting the IP manually...",
-						},
-						suit.InputText{
-							Title: "IP address",
-							Name:  "ip",
-							Value: c.driver.config.IP,
-						},
-					},
+					Title:    "Hub is not responding. Check that the Yeelight hub is connected and switched on, then click Refresh below.",
+					Contents: ipInputs,
 				},
 			},
 			Actions: []suit.Typed{
@@ -428,48 +1780,66 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 			},
 		}
 	} else {
-		// hub is alive so make normal list
-		var lightActions []suit.ActionListOption
+		// at least one hub is alive so make normal list
 		onLights := c.determineOnLights()
+		var sections []suit.Section
 
-		// create action option for each light
-		for _, lightID := range c.driver.config.LightIDs {
-			title := c.driver.config.Names[lightID]
-			if c.isLightOn(lightID, onLights) {
-				title += " *"
+		// On/Off buttons for controlling the lights on each hub
+		for _, hub := range c.driver.config.Hubs {
+			var lightActions []suit.ActionListOption
+			// create action option for each light, in the order of the config
+			for _, lightID := range c.driver.config.LightIDs {
+				if !containsString(hub.LightIDs, lightID) {
+					continue
+				}
+				title := c.driver.config.Names[lightID]
+				if c.isLightOn(lightID, onLights) {
+					title += " *"
+				}
+				subtitle := lightID
+				if containsString(hub.Missing, lightID) {
+					subtitle += " (missing from hub)"
+				}
+				lightActions = append(lightActions, suit.ActionListOption{
+					Title:    title,
+					Subtitle: subtitle,
+					Value:    lightID,
+				})
+			}
+			subtitle := "* indicates light is currently on"
+			if containsString(offlineHubs, hub.ID) {
+				subtitle = "Hub is not responding"
+			}
+			title := "Switch Lights"
+			if len(c.driver.config.Hubs) > 1 {
+				title += " - " + hub.Label()
 			}
-			lightActions = append(lightActions, suit.ActionListOption{
+			sections = append(sections, suit.Section{
 				Title:    title,
-				Subtitle: lightID,
-				Value:    lightID,
+				Subtitle: subtitle,
+				Contents: []suit.Typed{
+					suit.ActionList{
+						Name:    "lightID", // the field name for which light was clicked
+						Options: lightActions,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "on",
+							Label:       "On",
+							DisplayIcon: "toggle-on",
+						},
+						SecondaryAction: &suit.ReplyAction{
+							Name:         "off",
+							Label:        "Off",
+							DisplayIcon:  "toggle-off",
+							DisplayClass: "danger",
+						},
+					},
+				},
 			})
 		}
 
 		screen = suit.ConfigurationScreen{
 			Title: "Yeelight Sunflower - Main",
-			Sections: []suit.Section{
-				// On/Off buttons for controlling all lights
-				suit.Section{
-					Title:    "Switch Lights",
-					Subtitle: "* indicates light is currently on",
-					Contents: []suit.Typed{
-						suit.ActionList{
-							Name:    "lightID", // the field name for which light was clicked
-							Options: lightActions,
-							PrimaryAction: &suit.ReplyAction{
-								Name:        "on",
-								Label:       "On",
-								DisplayIcon: "toggle-on",
-							},
-							SecondaryAction: &suit.ReplyAction{
-								Name:         "off",
-								Label:        "Off",
-								DisplayIcon:  "toggle-off",
-								DisplayClass: "danger",
-							},
-						},
-					},
-				},
+			Sections: append(sections,
 				// extra button for turning off all lights
 				suit.Section{
 					Contents: []suit.Typed{
@@ -483,7 +1853,7 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 						},
 					},
 				},
-			},
+			),
 			Actions: []suit.Typed{
 				suit.CloseAction{
 					Label: "Close",
@@ -499,6 +1869,26 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 					DisplayClass: "info",
 					DisplayIcon:  "list-ul",
 				},
+				suit.ReplyAction{
+					Label:       "Groups",
+					Name:        "groups",
+					DisplayIcon: "object-group",
+				},
+				suit.ReplyAction{
+					Label:       "Effects",
+					Name:        "effects",
+					DisplayIcon: "magic",
+				},
+				suit.ReplyAction{
+					Label:       "Alerts",
+					Name:        "alerts",
+					DisplayIcon: "bell",
+				},
+				suit.ReplyAction{
+					Label:       "Schedules",
+					Name:        "schedules",
+					DisplayIcon: "clock-o",
+				},
 			},
 		}
 	}
@@ -599,15 +1989,59 @@ func (c *configService) confirmDeletePreset() (*suit.ConfigurationScreen, error)
 	}, nil
 }
 
+// confirmRemoveLight is a config screen to confirm/cancel removing a light
+func (c *configService) confirmRemoveLight() (*suit.ConfigurationScreen, error) {
+	return &suit.ConfigurationScreen{
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.Alert{
+						Title:        "Confirm Remove Light",
+						Subtitle:     "Do you really want to remove " + c.driver.config.Names[c.lightToRemove] + "? It will be taken out of all presets and ignored when scanning. It will stop responding now and disappear when the driver restarts.",
+						DisplayClass: "danger",
+						DisplayIcon:  "warning",
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:       "Cancel",
+				Name:        "rename",
+				DisplayIcon: "close",
+			},
+			suit.ReplyAction{
+				Label:        "Confirm",
+				Name:         "confirmRemoveLight",
+				DisplayClass: "warning",
+				DisplayIcon:  "check",
+			},
+		},
+	}, nil
+}
+
+// setOnOff turns a light on or off through its device, so the device state is updated too
+func (c *configService) setOnOff(lightID string, on bool) error {
+	device, ok := c.driver.devices[lightID]
+	if !ok {
+		return fmt.Errorf("Unknown light %v", lightID)
+	}
+	return device.applyLightState(&devices.LightDeviceState{OnOff: &on})
+}
+
 // determineOnLights gets current light values and returns a list of the IDs of lights that are on
 func (c *configService) determineOnLights() []string {
-	var lightData []yeelight.Light
 	var onLightIDs []string
-	// get light data
-	lightData, _ = yeelight.GetLights(c.driver.config.IP)
-	for _, light := range lightData {
-		if light.Level > 0 {
-			onLightIDs = append(onLightIDs, light.ID)
+	// get light data, skipping hubs the monitor has found offline rather than waiting for them to time out
+	for _, hub := range c.driver.config.Hubs {
+		if !c.driver.HubStatus(hub.ID).Online {
+			continue
+		}
+		lightData, _ := c.driver.hubClient(hub.ID).GetLights()
+		for _, light := range lightData {
+			if light.Level > 0 {
+				onLightIDs = append(onLightIDs, light.ID)
+			}
 		}
 	}
 	return onLightIDs
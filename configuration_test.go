@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// configure sends a request to the Labs service the way the Sphere does, returning the screen it replies with
+func configure(t *testing.T, c *configService, action string, data interface{}) *suit.ConfigurationScreen {
+	t.Helper()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	screen, err := c.Configure(&model.ConfigurationRequest{Action: action, Data: raw})
+	if err != nil {
+		t.Fatalf("%v: %v", action, err)
+	}
+	return screen
+}
+
+// screenError returns the message of the error shown on a screen, if there is one
+func screenError(screen *suit.ConfigurationScreen) string {
+	for _, section := range screen.Sections {
+		for _, content := range section.Contents {
+			if alert, ok := content.(suit.Alert); ok && alert.Title == "Error" {
+				return alert.Subtitle
+			}
+		}
+	}
+	return ""
+}
+
+func TestSetIP(t *testing.T) {
+	lights := []yeelight.Light{{ID: "4F1A", Level: 60}, {ID: "238B"}}
+	tests := []struct {
+		name string
+		data func(old, moved string) map[string]string // the fields from the error screen
+	}{
+		// the new IP typed in for the hub
+		{"existing hub", func(old, moved string) map[string]string { return map[string]string{"ip1": moved, "ip": ""} }},
+		// or added as a new hub, which turns out to have the lights of the old one
+		{"added hub", func(old, moved string) map[string]string { return map[string]string{"ip1": old, "ip": moved} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			old := startHub(t, lights...)
+			d := newTestDriver(t)
+			d.config.Hubs = []*HubConfig{{ID: "1", IP: old.IP()}}
+			if err := d.ScanLightsToConfig(); err != nil {
+				t.Fatalf("ScanLightsToConfig: %v", err)
+			}
+			d.CreateDevicesFromConfig()
+			c := &configService{driver: d}
+
+			// the hub gets a new address (started first so it can't take the old one)
+			moved := startHub(t, lights...)
+			old.Close()
+			data := test.data(old.IP(), moved.IP())
+			if message := screenError(configure(t, c, "setip", data)); message != "" {
+				t.Fatalf("setip failed: %v", message)
+			}
+
+			if len(d.config.Hubs) != 1 || d.config.Hubs[0].ID != "1" || d.config.Hubs[0].IP != moved.IP() {
+				t.Fatalf("hubs after setip = %+v, want hub 1 at %v", d.config.Hubs, moved.IP())
+			}
+			if len(d.config.Hubs[0].LightIDs) != 2 || len(d.config.Hubs[0].Missing) != 0 || len(d.devices) != 2 {
+				t.Errorf("hub lights %v (missing %v), %d devices", d.config.Hubs[0].LightIDs, d.config.Hubs[0].Missing, len(d.devices))
+			}
+			// and the lights are controlled at the new address
+			d.mu.Lock()
+			err := d.devices["4F1A"].hub.SetLight("4F1A", 1, 2, 3, 4)
+			d.mu.Unlock()
+			if err != nil {
+				t.Fatalf("SetLight after moving the hub: %v", err)
+			}
+			if light, _ := moved.Light("4F1A"); light.Level != 4 {
+				t.Errorf("light on the moved hub = %+v", light)
+			}
+		})
+	}
+
+	// an address for a hub that isn't configured is an error
+	d := newTestDriver(t)
+	c := &configService{driver: d}
+	if screenError(configure(t, c, "setip", map[string]string{"ip7": "127.0.0.1"})) == "" {
+		t.Errorf("setip for an unknown hub succeeded")
+	}
+}
+
+func TestListUsesHubStatus(t *testing.T) {
+	upstairs := startHub(t, yeelight.Light{ID: "4F1A", Level: 60})
+	downstairs := startHub(t, yeelight.Light{ID: "238B", Level: 60})
+	d := newTestDriver(t)
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: upstairs.IP()}, {ID: "2", IP: downstairs.IP()}}
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	// a monitor that has seen hub 2 go offline, but isn't running
+	d.monitor = newHubMonitor(d.ctx, d, time.Hour)
+	d.monitor.record(d.config.Hubs[1], fmt.Errorf("No answer"))
+	c := &configService{driver: d}
+
+	// the screen doesn't wait on the hub the monitor has found offline (which would take the 1s timeout)
+	downstairs.SetDelay(2 * time.Second)
+	start := time.Now()
+	screen := fmt.Sprintf("%+v", configure(t, c, "list", nil))
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("list took %v", took)
+	}
+	if !strings.Contains(screen, "Hub is not responding") || !strings.Contains(screen, "Yee4F1A *") {
+		t.Errorf("list with hub 2 offline = %v", screen)
+	}
+
+	d.monitor.record(d.config.Hubs[0], fmt.Errorf("No answer"))
+	if screen := fmt.Sprintf("%+v", configure(t, c, "list", nil)); !strings.Contains(screen, "Yeelight Sunflower - Error") {
+		t.Errorf("list with every hub offline = %v", screen)
+	}
+
+	// refreshing finds the hubs answering again
+	downstairs.SetDelay(0)
+	screen = fmt.Sprintf("%+v", configure(t, c, "refresh", nil))
+	if strings.Contains(screen, "Error") || strings.Contains(screen, "Hub is not responding") {
+		t.Errorf("list after refresh = %v", screen)
+	}
+	if offline := d.OfflineHubs(); len(offline) != 0 {
+		t.Errorf("offline hubs after refresh = %v", offline)
+	}
+}
+
+func TestConfirmReset(t *testing.T) {
+	for _, keepPresets := range []bool{true, false} {
+		d, _, _ := newFakeHubDriver(t)
+		d.config.Hubs[1].USN = "uuid:hub-2"
+		d.config.IgnoredIDs = []string{"C1"}
+		d.config.GroupNames = []string{"Lounge"}
+		d.config.Groups["Lounge"] = &Group{LightIDs: []string{"A1", "B1"}}
+		d.config.ThingNames = map[string]string{"A1": "Lamp"}
+		d.config.PresetNames = []string{"Evening"}
+		d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "A1", Level: 40}}}
+		d.config.Alerts = []*Alert{{ID: "1", Name: "Doorbell", Topic: "doorbell"}}
+		d.config.Schedules = []*Schedule{{ID: "1", Event: "Sunset", Preset: "Evening", Enabled: true}}
+		d.config.TimeZone = "Australia/Brisbane"
+		d.config.Latitude, d.config.Longitude = -27.47, 153.03
+		d.config.HTTPAddress = ":8089"
+		d.config.MQTTBroker, d.config.MQTTUsername, d.config.MQTTPassword = "broker:1883", "sphere", "secret"
+		d.config.Names["A1"] = "Lamp"
+		old := *d.config
+
+		options := []string{}
+		if keepPresets {
+			options = append(options, "keepPresets")
+		}
+		if message := screenError(configure(t, &configService{driver: d}, "confirmReset", map[string][]string{"options": options})); message != "" {
+			t.Fatalf("confirmReset failed: %v", message)
+		}
+
+		config := d.config
+		if config.Names["A1"] != "YeeA1" {
+			t.Errorf("names after reset = %v, want the defaults from scanning again", config.Names)
+		}
+		if len(config.Hubs) != 2 || config.Hubs[1].ID != "2" || config.Hubs[1].IP != "10.0.0.2" || config.Hubs[1].USN != "uuid:hub-2" {
+			t.Errorf("hubs after reset = %+v", config.Hubs)
+		}
+		if len(config.LightIDs) != 3 || fmt.Sprint(config.Hubs[0].LightIDs) != "[A1 A2]" {
+			t.Errorf("lights after reset = %v, hub 1 %v, want them scanned again", config.LightIDs, config.Hubs[0].LightIDs)
+		}
+		kept := []struct {
+			name      string
+			got, want interface{}
+		}{
+			{"ignored lights", config.IgnoredIDs, old.IgnoredIDs},
+			{"groups", config.Groups, old.Groups},
+			{"group names", config.GroupNames, old.GroupNames},
+			{"thing names", config.ThingNames, old.ThingNames},
+			{"alerts", config.Alerts, old.Alerts},
+			{"schedules", config.Schedules, old.Schedules},
+			{"time zone", config.TimeZone, old.TimeZone},
+			{"location", []float64{config.Latitude, config.Longitude}, []float64{old.Latitude, old.Longitude}},
+			{"HTTP address", config.HTTPAddress, old.HTTPAddress},
+			{"MQTT", []string{config.MQTTBroker, config.MQTTUsername, config.MQTTPassword}, []string{old.MQTTBroker, old.MQTTUsername, old.MQTTPassword}},
+		}
+		for _, field := range kept {
+			if fmt.Sprint(field.got) != fmt.Sprint(field.want) {
+				t.Errorf("%v after reset = %v, want %v", field.name, field.got, field.want)
+			}
+		}
+		if presets := len(config.PresetNames) > 0 && config.Presets["Evening"] != nil; presets != keepPresets {
+			t.Errorf("presets after reset = %v %v, want kept %v", config.PresetNames, config.Presets, keepPresets)
+		}
+	}
+}
+
+func TestMQTTPassword(t *testing.T) {
+	d := newTestDriver(t)
+	c := &configService{driver: d}
+	save := func(username, password string) {
+		t.Helper()
+		values := map[string]string{"mqttBroker": "127.0.0.1:1", "mqttUsername": username, "mqttPassword": password}
+		if message := screenError(configure(t, c, "saveRename", values)); message != "" {
+			t.Fatalf("saveRename failed: %v", message)
+		}
+	}
+	save("sphere", "secret")
+	if d.config.MQTTPassword != "secret" {
+		t.Fatalf("password = %q after setting it", d.config.MQTTPassword)
+	}
+
+	// the form doesn't show the password, so sending it back blank keeps it
+	raw, err := json.Marshal(configure(t, c, "rename", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "secret") {
+		t.Errorf("rename screen shows the MQTT password: %s", raw)
+	}
+	save("sphere", "")
+	if d.config.MQTTPassword != "secret" {
+		t.Errorf("password = %q after saving it blank, want it kept", d.config.MQTTPassword)
+	}
+
+	// it can still be changed, or cleared along with the username
+	save("sphere", "changed")
+	if d.config.MQTTPassword != "changed" {
+		t.Errorf("password = %q after changing it", d.config.MQTTPassword)
+	}
+	save("", "")
+	if d.config.MQTTUsername != "" || d.config.MQTTPassword != "" {
+		t.Errorf("username and password = %q, %q after clearing them", d.config.MQTTUsername, d.config.MQTTPassword)
+	}
+}
+
+func TestPresetOn(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	c := &configService{driver: d}
+	d.config.PresetNames = []string{"Evening"}
+	d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{
+		{ID: "A1", R: 255, G: 136, Level: 40},
+		{ID: "B1", B: 255, Level: 80},
+	}}
+
+	// lights that can't be set are shown, and the rest are still set
+	second.setErr(fmt.Errorf("Hub 2 is unplugged"))
+	message := screenError(configure(t, c, "presetOn", map[string]string{"name": "Evening", "fade": "0"}))
+	if !strings.Contains(message, "Could not set light B1") {
+		t.Errorf("presetOn with hub 2 unplugged shows %q, want B1's error", message)
+	}
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, G: 136, Level: 40}) {
+		t.Errorf("A1 = %+v after activating the preset", got)
+	}
+
+	// as is a preset that's gone
+	if message := screenError(configure(t, c, "presetOn", map[string]string{"name": "Missing", "fade": "0"})); message == "" {
+		t.Errorf("presetOn with an unknown preset showed no error")
+	}
+
+	second.setErr(nil)
+	if message := screenError(configure(t, c, "presetOn", map[string]string{"name": "Evening", "fade": "0"})); message != "" {
+		t.Errorf("presetOn failed: %v", message)
+	}
+}
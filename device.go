@@ -5,19 +5,42 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
 	"github.com/lindsaymarkward/go-ninja/devices"
 	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/channels"
 	"github.com/ninjasphere/go-ninja/model"
 )
 
+// ninjaLight is the part of go-ninja's LightDevice used once a light (or group) has been exported
+type ninjaLight interface {
+	GetDeviceInfo() *model.Device
+	UpdateLightState(state *devices.LightDeviceState) error
+}
+
+// exportLightFunc exports a light device to the Sphere, with callbacks for the commands it sends
+type exportLightFunc func(info *model.Device, apply func(state *devices.LightDeviceState) error, isOn func() (bool, error)) (ninjaLight, error)
+
 type YeelightDevice struct {
-	*devices.LightDevice
+	ninjaLight
 	sendEvent func(event string, payload interface{}) error
+	id        string
+	hub       sunflower.Client
+	hubID     string // the hub this light is paired with
+	removed   bool   // set when the light is removed, as devices can't be unexported until the driver restarts
+	driver    *YeelightDriver
 }
 
-// NewYeelightDevice creates a light device, given a driver and an id (hex code used by Yeelight hub)
-func NewYeelightDevice(d *YeelightDriver, id string) *YeelightDevice {
+// Remove stops the device answering commands
+func (yd *YeelightDevice) Remove() {
+	yd.removed = true
+}
+
+// NewYeelightDevice creates a light device, given a driver, the ID and client of the hub the light is on
+// and an id (hex code used by Yeelight hub)
+func NewYeelightDevice(d *YeelightDriver, hubID string, hub sunflower.Client, id string) *YeelightDevice {
 	name := d.config.Names[id]
 	infoModel := &model.Device{
 		NaturalID:     fmt.Sprintf("%s", id),
@@ -31,11 +54,22 @@ func NewYeelightDevice(d *YeelightDriver, id string) *YeelightDevice {
 		},
 	}
 
-	// use go-ninja's light type to create a LightDevice
-	lightDevice, err := devices.CreateLightDevice(d, infoModel, d.Conn)
+	yd := &YeelightDevice{id: id, hub: hub, hubID: hubID, driver: d}
+
+	// the callbacks run on go-ninja's goroutines, so they take the driver lock
+	lightDevice, err := d.exportLight(infoModel, func(state *devices.LightDeviceState) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return yd.applyLightState(state)
+	}, func() (bool, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return yd.applyIsOn()
+	})
 	if err != nil {
 		log.Printf("Error creating light device %v\n", id)
 	}
+	yd.ninjaLight = lightDevice
 
 	// ?? test - set ThingID in Device
 	// can get access to it but setting it doesn't do anything
@@ -44,48 +78,18 @@ func NewYeelightDevice(d *YeelightDriver, id string) *YeelightDevice {
 	//	lightDevice.GetDeviceInfo().ThingID = &name
 	//	fmt.Printf("\n- Now name %v has ThingID %v\n", name, *lightDevice.GetDeviceInfo().ThingID)
 
-	// ApplyLightState runs for a number of actions, including when airwheeling for brightness and color,
-	// takes the state based on action and sends appropriate Yeelight command
-	lightDevice.ApplyLightState = func(state *devices.LightDeviceState) error {
-		// for some reason, nothing prints in here...
-		log.Printf("Applying Light State: %v\n", *state)
-		if state.OnOff != nil {
-			err = yeelight.SetOnOff(lightDevice.GetDeviceInfo().NaturalID, *state.OnOff, d.config.IP)
-			// send brightness to match on/off state
-			var brightness float64
-			if *state.OnOff {
-				brightness = 1.0
-			} else {
-				brightness = 0.0
-			}
-			state.Brightness = &brightness
-		}
-		if state.Brightness != nil {
-			// state.Brightness is a float value between 0-1
-			err = yeelight.SetBrightness(lightDevice.GetDeviceInfo().NaturalID, *state.Brightness, d.config.IP)
-			// send on/off state to match brightness with minimum brightness before going off
-			onOff := true
-			if *state.Brightness < 0.08 {
-				*state.Brightness = 0
-				onOff = false
-			}
-			state.OnOff = &onOff
-
-		}
-		if state.Color != nil {
-			r, g, b := yeelight.HSVToRGB(*state.Color.Hue, *state.Color.Saturation, 1)
-			err = yeelight.SetColor(lightDevice.GetDeviceInfo().NaturalID, r, g, b, d.config.IP)
-		}
-		// update the state for the UI
-		lightDevice.UpdateLightState(state)
-		return err
-	}
+	return yd
+}
 
-	// to determine if a light is on
-	lightDevice.ApplyIsOn = func() (bool, error) {
-		isOn, err := yeelight.IsOn(lightDevice.GetDeviceInfo().NaturalID, d.config.IP)
-		return isOn, err
+// exportLightDevice uses go-ninja's light type to create and export a LightDevice
+// with the channels Yeelights support, for a light or a group
+func (d *YeelightDriver) exportLightDevice(info *model.Device, apply func(state *devices.LightDeviceState) error, isOn func() (bool, error)) (ninjaLight, error) {
+	lightDevice, err := devices.CreateLightDevice(d, info, d.Conn)
+	if err != nil {
+		return nil, err
 	}
+	lightDevice.ApplyLightState = apply
+	lightDevice.ApplyIsOn = isOn
 
 	// enable channels that Yeelight supports
 	if err := lightDevice.EnableOnOffChannel(); err != nil {
@@ -94,10 +98,129 @@ func NewYeelightDevice(d *YeelightDriver, id string) *YeelightDevice {
 	if err := lightDevice.EnableBrightnessChannel(); err != nil {
 		log.Printf("Could not enable brightness channel. %v", err)
 	}
-	// don't enable temperature channel - then temperature -> hue is handled by LightDevice
 	if err := lightDevice.EnableColorChannel("hue"); err != nil {
 		log.Printf("Could not enable color channel. %v", err)
 	}
+	// with the temperature channel enabled, temperature is handled in ApplyLightState (rather than converted to hue
+	// by LightDevice) so whites look right on the Sunflower
+	if err := lightDevice.EnableTemperatureChannel(); err != nil {
+		log.Printf("Could not enable temperature channel. %v", err)
+	}
+
+	if err := lightDevice.EnableTransitionChannel(); err != nil {
+		log.Printf("Could not enable transition channel. %v", err)
+	}
+	return lightDevice, nil
+}
+
+// applyLightState runs for a number of actions, including when airwheeling for brightness and color,
+// takes the state based on action and sends appropriate Yeelight command.
+// If the state has a transition time, the light fades to the new state instead. The driver lock must be held
+func (yd *YeelightDevice) applyLightState(state *devices.LightDeviceState) error {
+	// for some reason, nothing prints in here...
+	log.Printf("Applying Light State: %v\n", *state)
+	if yd.removed {
+		return fmt.Errorf("Light %v has been removed", yd.id)
+	}
+	// a new command replaces any fade or effect in progress
+	yd.driver.fader.cancel(yd.id)
+	yd.driver.effects.stop(yd.id)
+	yd.driver.lightCommanded(yd.id)
+
+	if state.Transition != nil && *state.Transition > 0 {
+		err := yd.fadeTo(state, time.Duration(*state.Transition)*time.Millisecond)
+		yd.UpdateLightState(state)
+		return err
+	}
 
-	return &YeelightDevice{LightDevice: lightDevice}
+	// the hub client has already retried each command, so give up at the first failure rather than
+	// waiting on the rest (with the driver locked) and reporting a state the light isn't in
+	if state.OnOff != nil {
+		if err := yd.hub.SetOnOff(yd.id, *state.OnOff); err != nil {
+			return err
+		}
+	}
+	matchOnOffAndBrightness(state)
+	if state.Brightness != nil {
+		// state.Brightness is a float value between 0-1
+		if err := yd.hub.SetBrightness(yd.id, *state.Brightness); err != nil {
+			return err
+		}
+	}
+	if state.Color != nil {
+		r, g, b := yd.colorToRGB(state.Color)
+		if err := yd.hub.SetColor(yd.id, r, g, b); err != nil {
+			return err
+		}
+	}
+	// update the state for the UI
+	yd.UpdateLightState(state)
+	return nil
+}
+
+// applyIsOn determines if a light is on. The driver lock must be held
+func (yd *YeelightDevice) applyIsOn() (bool, error) {
+	if yd.removed {
+		return false, fmt.Errorf("Light %v has been removed", yd.id)
+	}
+	return yd.hub.IsOn(yd.id)
+}
+
+// fadeTo starts fading the light from its current state to state over duration, returning once the fade has started
+func (yd *YeelightDevice) fadeTo(state *devices.LightDeviceState, duration time.Duration) error {
+	from, err := currentLight(yd.hub, yd.id)
+	if err != nil {
+		return err
+	}
+	matchOnOffAndBrightness(state)
+	to := from
+	if state.Brightness != nil {
+		to.Level = int(*state.Brightness*100 + 0.5)
+	}
+	if state.Color != nil {
+		to.R, to.G, to.B = yd.colorToRGB(state.Color)
+	}
+	quit := yd.driver.fader.start(yd.id)
+	ctx := yd.driver.ctx // Start replaces it under the lock
+	// the fade runs outside the driver lock, so it takes the lock for each step
+	hub := &lockedHub{mu: &yd.driver.mu, hub: yd.hub, cancelled: fadeCancelled(ctx, quit)}
+	go func() {
+		if err := yd.driver.fader.fade(ctx, hub, quit, from, to, duration); err != nil {
+			log.Printf("%v", err)
+		}
+	}()
+	return nil
+}
+
+// colorToRGB converts a go-ninja colour (hue or temperature) to RGB values for the light
+func (yd *YeelightDevice) colorToRGB(color *channels.ColorState) (int, int, int) {
+	if color.Mode == "temperature" && color.Temperature != nil {
+		// temperature in Kelvin, mixed for this bulb's LEDs
+		return temperatureToRGB(*color.Temperature, yd.driver.config.Calibrations[yd.GetDeviceInfo().NaturalID])
+	}
+	return yeelight.HSVToRGB(*color.Hue, *color.Saturation, 1)
+}
+
+// matchOnOffAndBrightness makes the on/off and brightness in a state agree, as the Yeelight uses level for both:
+// on/off sets full or zero brightness, and brightness turns the light off below a minimum
+func matchOnOffAndBrightness(state *devices.LightDeviceState) {
+	if state.OnOff != nil {
+		// send brightness to match on/off state
+		var brightness float64
+		if *state.OnOff {
+			brightness = 1.0
+		} else {
+			brightness = 0.0
+		}
+		state.Brightness = &brightness
+	}
+	if state.Brightness != nil {
+		// send on/off state to match brightness with minimum brightness before going off
+		onOff := true
+		if *state.Brightness < 0.08 {
+			*state.Brightness = 0
+			onOff = false
+		}
+		state.OnOff = &onOff
+	}
 }
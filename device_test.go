@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+func TestColorToRGB(t *testing.T) {
+	d, _, _ := newFakeHubDriver(t)
+	d.config.Calibrations["A1"] = []TemperaturePoint{
+		{Kelvin: 3000, R: 200, G: 100, B: 50},
+		{Kelvin: 6000, R: 100, G: 200, B: 250},
+	}
+	temperature := func(kelvin float64) *channels.ColorState {
+		return &channels.ColorState{Mode: "temperature", Temperature: &kelvin}
+	}
+	hue := func(hue, saturation float64) *channels.ColorState {
+		return &channels.ColorState{Mode: "hue", Hue: &hue, Saturation: &saturation}
+	}
+	tests := []struct {
+		name    string
+		id      string
+		color   *channels.ColorState
+		r, g, b int
+	}{
+		{"calibrated bulb", "A1", temperature(4500), 150, 150, 150},
+		{"calibrated bulb below its range", "A1", temperature(1500), 200, 100, 50},
+		{"calibrated bulb above its range", "A1", temperature(9000), 100, 200, 250},
+		{"uncalibrated bulb", "B1", temperature(4000), 255, 209, 163},
+		{"uncalibrated bulb below the range", "B1", temperature(1500), 255, 137, 14},
+		{"uncalibrated bulb above the range", "B1", temperature(9000), 255, 254, 250},
+		{"hue", "A1", hue(0, 1), 255, 0, 0},
+		{"white", "B1", hue(0, 0), 255, 255, 255},
+	}
+	for _, test := range tests {
+		if r, g, b := d.devices[test.id].colorToRGB(test.color); r != test.r || g != test.g || b != test.b {
+			t.Errorf("%v: colorToRGB = %d,%d,%d, want %d,%d,%d", test.name, r, g, b, test.r, test.g, test.b)
+		}
+	}
+}
+
+func TestApplyTemperature(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	d.config.Calibrations["A1"] = []TemperaturePoint{
+		{Kelvin: 3000, R: 200, G: 100, B: 50},
+		{Kelvin: 6000, R: 100, G: 200, B: 250},
+	}
+
+	// the same temperature is mixed for each bulb, without changing its brightness
+	kelvin := 4500.0
+	for _, id := range []string{"A1", "B1"} {
+		state := &devices.LightDeviceState{Color: &channels.ColorState{Mode: "temperature", Temperature: &kelvin}}
+		if err := d.devices[id].applyLightState(state); err != nil {
+			t.Fatalf("applyLightState on %v: %v", id, err)
+		}
+	}
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 150, G: 150, B: 150, Level: 50}) {
+		t.Errorf("calibrated A1 = %+v at 4500K", got)
+	}
+	// halfway between the default 4000K and 5000K
+	if got := second.light("B1"); got != (yeelight.Light{ID: "B1", R: 255, G: 219, B: 185, Level: 100}) {
+		t.Errorf("uncalibrated B1 = %+v at 4500K", got)
+	}
+
+	// and along with brightness
+	brightness := 0.3
+	kelvin = 1000
+	state := &devices.LightDeviceState{Brightness: &brightness, Color: &channels.ColorState{Mode: "temperature", Temperature: &kelvin}}
+	if err := d.devices["B1"].applyLightState(state); err != nil {
+		t.Fatalf("applyLightState: %v", err)
+	}
+	if got := second.light("B1"); got != (yeelight.Light{ID: "B1", R: 255, G: 137, B: 14, Level: 30}) {
+		t.Errorf("B1 = %+v at 1000K and 30%%", got)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 // Ninja Sphere driver for Yeelight Sunflower light bulbs
 
-// TODO: Consider how to remove a light. Maybe offer delete option to ignore these lights (which would still appear in the Yeelight iPhone app)
-
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
 	"github.com/lindsaymarkward/go-yeelight"
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/model"
@@ -16,45 +21,161 @@ import (
 
 var info = ninja.LoadModuleInfo("./package.json")
 
+// YeelightDriver is the driver for all Yeelight hubs and lights.
+// mu guards the config, devices and hub clients. It is taken where work comes in (Start and Stop, the Labs service,
+// device callbacks, HTTP API requests and each run of the background workers) so the driver's methods run with it held.
+// The background workers that check the hubs on a timer only hold it to take snapshots of the hubs and apply the results
 type YeelightDriver struct {
 	support.DriverSupport
-	config  *YeelightDriverConfig
-	devices map[string]*YeelightDevice
+	mu           sync.Mutex
+	config       *YeelightDriverConfig
+	devices      map[string]*YeelightDevice
+	groupDevices map[string]*GroupDevice                  // keyed by group name
+	hub          sunflower.Client                         // all hubs, with commands sent to the hub each light is on
+	hubs         map[string]sunflower.Client              // clients for each hub, keyed by hub ID
+	newHub       func(ip func() string) sunflower.Client  // creates hub clients, sunflower.NewClient unless testing
+	discover     func() (sunflower.DiscoveredHub, error)  // finds a hub with SSDP, sunflower.Discover unless testing
+	subscribe    subscribeFunc                            // subscribes to MQTT topics, subscribeMQTT unless testing
+	sendConfig   func(config *YeelightDriverConfig) error // saves the config with a "config" event unless testing
+	exportLight  exportLightFunc                          // exports light and group devices, exportLightDevice unless testing
+	thingModel   func() serviceClient                     // the ThingModel service, thingModelClient unless testing
+	fader        *fader
+	effects      *effectRunner
+	alerts       *alertPlayer
+	monitor      *hubMonitor
+	poller       *statePoller
+	scheduler    *scheduler
+	thingSync    sync.Mutex      // one thing name sync at a time
+	ctx          context.Context // cancelled when the driver stops, ending all background work
+	cancel       context.CancelFunc
+	configure    *configService // the Labs service, exported once and reused if the driver is started again
+	effectRPC    *effectService // the effects service, exported once like configure
+	api          *http.Server   // the local HTTP API, if it's running
+	apiListener  net.Listener   // what api serves, closed by stopAPI along with cancelling apiCancel's context
+	bridge       *mqttBridge    // the MQTT bridge, if it's running
+	metrics      *hubMetrics    // command latency and heartbeat results for /metrics, kept across restarts
+	apiCancel    context.CancelFunc
+	metricsHTTP  *metricsServer // metrics on their own address, if it's set
+	started      time.Time
+	commands     uint64            // commands sent to lights so far, see lightCommanded
+	commanded    map[string]uint64 // the value of commands when each light was last sent one, keyed by light ID
 }
 
 type YeelightDriverConfig struct {
+	Version     int // schema version, see configVersion and migrateConfig
 	Initialised bool
-	IP          string
+	IP          string // only used by configs saved before multiple hubs were supported
+	Hubs        []*HubConfig
 	LightIDs    []string // need slices in addition to maps due to being ordered
 	Names       map[string]string
+	ThingNames  map[string]string // names we last gave the Things for our devices, keyed by device NaturalID
 	PresetNames []string
-	Presets     map[string]*Preset
+	Presets     map[string]*sunflower.Preset
+	GroupNames  []string
+	Groups      map[string]*Group
+	IgnoredIDs  []string // lights that have been removed, which scanning won't add again
+	PollSeconds int      // how often to check for changes made outside the driver, 0 for the default
+	FadeSeconds int      // how long presets activated from Labs take to fade in
+	// how long to wait for a hub to answer each command, and how many times to try commands the hub drops
+	// or doesn't answer, 0 for the defaults
+	HubTimeoutSeconds int
+	HubAttempts       int
+	// colour temperature calibration tables for bulbs that don't suit the default, keyed by light ID
+	Calibrations map[string][]TemperaturePoint
+	Schedules    []*Schedule
+	Alerts       []*Alert
+	TimeZone     string // IANA name of the time zone schedules run in, empty for the driver's local time zone
+	// where the lights are (degrees, north and east positive), for schedules relative to sunrise and sunset
+	Latitude  float64
+	Longitude float64
+	// address the local HTTP API listens on, like ":8089" (this machine only, see apiListenAddress), empty to turn it off
+	HTTPAddress string
+	// address Prometheus metrics are served on without the rest of the API, like ":9089", empty for just the API's /metrics
+	MetricsAddress string
+	// MQTT broker (host:port) to bridge the lights and presets to, announced for Home Assistant, empty to turn it off
+	MQTTBroker   string
+	MQTTUsername string
+	MQTTPassword string
+}
+
+// HubConfig is a single Yeelight hub and the lights paired with it
+type HubConfig struct {
+	ID       string // names the hub in the config and screens ("1", "2"...), staying the same if its IP address changes
+	IP       string
+	USN      string // SSDP unique service name of a discovered hub, which recognises it at a new IP address
+	LightIDs []string
+	Missing  []string // lights paired with this hub that it didn't report at the last scan
 }
 
-type Preset struct {
-	//	Name   string	// name is the key in the map of Presets
-	Lights []yeelight.Light // TODO: consider storing only what we need, not everything (LQI, Effect...)
+// Label is a display name for the hub, like "Hub 1 (192.168.1.20)"
+func (h *HubConfig) Label() string {
+	return fmt.Sprintf("Hub %v (%v)", h.ID, h.IP)
 }
 
 // DefaultConfig sets a default configuration for the YeelightDriverConfig with no lights
 func DefaultConfig() *YeelightDriverConfig {
 	return &YeelightDriverConfig{
-		Initialised: false,
-		IP:          "",
-		LightIDs:    make([]string, 0),
-		Names:       make(map[string]string),
-		Presets:     make(map[string]*Preset),
+		Version:      configVersion,
+		Initialised:  false,
+		IP:           "",
+		Hubs:         make([]*HubConfig, 0),
+		LightIDs:     make([]string, 0),
+		Names:        make(map[string]string),
+		ThingNames:   make(map[string]string),
+		Presets:      make(map[string]*sunflower.Preset),
+		Groups:       make(map[string]*Group),
+		IgnoredIDs:   make([]string, 0),
+		Calibrations: make(map[string][]TemperaturePoint),
+		Schedules:    make([]*Schedule, 0),
+		Alerts:       make([]*Alert, 0),
+	}
+}
+
+// resetConfig returns a default config (with no lights) keeping everything from old that a reset shouldn't lose:
+// the hubs (without their lights), removed lights, groups, thing names, alerts, schedules and where they run,
+// the HTTP API and MQTT settings, and the presets if keepPresets is set
+func resetConfig(old *YeelightDriverConfig, keepPresets bool) *YeelightDriverConfig {
+	config := DefaultConfig()
+	for _, hub := range old.Hubs {
+		config.Hubs = append(config.Hubs, &HubConfig{ID: hub.ID, IP: hub.IP, USN: hub.USN, LightIDs: make([]string, 0)})
+	}
+	// removed lights stay removed
+	if old.IgnoredIDs != nil {
+		config.IgnoredIDs = old.IgnoredIDs
 	}
+	// groups keep their devices, and light IDs don't change, so keep them too
+	if len(old.GroupNames) > 0 {
+		log.Printf("Preserving groups: %v\n", old.GroupNames)
+		config.GroupNames = old.GroupNames
+		config.Groups = old.Groups
+	}
+	if old.ThingNames != nil {
+		config.ThingNames = old.ThingNames
+	}
+	// alerts keep listening for their topics, and schedules keep running at the same times
+	if old.Alerts != nil {
+		config.Alerts = old.Alerts
+	}
+	if old.Schedules != nil {
+		config.Schedules = old.Schedules
+	}
+	config.TimeZone = old.TimeZone
+	config.Latitude, config.Longitude = old.Latitude, old.Longitude
+	// the API and bridge keep running through a reset
+	config.HTTPAddress, config.MetricsAddress = old.HTTPAddress, old.MetricsAddress
+	config.MQTTBroker, config.MQTTUsername, config.MQTTPassword = old.MQTTBroker, old.MQTTUsername, old.MQTTPassword
+	if keepPresets && len(old.PresetNames) > 0 {
+		log.Printf("Preserving presets: %v\n", old.PresetNames)
+		config.PresetNames = old.PresetNames
+		config.Presets = old.Presets
+	}
+	return config
 }
 
 // NewYeelightDriver creates a new driver with an empty map of names
 // initialises and exports Ninja stuff
 func NewYeelightDriver() (*YeelightDriver, error) {
-
-	driver := &YeelightDriver{
-		// make map of devices so we can add lights to it
-		devices: make(map[string]*YeelightDevice),
-	}
+	driver := newDriver()
 
 	err := driver.Init(info)
 	if err != nil {
@@ -69,22 +190,58 @@ func NewYeelightDriver() (*YeelightDriver, error) {
 	return driver, nil
 }
 
+// newDriver creates a driver that isn't connected to the Sphere yet, which tests use with their own hubs
+func newDriver() *YeelightDriver {
+	driver := &YeelightDriver{
+		// make map of devices so we can add lights to it
+		devices:      make(map[string]*YeelightDevice),
+		groupDevices: make(map[string]*GroupDevice),
+		hubs:         make(map[string]sunflower.Client),
+		commanded:    make(map[string]uint64),
+		newHub:       sunflower.NewClient,
+		discover:     sunflower.Discover,
+		fader:        newFader(),
+		effects:      newEffectRunner(),
+		alerts:       newAlertPlayer(),
+		metrics:      newHubMetrics(),
+	}
+	driver.subscribe = driver.subscribeMQTT
+	driver.sendConfig = func(config *YeelightDriverConfig) error {
+		return driver.SendEvent("config", config)
+	}
+	driver.exportLight = driver.exportLightDevice
+	driver.thingModel = driver.thingModelClient
+	driver.ctx, driver.cancel = context.WithCancel(context.Background())
+	driver.hub = &hubSet{driver}
+	return driver
+}
+
+// saveConfig saves the config on the Sphere
+func (d *YeelightDriver) saveConfig() error {
+	return d.sendConfig(d.config)
+}
+
 // Start runs when the driver is started - called by the Ninja system (not the driver itself),
 // gets the hub and light details, sets the configuration
 func (d *YeelightDriver) Start(config *YeelightDriverConfig) error {
 	log.Printf("Yeelight Driver Starting with config %v", config)
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.config = config
+	d.started = time.Now()
+	// a driver that has been stopped can be started again, with new background work
+	if d.ctx.Err() != nil {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+	}
+
+	// bring configs saved by older versions up to date (saved at the end of Start)
+	if _, err := migrateConfig(d.config); err != nil {
+		return err
+	}
 
 	if !d.config.Initialised {
-		// Preserve presets if they exist
-		presetNames := config.PresetNames
-		presets := config.Presets
-		d.config = DefaultConfig()
-		if len(presetNames) > 0 {
-			log.Printf("Preserving presets: %v\n", presetNames)
-			d.config.Presets = presets
-			d.config.PresetNames = presetNames
-		}
+		// Preserve presets, known hubs and settings if they exist
+		d.config = resetConfig(config, true)
 
 		// find hub and lights, save to config
 		// if it worked, the driver is initialised
@@ -97,86 +254,339 @@ func (d *YeelightDriver) Start(config *YeelightDriverConfig) error {
 	// create devices from the lights stored in the config
 	// this creates devices even if the hub is not online so they can be used when it does come online
 	d.CreateDevicesFromConfig()
+	d.CreateGroupDevicesFromConfig()
+
+	// keep an eye on the hubs in the background
+	d.monitor = newHubMonitor(d.ctx, d, heartbeatInterval)
+	go d.monitor.run()
+
+	// and pick up changes made from the Yeelight app or wall switches
+	d.poller = newStatePoller(d.ctx, d, d.pollInterval())
+	go d.poller.run()
+
+	// run presets on schedule
+	d.scheduler = newScheduler(d.ctx, d)
+	go d.scheduler.run()
+
+	// and flash lights when alerts arrive
+	d.SubscribeAlerts()
+
+	// and let scripts and dashboards control the lights, if the HTTP API is turned on
+	if err := d.startAPI(); err != nil {
+		log.Printf("%v", err)
+	}
+	if err := d.startMetrics(); err != nil {
+		log.Printf("%v", err)
+	}
 
-	// TODO: trying to set ThingIDs so we can set Thing.Name
-	// can get access to it but setting it doesn't do anything
-	// I think I need a sendEvent like for config
-	// but there isn't one for saving yet! Wait for Ninjas
-
-	//	thingClient := d.Conn.GetServiceClient("$home/services/ThingModel")
-	//	things := make([]*model.Thing, 0)
-	//	keptThings := make([]*model.Thing, 0, len(things))
-	//	if err := thingClient.Call("fetchAll", nil, &things, 10*time.Second); err != nil {
-	//		fmt.Printf("ERROR getting things, %v\n", err)
-	//	}
-	//
-	//	fmt.Printf("\n\n")
-	//	for _, thing := range things {
-	//		if thing.Type == "light" {
-	//			keptThings = append(keptThings, thing)
-	//			fmt.Printf("> %v (%v)\n", *thing.DeviceID, thing.Name)
-	//			if thing.Name == "Lt 143F" {
-	//				thing.Name = "Yee 143F"
-	//				fmt.Printf("\n\n!! %v\n", thing.Name)
-	//			}
-	//		}
-	//	}
+	// and bridge to an MQTT broker for Home Assistant, if one is set
+	d.startMQTTBridge()
+
+	// give the Things our names, once the ThingModel service is ready and the Things exist
+	d.syncThingNamesInBackground(false)
 
 	// Provide configuration (Labs) service
-	d.Conn.MustExportService(&configService{d}, "$driver/"+info.ID+"/configure", &model.ServiceAnnouncement{
-		Schema: "/protocol/configuration",
-	})
+	if d.configure == nil {
+		d.configure = &configService{driver: d}
+		d.Conn.MustExportService(d.configure, "$driver/"+info.ID+"/configure", &model.ServiceAnnouncement{
+			Schema: "/protocol/configuration",
+		})
+	}
+	d.configure.setStopped(false)
+
+	// and effects for other drivers and apps
+	if d.effectRPC == nil {
+		d.effectRPC = &effectService{driver: d}
+		d.Conn.MustExportService(d.effectRPC, "$driver/"+info.ID+"/effects", &model.ServiceAnnouncement{
+			Schema: "/service/yeelight-effects",
+		})
+	}
 
-	return d.SendEvent("config", config)
+	return d.saveConfig()
 }
 
-// ScanLightsToConfig finds the Yeelight hub on the network, gets the lights and saves them to the config
+// ScanLightsToConfig finds Yeelight hubs on the network, gets the lights from every hub and saves them to the config
 func (d *YeelightDriver) ScanLightsToConfig() error {
-	// search for hub and get IP address
-	ip, err := yeelight.DiscoverHub()
+	// search for a hub and add it if it's new
+	discovered, err := d.discover()
 	if err != nil {
 		log.Printf("ERROR discovering Yeelight hub with SSDP: %v", err)
-		if d.config.IP == "" {
+		if len(d.config.Hubs) == 0 {
 			return err
-		} else {
-			ip = d.config.IP
-			log.Printf("Trying to get lights with config IP %v\n", ip)
 		}
+		log.Printf("Trying to get lights from configured hubs\n")
 	} else {
 		// found hub with SSDP
-		log.Printf("Hub discovered with SSDP at %s\n", ip)
+		log.Printf("Hub discovered with SSDP at %s (%s)\n", discovered.IP, discovered.USN)
+		if _, err := d.AddHub(discovered.IP, discovered.USN); err != nil {
+			log.Printf("Unable to add hub at %v - %v", discovered.IP, err)
+		}
 	}
-	// get lights and set config details
-	lights, err := yeelight.GetLights(ip)
-	if err != nil {
+	// get lights from each hub and set config details
+	found := 0
+	for _, hub := range d.config.Hubs {
+		if err = d.scanHub(hub); err != nil {
+			log.Printf("Unable to get lights from %v - %v", hub.Label(), err)
+			continue
+		}
+		found++
+	}
+	if found == 0 {
 		return fmt.Errorf("Unable to get lights - %v", err)
 	}
-	// Create entries in Names map (light IDs from lights slice as keys) and LightIDs slice
+	// "initialise" driver
+	d.config.Initialised = true
+	log.Printf("Found these (%d) lights: %v on %d hub(s)", len(d.config.LightIDs), d.config.LightIDs, found)
+	return nil
+}
+
+// AddHub adds the hub at ip to the config, or returns the existing hub if it's already known.
+// usn is the hub's SSDP unique service name if it was discovered, or empty for hubs added by IP address
+func (d *YeelightDriver) AddHub(ip, usn string) (*HubConfig, error) {
+	hub, err := d.findHub(ip, usn)
+	if err != nil || hub != nil {
+		return hub, err
+	}
+	hub = &HubConfig{ID: d.nextHubID(), IP: ip, USN: usn, LightIDs: make([]string, 0)}
+	d.config.Hubs = append(d.config.Hubs, hub)
+	log.Printf("Added %v\n", hub.Label())
+	return hub, nil
+}
+
+// findHub returns the configured hub at ip with the SSDP unique service name usn (if it's known), or nil if the hub
+// there is new. A hub with the same USN is the same hub at a new address, so its IP is updated. Hubs that haven't
+// been discovered yet have no USN, so for them a hub with lights we already know is the same hub too
+func (d *YeelightDriver) findHub(ip, usn string) (*HubConfig, error) {
+	if hub := d.knownHub(ip, usn); hub != nil {
+		return hub, nil
+	}
+	lights, err := d.hubAt(ip).GetLights()
+	if err != nil {
+		return nil, err
+	}
+	return d.hubWithLights(ip, usn, lights), nil
+}
+
+// knownHub is the part of findHub that doesn't ask the hub at ip for its lights:
+// it returns the hub with the same USN or at the same address, or nil if neither is configured
+func (d *YeelightDriver) knownHub(ip, usn string) *HubConfig {
+	if usn != "" {
+		for _, hub := range d.config.Hubs {
+			if hub.USN == usn {
+				d.moveHub(hub, ip)
+				return hub
+			}
+		}
+	}
+	for _, hub := range d.config.Hubs {
+		if hub.IP == ip && mayBeSameHub(hub, usn) {
+			if usn != "" {
+				hub.USN = usn
+			}
+			return hub
+		}
+	}
+	return nil
+}
+
+// hubWithLights is the rest of findHub, given the lights the hub at ip reported:
+// it returns the hub any of them are paired with, or nil if they are all new
+func (d *YeelightDriver) hubWithLights(ip, usn string, lights []yeelight.Light) *HubConfig {
+	for _, light := range lights {
+		if hub := d.hubForLight(light.ID); hub != nil && mayBeSameHub(hub, usn) {
+			d.moveHub(hub, ip)
+			if usn != "" {
+				hub.USN = usn
+			}
+			return hub
+		}
+	}
+	return nil
+}
+
+// mayBeSameHub returns false if hub and the hub with usn were both discovered with different USNs,
+// which means another hub has been given the address of (or lights paired with) one of ours
+func mayBeSameHub(hub *HubConfig, usn string) bool {
+	return usn == "" || hub.USN == ""
+}
+
+// hubAt returns a client for a hub at ip that isn't in the config yet
+func (d *YeelightDriver) hubAt(ip string) sunflower.Client {
+	return sunflower.NewRetryClient(d.newHub(func() string { return ip }), d.retryOptions)
+}
+
+// moveHub changes the address of a hub that has been found at a new one
+func (d *YeelightDriver) moveHub(hub *HubConfig, ip string) {
+	if hub.IP != ip {
+		log.Printf("%v has moved to %v\n", hub.Label(), ip)
+		hub.IP = ip
+	}
+}
+
+// scanHub gets the lights from a single hub and adds any new ones to the config
+func (d *YeelightDriver) scanHub(hub *HubConfig) error {
+	lights, err := d.hubClient(hub.ID).GetLights()
+	// an answer is as good as a heartbeat, so the status is right straight after a scan or change of address
+	if d.monitor != nil {
+		d.monitor.record(hub, err)
+	}
+	if err != nil {
+		return err
+	}
+	// Create entries in Names map (light IDs from lights slice as keys) and LightIDs slices
+	reported := make([]string, 0, len(lights))
 	for _, light := range lights {
+		if containsString(d.config.IgnoredIDs, light.ID) {
+			continue
+		}
+		reported = append(reported, light.ID)
+		if !containsString(hub.LightIDs, light.ID) {
+			if other := d.hubForLight(light.ID); other != nil {
+				log.Printf("Light %v is on %v and %v, using %v", light.ID, other.Label(), hub.Label(), other.Label())
+				continue
+			}
+			hub.LightIDs = append(hub.LightIDs, light.ID)
+		}
 		// set default name for new lights, like "Yee238B"
 		if !containsString(d.config.LightIDs, light.ID) {
 			d.config.Names[light.ID] = "Yee" + light.ID
 			d.config.LightIDs = append(d.config.LightIDs, light.ID)
 		}
 	}
-	// save IP address to config and "initialise" driver
-	d.config.IP = ip
-	d.config.Initialised = true
-	log.Printf("Found these (%d) lights: %v at IP %v", len(lights), d.config.LightIDs, ip)
-	return err
+	// mark lights that have gone from the hub as missing (they may come back, so keep them)
+	missing := make([]string, 0)
+	for _, id := range hub.LightIDs {
+		if !containsString(reported, id) {
+			if !containsString(hub.Missing, id) {
+				log.Printf("Light %v is missing from %v", id, hub.Label())
+			}
+			missing = append(missing, id)
+		} else if containsString(hub.Missing, id) {
+			log.Printf("Light %v is back on %v", id, hub.Label())
+		}
+	}
+	hub.Missing = missing
+	return nil
+}
+
+// IsMissing returns true if a light was not reported by its hub at the last scan
+func (d *YeelightDriver) IsMissing(lightID string) bool {
+	hub := d.hubForLight(lightID)
+	return hub != nil && containsString(hub.Missing, lightID)
 }
 
-// I think Stop should be different ??
+// nextHubID returns an unused ID for a new hub ("1", "2"...)
+func (d *YeelightDriver) nextHubID() string {
+	for n := len(d.config.Hubs) + 1; ; n++ {
+		id := fmt.Sprintf("%d", n)
+		if d.hubConfig(id) == nil {
+			return id
+		}
+	}
+}
+
+// hubConfig returns the config of the hub with the given ID, or nil if there isn't one
+func (d *YeelightDriver) hubConfig(hubID string) *HubConfig {
+	for _, hub := range d.config.Hubs {
+		if hub.ID == hubID {
+			return hub
+		}
+	}
+	return nil
+}
+
+// hubForLight returns the config of the hub a light is paired with, or nil if the light isn't known
+func (d *YeelightDriver) hubForLight(lightID string) *HubConfig {
+	for _, hub := range d.config.Hubs {
+		if containsString(hub.LightIDs, lightID) {
+			return hub
+		}
+	}
+	return nil
+}
+
+// hubClient returns the client for a hub, creating it the first time it's needed.
+// The hub address can change (scan, set IP, reset) so the client always reads it from the current config
+func (d *YeelightDriver) hubClient(hubID string) sunflower.Client {
+	client, ok := d.hubs[hubID]
+	if !ok {
+		direct := d.newHub(func() string {
+			if hub := d.hubConfig(hubID); hub != nil {
+				return hub.IP
+			}
+			return ""
+		})
+		// metered outside the retries, so a command that needed retrying counts once, as a failure only if every attempt failed
+		client = &meteredHub{hubID: hubID, metrics: d.metrics, client: sunflower.NewRetryClient(direct, d.retryOptions)}
+		d.hubs[hubID] = client
+	}
+	return client
+}
+
+// SetHubIP changes the address of a configured hub
+func (d *YeelightDriver) SetHubIP(hubID, ip string) error {
+	hub := d.hubConfig(hubID)
+	if hub == nil {
+		return fmt.Errorf("Unknown hub %v", hubID)
+	}
+	hub.IP = ip
+	return nil
+}
+
+// Stop runs when the driver is stopped (by the Ninja system, or main on SIGINT/SIGTERM). It cancels all background work
+// (monitor, poller, scheduler, fades, effects, alerts and thing name syncs), stops the HTTP API, metrics and MQTT bridge, closes the hub clients, disables the Labs service
+// and saves the config. The driver can be started again afterwards
 func (d *YeelightDriver) Stop() error {
-	return fmt.Errorf("This driver does not support being stopped. YOU HAVE NO POWER HERE.")
+	log.Printf("Yeelight Driver Stopping")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancel()
+	d.fader.cancelAll()
+	d.effects.stopAll()
+	d.unsubscribeAlerts()
+	d.stopAPI()
+	d.stopMetrics()
+	d.stopMQTTBridge()
+	d.monitor, d.poller, d.scheduler = nil, nil, nil
+
+	// go-yeelight opens a connection for each command, so there is usually nothing to close,
+	// but drop the clients so a restart uses the config's addresses
+	for id, client := range d.hubs {
+		if closer, ok := client.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Printf("Error closing hub %v: %v", id, err)
+			}
+		}
+		delete(d.hubs, id)
+	}
+
+	// go-ninja can't unexport services (or devices), so the Labs service stays exported but refuses requests
+	if d.configure != nil {
+		d.configure.setStopped(true)
+	}
+
+	// save any changes made since the last save
+	if d.config == nil {
+		return nil
+	}
+	return d.saveConfig()
 }
 
-// CreateDevicesFromConfig creates a new device (exporting it) for each light in the config
+// CreateDevicesFromConfig creates a new device (exporting it) for each light in the config that doesn't have one yet,
+// so it can be called again after scanning without re-creating existing devices
 func (d *YeelightDriver) CreateDevicesFromConfig() error {
-	// create device for each light and add it to devices map in driver
+	// create device for each new light and add it to devices map in driver
 	for id, _ := range d.config.Names {
-		log.Printf("Creating new Yeelight, %v", id)
-		device := NewYeelightDevice(d, id)
+		if _, exists := d.devices[id]; exists {
+			continue
+		}
+		hub := d.hubForLight(id)
+		if hub == nil {
+			log.Printf("Light %v is not on any hub, not creating it", id)
+			continue
+		}
+		log.Printf("Creating new Yeelight, %v on %v", id, hub.Label())
+		device := NewYeelightDevice(d, hub.ID, d.hubClient(hub.ID), id)
 		d.devices[id] = device
 	}
 	return nil
@@ -187,21 +597,77 @@ func (d *YeelightDriver) Rename(names map[string]string) error {
 	d.config.Names = names
 	// as well as the driver config, we also need to set the device names
 	for id, newName := range names {
-		d.devices[id].GetDeviceInfo().Name = &newName
+		if device, ok := d.devices[id]; ok {
+			device.GetDeviceInfo().Name = &newName
+		}
+	}
+	// save the new configuration
+	if err := d.saveConfig(); err != nil {
+		return err
+	}
+	// and pass the names on to the Things
+	d.syncThingNamesInBackground(false)
+	return nil
+}
+
+// SetCalibration sets the colour temperature calibration table for a light, or goes back to the default if table is empty
+func (d *YeelightDriver) SetCalibration(id string, table []TemperaturePoint) error {
+	if d.config.Calibrations == nil {
+		d.config.Calibrations = make(map[string][]TemperaturePoint)
+	}
+	if len(table) == 0 {
+		delete(d.config.Calibrations, id)
+	} else {
+		d.config.Calibrations[id] = table
+	}
+	// save the new configuration
+	return d.saveConfig()
+}
+
+// RemoveLight adds a light to the ignore list so scanning won't add it again, takes it out of the config
+// (names, groups and every preset) and stops its device answering commands
+func (d *YeelightDriver) RemoveLight(id string) error {
+	if !containsString(d.config.IgnoredIDs, id) {
+		d.config.IgnoredIDs = append(d.config.IgnoredIDs, id)
+	}
+	d.config.LightIDs = removeString(d.config.LightIDs, id)
+	delete(d.config.Names, id)
+	delete(d.config.Calibrations, id)
+	for _, hub := range d.config.Hubs {
+		hub.LightIDs = removeString(hub.LightIDs, id)
+		hub.Missing = removeString(hub.Missing, id)
+	}
+	for _, group := range d.config.Groups {
+		group.LightIDs = removeString(group.LightIDs, id)
+	}
+	for _, preset := range d.config.Presets {
+		lights := preset.Lights[:0]
+		for _, light := range preset.Lights {
+			if light.ID != id {
+				lights = append(lights, light)
+			}
+		}
+		preset.Lights = lights
 	}
+	d.effects.stop(id)
+	if device, ok := d.devices[id]; ok {
+		device.Remove()
+		delete(d.devices, id)
+	}
+	log.Printf("Removed light %v", id)
 	// save the new configuration
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 }
 
 // SavePreset takes the data from the configuration and saves a new preset as a slice of light values
 func (d *YeelightDriver) SavePreset(values *savePresetData) error {
-	lightStates, err := yeelight.GetLights(d.config.IP)
+	lightStates, err := d.hub.GetLights()
 	if err != nil {
 		return err
 	}
-	// handle "all" selection
-	lightsToSet := values.LightIDs
-	if values.LightIDs[0] == "all" {
+	// handle "all" selection and groups
+	lightsToSet := d.expandGroups(values.LightIDs)
+	if len(values.LightIDs) > 0 && values.LightIDs[0] == "all" {
 		lightsToSet = d.config.LightIDs
 	}
 	// save name to slice of names so we can have consistent order on presets page
@@ -210,12 +676,12 @@ func (d *YeelightDriver) SavePreset(values *savePresetData) error {
 		d.config.PresetNames = append(d.config.PresetNames, values.Name)
 	}
 	// create blank preset to save to
-	d.config.Presets[values.Name] = &Preset{Lights: make([]yeelight.Light, len(values.LightIDs))}
+	d.config.Presets[values.Name] = &sunflower.Preset{Lights: make([]sunflower.PresetLight, 0, len(lightsToSet))}
 	// for each light in preset
 	for _, lightID := range lightsToSet {
 		for _, light := range lightStates {
 			if lightID == light.ID {
-				d.config.Presets[values.Name].Lights = append(d.config.Presets[values.Name].Lights, light)
+				d.config.Presets[values.Name].Lights = append(d.config.Presets[values.Name].Lights, sunflower.NewPresetLight(light))
 				break
 			}
 		}
@@ -224,11 +690,26 @@ func (d *YeelightDriver) SavePreset(values *savePresetData) error {
 	log.Printf("Saving preset: %v\n", values.Name)
 	//	log.Printf("Current presets: %v\n", d.config.Presets)
 	// save the new configuration
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
+}
+
+// UpdatePreset replaces the light values stored in a preset (without changing the lights themselves)
+func (d *YeelightDriver) UpdatePreset(name string, lights []sunflower.PresetLight) error {
+	preset, ok := d.config.Presets[name]
+	if !ok {
+		return fmt.Errorf("Unknown preset %v", name)
+	}
+	preset.Lights = lights
+	log.Printf("Updating preset: %v\n", name)
+	// save the new configuration
+	return d.saveConfig()
 }
 
 // DeletePreset takes the name of a preset and deletes it from the config
 func (d *YeelightDriver) DeletePreset(name string) error {
+	if _, ok := d.config.Presets[name]; !ok {
+		return fmt.Errorf("Unknown preset %v", name)
+	}
 	// delete from map
 	delete(d.config.Presets, name)
 	// delete from slice
@@ -236,31 +717,224 @@ func (d *YeelightDriver) DeletePreset(name string) error {
 	d.config.PresetNames = append(d.config.PresetNames[:i], d.config.PresetNames[i+1:]...)
 
 	// save the new configuration
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 
 }
 
-// ActivatePreset takes the name of a preset and sets the lights to match the values stored
+// ActivatePreset takes the name of a preset and sets the lights to match the values stored,
+// fading to them over transition if it's not zero.
 // only changes the lights the preset stores values for
-func (d *YeelightDriver) ActivatePreset(name string) error {
+func (d *YeelightDriver) ActivatePreset(name string, transition time.Duration) error {
 	log.Printf("Activating preset: %v", name)
-	lights := d.config.Presets[name].Lights
+	preset, ok := d.config.Presets[name]
+	if !ok {
+		return fmt.Errorf("Unknown preset %v", name)
+	}
+	var current []yeelight.Light
 	var err error
+	if transition > 0 {
+		if current, err = d.hub.GetLights(); err != nil {
+			return err
+		}
+	}
+	// lights that aren't fading are set straight away, the same way the yeelight command applies presets
+	immediate := &sunflower.Preset{}
+	for _, light := range preset.Lights {
+		// a preset replaces any fade or effect in progress
+		d.fader.cancel(light.ID)
+		d.effects.stop(light.ID)
+		d.lightCommanded(light.ID)
+		from, found := findLight(current, light.ID)
+		if transition > 0 && found {
+			quit := d.fader.start(light.ID)
+			ctx := d.ctx // Start replaces it under the lock
+			// fades run outside the driver lock, so take the lock for each step
+			hub := &lockedHub{mu: &d.mu, hub: d.hub, cancelled: fadeCancelled(ctx, quit)}
+			go func(from, to yeelight.Light) {
+				if err := d.fader.fade(ctx, hub, quit, from, to, transition); err != nil {
+					log.Printf("%v", err)
+				}
+			}(from, light.Light())
+			continue
+		}
+		immediate.Lights = append(immediate.Lights, light)
+	}
+	return sunflower.ApplyPreset(d.hub, immediate)
+}
+
+// lightCommanded records that a light has been sent a new command (through its device, a preset or an effect),
+// so background work that began before it doesn't overwrite it. The driver lock must be held
+func (d *YeelightDriver) lightCommanded(id string) {
+	d.commands++
+	d.commanded[id] = d.commands
+}
+
+// commandedSince returns true if a light has been sent a command since commands was since. The driver lock must be held
+func (d *YeelightDriver) commandedSince(id string, since uint64) bool {
+	return d.commanded[id] > since
+}
+
+// findLight returns the light with the given ID from a slice of lights
+func findLight(lights []yeelight.Light, id string) (yeelight.Light, bool) {
 	for _, light := range lights {
-		err = yeelight.SetLight(light.ID, light.R, light.G, light.B, light.Level, d.config.IP)
+		if light.ID == id {
+			return light, true
+		}
 	}
-	return err
+	return yeelight.Light{}, false
 }
 
-// CheckHub calls Heartbeat which pings the Yeelight hub to see if it's alive,
-// returns either nil error if it's responsive or error if the ack is not received from the hub.
+// AddSchedule saves a new schedule, enabled
+func (d *YeelightDriver) AddSchedule(schedule *Schedule) error {
+	switch schedule.Event {
+	case "":
+		if _, _, err := schedule.clock(); err != nil {
+			return err
+		}
+	case Sunrise, Sunset, CivilDawn, CivilDusk:
+		if d.config.Latitude == 0 && d.config.Longitude == 0 {
+			return fmt.Errorf("Set your location on the schedules screen to use %v", schedule.Event)
+		}
+	default:
+		return fmt.Errorf("Unknown event %v", schedule.Event)
+	}
+	if len(schedule.Days) == 0 {
+		return fmt.Errorf("Choose at least one day")
+	}
+	if !schedule.AllOff {
+		if _, ok := d.config.Presets[schedule.Preset]; !ok {
+			return fmt.Errorf("Unknown preset %v", schedule.Preset)
+		}
+	}
+	schedule.ID = d.nextScheduleID()
+	schedule.Enabled = true
+	d.config.Schedules = append(d.config.Schedules, schedule)
+	return d.schedulesChanged()
+}
+
+// SetScheduleEnabled turns a schedule on or off
+func (d *YeelightDriver) SetScheduleEnabled(id string, enabled bool) error {
+	for _, schedule := range d.config.Schedules {
+		if schedule.ID == id {
+			schedule.Enabled = enabled
+			return d.schedulesChanged()
+		}
+	}
+	return fmt.Errorf("Unknown schedule %v", id)
+}
+
+// DeleteSchedule removes a schedule
+func (d *YeelightDriver) DeleteSchedule(id string) error {
+	for i, schedule := range d.config.Schedules {
+		if schedule.ID == id {
+			d.config.Schedules = append(d.config.Schedules[:i], d.config.Schedules[i+1:]...)
+			return d.schedulesChanged()
+		}
+	}
+	return fmt.Errorf("Unknown schedule %v", id)
+}
+
+// schedulesChanged tells the scheduler about changed schedules and saves the config
+func (d *YeelightDriver) schedulesChanged() error {
+	if d.scheduler != nil {
+		d.scheduler.reload()
+	}
+	return d.saveConfig()
+}
+
+// scheduleByID returns the schedule with the given ID, or nil if there isn't one
+func (d *YeelightDriver) scheduleByID(id string) *Schedule {
+	for _, schedule := range d.config.Schedules {
+		if schedule.ID == id {
+			return schedule
+		}
+	}
+	return nil
+}
+
+// nextScheduleID returns an unused ID for a new schedule
+func (d *YeelightDriver) nextScheduleID() string {
+	for n := len(d.config.Schedules) + 1; ; n++ {
+		id := fmt.Sprintf("%d", n)
+		if d.scheduleByID(id) == nil {
+			return id
+		}
+	}
+}
+
+// runSchedule carries out a schedule's action
+func (d *YeelightDriver) runSchedule(schedule *Schedule) error {
+	if schedule.AllOff {
+		return d.TurnOffAllLights()
+	}
+	return d.ActivatePreset(schedule.Preset, time.Duration(d.config.FadeSeconds)*time.Second)
+}
+
+// CheckHub calls Heartbeat which pings each Yeelight hub to see if it's alive,
+// returns either nil error if they're all responsive or error if the ack is not received from a hub.
 func (d *YeelightDriver) CheckHub() error {
-	return yeelight.Heartbeat(d.config.IP)
+	return d.hub.Heartbeat()
+}
+
+// OfflineHubs returns the IDs of the hubs the background monitor last found not responding,
+// without waiting on the hubs themselves
+func (d *YeelightDriver) OfflineHubs() []string {
+	var offline []string
+	for _, hub := range d.config.Hubs {
+		if !d.HubStatus(hub.ID).Online {
+			offline = append(offline, hub.ID)
+		}
+	}
+	return offline
+}
+
+// pollInterval is how often the lights are polled for changes, from the config or the default
+func (d *YeelightDriver) pollInterval() time.Duration {
+	seconds := d.config.PollSeconds
+	if seconds <= 0 {
+		seconds = defaultPollSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// retryOptions are how long to wait for the hubs and how many times to try each command, from the config or the defaults.
+// The hub clients call it for every command, with the driver lock held, or once when a client is resolved
+func (d *YeelightDriver) retryOptions() sunflower.RetryOptions {
+	options := sunflower.RetryOptions{Timeout: sunflower.DefaultTimeout, Attempts: sunflower.DefaultAttempts}
+	if d.config.HubTimeoutSeconds > 0 {
+		options.Timeout = time.Duration(d.config.HubTimeoutSeconds) * time.Second
+	}
+	if d.config.HubAttempts > 0 {
+		options.Attempts = d.config.HubAttempts
+	}
+	return options
 }
 
-// TurnOffAllLights turns off all bulbs
+// SetPollInterval changes how often the lights are polled, restarting the poller if it's running
+func (d *YeelightDriver) SetPollInterval(seconds int) {
+	d.config.PollSeconds = seconds
+	if d.poller != nil {
+		d.poller.stop()
+		d.poller = newStatePoller(d.ctx, d, d.pollInterval())
+		go d.poller.run()
+	}
+}
+
+// HubStatus returns the status of a hub from the background monitor
+func (d *YeelightDriver) HubStatus(hubID string) HubStatus {
+	if d.monitor == nil {
+		return HubStatus{Online: true}
+	}
+	return d.monitor.Status(hubID)
+}
+
+// TurnOffAllLights turns off all bulbs on every hub
 func (d *YeelightDriver) TurnOffAllLights() error {
-	return yeelight.TurnOffAllLights(d.config.IP)
+	for _, id := range d.config.LightIDs {
+		d.fader.cancel(id)
+	}
+	d.effects.stopAll()
+	return d.hub.TurnOffAllLights()
 }
 
 func containsString(haystack []string, needle string) bool {
@@ -272,6 +946,17 @@ func containsString(haystack []string, needle string) bool {
 	return false
 }
 
+// removeString returns slice without any occurrences of value
+func removeString(slice []string, value string) []string {
+	kept := slice[:0]
+	for _, v := range slice {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
 // pos finds the position of a value in a slice, returns -1 if not found
 func pos(slice []string, value string) int {
 	for p, v := range slice {
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/simulator"
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// testLight stands in for a light exported to the Sphere, keeping the states the driver sends it
+// and the callbacks go-ninja would call with commands from the Sphere
+type testLight struct {
+	info   *model.Device
+	apply  func(state *devices.LightDeviceState) error
+	isOn   func() (bool, error)
+	mu     sync.Mutex
+	states []*devices.LightDeviceState
+}
+
+func (l *testLight) GetDeviceInfo() *model.Device {
+	return l.info
+}
+
+func (l *testLight) UpdateLightState(state *devices.LightDeviceState) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.states = append(l.states, state)
+	return nil
+}
+
+// newTestDriver creates a driver with an empty config that doesn't need a Sphere: the config isn't saved,
+// devices aren't exported and SSDP finds nothing. Commands get one short attempt, as the hubs are all local
+func newTestDriver(t *testing.T) *YeelightDriver {
+	t.Helper()
+	d := newDriver()
+	d.Info = info
+	d.config = DefaultConfig()
+	d.config.Initialised = true
+	d.config.HubTimeoutSeconds = 1
+	d.config.HubAttempts = 1
+	d.sendConfig = func(config *YeelightDriverConfig) error { return nil }
+	d.exportLight = func(info *model.Device, apply func(state *devices.LightDeviceState) error, isOn func() (bool, error)) (ninjaLight, error) {
+		return &testLight{info: info, apply: apply, isOn: isOn}, nil
+	}
+	d.subscribe = func(topic string, handler func(payload []byte)) (func(), error) { return func() {}, nil }
+	d.thingModel = func() serviceClient { return nil }
+	d.discover = func() (sunflower.DiscoveredHub, error) {
+		return sunflower.DiscoveredHub{}, fmt.Errorf("No hub answered the search")
+	}
+	t.Cleanup(func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.cancel()
+		d.fader.cancelAll()
+		d.effects.stopAll()
+	})
+	return d
+}
+
+// startTestDriver starts the driver with its config the way the Sphere does, with the services it would export
+// already in place, and stops it when the test ends
+func startTestDriver(t *testing.T, d *YeelightDriver) {
+	t.Helper()
+	d.configure = &configService{driver: d}
+	d.effectRPC = &effectService{driver: d}
+	if err := d.Start(d.config); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { d.Stop() })
+}
+
+// startHub starts a simulated hub on its own loopback address, closed when the test ends
+func startHub(t *testing.T, lights ...yeelight.Light) *simulator.Hub {
+	t.Helper()
+	hub := simulator.NewHub(lights...)
+	if err := hub.ListenLoopback(); err != nil {
+		t.Fatalf("Could not start simulated hub: %v", err)
+	}
+	t.Cleanup(func() { hub.Close() })
+	return hub
+}
+
+// answerSearches makes SSDP searches by the driver find hub, sending them straight to it as tests can't rely on multicast
+func answerSearches(t *testing.T, d *YeelightDriver, hub *simulator.Hub) {
+	t.Helper()
+	if err := hub.ListenSSDP(net.JoinHostPort(hub.IP(), "0")); err != nil {
+		t.Fatalf("Could not answer SSDP: %v", err)
+	}
+	d.discover = func() (sunflower.DiscoveredHub, error) {
+		return sunflower.DiscoverAt(hub.SearchAddr(), time.Second)
+	}
+}
+
+// waitForLight waits for a simulated light to reach a state, failing the test if it doesn't within a couple of seconds
+func waitForLight(t *testing.T, hub *simulator.Hub, want yeelight.Light) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := hub.Light(want.ID)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("light %v = %+v, want %+v", want.ID, got, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestScanLightsToConfig(t *testing.T) {
+	first := startHub(t, yeelight.Light{ID: "4F1A", Level: 60}, yeelight.Light{ID: "238B"})
+	second := startHub(t, yeelight.Light{ID: "77C0", Level: 100})
+
+	d := newTestDriver(t)
+	d.config.Initialised = false
+	d.config.IgnoredIDs = []string{"238B"}
+	answerSearches(t, d, first)
+	// the second hub was added by hand, so it's only found through the config
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: second.IP()}}
+
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	if !d.config.Initialised {
+		t.Errorf("config is not initialised after a scan")
+	}
+	if len(d.config.Hubs) != 2 {
+		t.Fatalf("hubs = %v, want the configured one and the discovered one", d.config.Hubs)
+	}
+	hubs := map[string][]string{}
+	for _, hub := range d.config.Hubs {
+		hubs[hub.IP] = hub.LightIDs
+	}
+	if discovered := d.config.Hubs[1]; discovered.IP != first.IP() || discovered.USN != first.USN() {
+		t.Errorf("discovered hub = %+v, want it at %v with USN %v", discovered, first.IP(), first.USN())
+	}
+	if got := fmt.Sprint(hubs[second.IP()]); got != "[77C0]" {
+		t.Errorf("lights on the configured hub = %v, want [77C0]", got)
+	}
+	// the ignored light stays out
+	if got := fmt.Sprint(hubs[first.IP()]); got != "[4F1A]" {
+		t.Errorf("lights on the discovered hub = %v, want [4F1A]", got)
+	}
+	if d.config.Names["4F1A"] != "Yee4F1A" || d.config.Names["77C0"] != "Yee77C0" {
+		t.Errorf("names = %v, want defaults for the new lights", d.config.Names)
+	}
+
+	// lights that go from the hub are kept but marked missing, until they come back
+	first.RemoveLight("4F1A")
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	if !d.IsMissing("4F1A") || !containsString(d.config.LightIDs, "4F1A") {
+		t.Errorf("light removed from its hub: missing %v, light IDs %v", d.IsMissing("4F1A"), d.config.LightIDs)
+	}
+	first.AddLight(yeelight.Light{ID: "4F1A"})
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	if d.IsMissing("4F1A") {
+		t.Errorf("light is still missing after coming back")
+	}
+
+	// with no hubs answering, the scan fails
+	first.SetOffline(true)
+	second.SetOffline(true)
+	if err := d.ScanLightsToConfig(); err == nil {
+		t.Errorf("ScanLightsToConfig with every hub offline succeeded")
+	}
+}
+
+func TestFindHubByUSN(t *testing.T) {
+	upstairs := startHub(t, yeelight.Light{ID: "4F1A"})
+	d := newTestDriver(t)
+	answerSearches(t, d, upstairs)
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+
+	// the hub gets a new address, and its lights have been paired again so only the USN says it's the same hub
+	moved := startHub(t, yeelight.Light{ID: "77C0"})
+	moved.SetUSN(upstairs.USN())
+	upstairs.Close()
+	answerSearches(t, d, moved)
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig after moving: %v", err)
+	}
+	if len(d.config.Hubs) != 1 || d.config.Hubs[0].IP != moved.IP() {
+		t.Fatalf("hubs = %+v, want hub 1 moved to %v", d.config.Hubs, moved.IP())
+	}
+
+	// a hub added by IP address is recognised when it's discovered, and keeps its USN from then on
+	downstairs := startHub(t, yeelight.Light{ID: "238B"})
+	if _, err := d.AddHub(downstairs.IP(), ""); err != nil {
+		t.Fatalf("AddHub: %v", err)
+	}
+	answerSearches(t, d, downstairs)
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	if len(d.config.Hubs) != 2 || d.config.Hubs[1].USN != downstairs.USN() {
+		t.Fatalf("hubs = %+v, want hub 2 with USN %v", d.config.Hubs, downstairs.USN())
+	}
+
+	// another hub with lights we know isn't mistaken for one whose USN is known
+	other := startHub(t, yeelight.Light{ID: "238B"})
+	hub, err := d.findHub(other.IP(), other.USN())
+	if err != nil || hub != nil {
+		t.Errorf("findHub for a new hub with known lights = %+v, %v, want a new hub", hub, err)
+	}
+	if d.config.Hubs[1].IP != downstairs.IP() {
+		t.Errorf("hub 2 moved to %v", d.config.Hubs[1].IP)
+	}
+}
+
+func TestSavePreset(t *testing.T) {
+	hub := startHub(t,
+		yeelight.Light{ID: "4F1A", LQI: 80, R: 255, G: 136, B: 0, Level: 60},
+		yeelight.Light{ID: "238B", LQI: 60, R: 0, G: 0, B: 255, Level: 20},
+		yeelight.Light{ID: "77C0", R: 1, G: 2, B: 3, Level: 0},
+	)
+	d := newTestDriver(t)
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: hub.IP()}}
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	d.config.GroupNames = []string{"Lounge"}
+	d.config.Groups = map[string]*Group{"Lounge": {LightIDs: []string{"238B", "77C0"}}}
+
+	tests := []struct {
+		name     string
+		lightIDs []string
+		want     []sunflower.PresetLight
+	}{
+		{"Orange", []string{"4F1A"}, []sunflower.PresetLight{{ID: "4F1A", R: 255, G: 136, B: 0, Level: 60}}},
+		{"Lounge", []string{"group:Lounge"}, []sunflower.PresetLight{{ID: "238B", B: 255, Level: 20}, {ID: "77C0", R: 1, G: 2, B: 3}}},
+		{"Everything", []string{"all"}, []sunflower.PresetLight{
+			{ID: "4F1A", R: 255, G: 136, B: 0, Level: 60}, {ID: "238B", B: 255, Level: 20}, {ID: "77C0", R: 1, G: 2, B: 3}}},
+	}
+	for _, test := range tests {
+		if err := d.SavePreset(&savePresetData{Name: test.name, LightIDs: test.lightIDs}); err != nil {
+			t.Fatalf("SavePreset(%v): %v", test.name, err)
+		}
+		preset := d.config.Presets[test.name]
+		if preset == nil || fmt.Sprint(preset.Lights) != fmt.Sprint(test.want) {
+			t.Errorf("preset %v = %+v, want %+v", test.name, preset, test.want)
+		}
+	}
+	if fmt.Sprint(d.config.PresetNames) != "[Orange Lounge Everything]" {
+		t.Errorf("preset names = %v", d.config.PresetNames)
+	}
+
+	// saving again updates the preset in place
+	hub.Execute("C 4F1A,9,9,9,9,,0")
+	if err := d.SavePreset(&savePresetData{Name: "Orange", LightIDs: []string{"4F1A"}}); err != nil {
+		t.Fatalf("SavePreset: %v", err)
+	}
+	if got := d.config.Presets["Orange"].Lights; len(got) != 1 || got[0].Level != 9 || len(d.config.PresetNames) != 3 {
+		t.Errorf("updated preset = %+v, names %v", got, d.config.PresetNames)
+	}
+}
+
+func TestActivatePreset(t *testing.T) {
+	hub := startHub(t,
+		yeelight.Light{ID: "4F1A", R: 255, G: 255, B: 255, Level: 100},
+		yeelight.Light{ID: "238B", R: 0, G: 0, B: 0, Level: 0},
+		yeelight.Light{ID: "77C0", R: 5, G: 5, B: 5, Level: 5},
+	)
+	d := newTestDriver(t)
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: hub.IP()}}
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	d.config.PresetNames = []string{"Evening"}
+	d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{
+		{ID: "4F1A", R: 255, G: 136, B: 0, Level: 40},
+		{ID: "238B", R: 0, G: 0, B: 255, Level: 80},
+	}}
+
+	if err := d.ActivatePreset("Missing", 0); err == nil {
+		t.Errorf("ActivatePreset with an unknown preset succeeded")
+	}
+
+	// straight away
+	if err := d.ActivatePreset("Evening", 0); err != nil {
+		t.Fatalf("ActivatePreset: %v", err)
+	}
+	waitForLight(t, hub, yeelight.Light{ID: "4F1A", R: 255, G: 136, B: 0, Level: 40})
+	waitForLight(t, hub, yeelight.Light{ID: "238B", R: 0, G: 0, B: 255, Level: 80})
+	// lights that aren't in the preset are left alone
+	waitForLight(t, hub, yeelight.Light{ID: "77C0", R: 5, G: 5, B: 5, Level: 5})
+
+	// and fading, with the fades running outside the lock the way Labs and the scheduler call it
+	hub.Execute("C ****,0,0,0,0,,0")
+	commands := len(hub.Commands())
+	d.mu.Lock()
+	err := d.ActivatePreset("Evening", 300*time.Millisecond)
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("ActivatePreset with a fade: %v", err)
+	}
+	waitForLight(t, hub, yeelight.Light{ID: "4F1A", R: 255, G: 136, B: 0, Level: 40})
+	waitForLight(t, hub, yeelight.Light{ID: "238B", R: 0, G: 0, B: 255, Level: 80})
+	// a GetLights, then more than one step for each light
+	if sent := len(hub.Commands()) - commands; sent < 5 {
+		t.Errorf("fade sent %d commands, want several steps", sent)
+	}
+
+	// lights that fail are reported, but don't stop the others
+	hub.RemoveLight("238B")
+	hub.Execute("C 4F1A,0,0,0,0,,0")
+	err = d.ActivatePreset("Evening", 0)
+	failed, ok := err.(sunflower.LightErrors)
+	if !ok || len(failed) != 1 || failed[0].ID != "238B" {
+		t.Errorf("ActivatePreset with a light gone = %v, want an error for 238B", err)
+	}
+	waitForLight(t, hub, yeelight.Light{ID: "4F1A", R: 255, G: 136, B: 0, Level: 40})
+}
+
+// TestConcurrentCallers has the Sphere, Labs and a restarting driver all using the driver at once,
+// for go test -race to check everything shared is guarded
+func TestConcurrentCallers(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	d.config.PresetNames = []string{"Evening"}
+	d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "A1", R: 255, G: 136, Level: 40}, {ID: "B1", B: 255, Level: 80}}}
+	startTestDriver(t, d)
+	c := d.configure
+	lights := make(map[string]*testLight)
+	for id, device := range d.devices {
+		lights[id] = device.ninjaLight.(*testLight)
+	}
+
+	const rounds = 50
+	var wg sync.WaitGroup
+	run := func(name string, do func(round int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				if err := do(round); err != nil {
+					t.Errorf("%v: %v", name, err)
+					return
+				}
+			}
+		}()
+	}
+	// commands from the Sphere, fading and straight away
+	run("fade", func(round int) error {
+		transition, brightness := 2*int(fadeStep/time.Millisecond), float64(round)/rounds
+		return lights["A1"].apply(&devices.LightDeviceState{Brightness: &brightness, Transition: &transition})
+	})
+	run("switch", func(round int) error {
+		on := round%2 == 0
+		if err := lights["B1"].apply(&devices.LightDeviceState{OnOff: &on}); err != nil {
+			return err
+		}
+		_, err := lights["A2"].isOn()
+		return err
+	})
+	// Labs presets, effects and all off
+	run("labs", func(round int) error {
+		var screen *suit.ConfigurationScreen
+		var err error
+		switch round % 3 {
+		case 0:
+			screen, err = c.Configure(&model.ConfigurationRequest{Action: "presetOn", Data: []byte(`{"name":"Evening","fade":"1"}`)})
+		case 1:
+			screen, err = c.Configure(&model.ConfigurationRequest{Action: "startEffect", Data: []byte(`{"effect":"candle","lightIDs":["all"]}`)})
+		default:
+			screen, err = c.Configure(&model.ConfigurationRequest{Action: "allOff"})
+		}
+		if err != nil {
+			return err
+		}
+		if message := screenError(screen); message != "" && message != "The Yeelight driver is stopped" {
+			return fmt.Errorf("%v", message)
+		}
+		return nil
+	})
+	// and the driver restarting underneath them
+	run("restart", func(round int) error {
+		if err := d.Stop(); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		config := d.config
+		d.mu.Unlock()
+		return d.Start(config)
+	})
+	wg.Wait()
+
+	// everything stops with the driver
+	if err := d.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	time.Sleep(2 * fadeStep)
+	sent := len(first.sent()) + len(second.sent())
+	time.Sleep(3 * fadeStep)
+	if more := len(first.sent()) + len(second.sent()) - sent; more != 0 {
+		t.Errorf("%d commands sent after the driver stopped", more)
+	}
+}
+
+// TestBackgroundChecksDontHoldLock checks the monitor and poller leave the driver unlocked while waiting for a slow hub
+func TestBackgroundChecksDontHoldLock(t *testing.T) {
+	d := newTestDriver(t)
+	hub := startHub(t, yeelight.Light{ID: "4F1A", Level: 60})
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: hub.IP(), LightIDs: []string{"4F1A"}}}
+	d.config.LightIDs = []string{"4F1A"}
+	hub.SetDelay(500 * time.Millisecond)
+	monitor := newHubMonitor(d.ctx, d, time.Hour)
+	poller := newStatePoller(d.ctx, d, time.Hour)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		monitor.checkHubs()
+	}()
+	go func() {
+		defer wg.Done()
+		poller.poll()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	d.mu.Lock()
+	d.mu.Unlock()
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("waited %v for the driver lock while the hub was slow", waited)
+	}
+	wg.Wait()
+
+	if status := monitor.Status("1"); !status.Online {
+		t.Errorf("slow hub is offline: %+v", status)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if light, ok := poller.last["4F1A"]; !ok || light.Level != 60 {
+		t.Errorf("poller read %+v for 4F1A", light)
+	}
+}
+
+func TestRediscover(t *testing.T) {
+	d := newTestDriver(t)
+	old := startHub(t, yeelight.Light{ID: "4F1A"})
+	if _, err := d.AddHub(old.IP(), ""); err != nil {
+		t.Fatalf("AddHub: %v", err)
+	}
+	d.config.Hubs[0].LightIDs = []string{"4F1A"}
+	monitor := newHubMonitor(d.ctx, d, time.Hour)
+	d.monitor = monitor
+
+	// the hub comes back at a new address, recognised by its lights as it had no USN
+	moved := startHub(t, yeelight.Light{ID: "4F1A"})
+	old.Close()
+	answerSearches(t, d, moved)
+	for i := 0; i < failuresToRediscover; i++ {
+		monitor.checkHubs()
+	}
+	d.mu.Lock()
+	hub := *d.config.Hubs[0]
+	d.mu.Unlock()
+	if hub.IP != moved.IP() || hub.USN != moved.USN() {
+		t.Errorf("hub = %+v, want it moved to %v with USN %v", hub, moved.IP(), moved.USN())
+	}
+	if status := monitor.Status("1"); !status.Online {
+		t.Errorf("moved hub is offline: %+v", status)
+	}
+}
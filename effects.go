@@ -0,0 +1,305 @@
+package main
+
+// Animated lighting effects (colour loop, candle, breathing, strobe, party) on any set of lights
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// effectCommandInterval limits how fast effects send commands, so the hubs aren't flooded:
+// a frame for n lights takes at least n times this
+const effectCommandInterval = 50 * time.Millisecond
+
+// Effects that can be run
+const (
+	EffectColorLoop = "colorloop"
+	EffectCandle    = "candle"
+	EffectBreathe   = "breathe"
+	EffectStrobe    = "strobe"
+	EffectParty     = "party"
+)
+
+// EffectNames lists the effects in the order they are shown
+var EffectNames = []string{EffectColorLoop, EffectCandle, EffectBreathe, EffectStrobe, EffectParty}
+
+// effect is an animation, worked out a frame at a time for each light
+type effect struct {
+	title    string        // for the config screens
+	interval time.Duration // time between frames
+	// frame returns the state of light i (of n) for frame number f, elapsed into the effect,
+	// given the light's state when the effect started
+	frame func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light
+}
+
+var effects = map[string]effect{
+	EffectColorLoop: {
+		title:    "Colour loop",
+		interval: 300 * time.Millisecond,
+		frame: func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light {
+			// once round the colour wheel a minute, with the lights spread around it
+			hue := math.Mod(elapsed.Minutes()+float64(i)/float64(n), 1)
+			r, g, b := yeelight.HSVToRGB(hue, 1, 1)
+			return yeelight.Light{ID: start.ID, R: r, G: g, B: b, Level: 100}
+		},
+	},
+	EffectCandle: {
+		title:    "Candle flicker",
+		interval: 150 * time.Millisecond,
+		frame: func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light {
+			// warm orange, flickering between 35 and 65% with the odd brighter flare
+			level := 35 + rnd.Intn(31)
+			if rnd.Intn(20) == 0 {
+				level = 80
+			}
+			return yeelight.Light{ID: start.ID, R: 255, G: 120 + rnd.Intn(25), B: 20, Level: level}
+		},
+	},
+	EffectBreathe: {
+		title:    "Breathing",
+		interval: 200 * time.Millisecond,
+		frame: func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light {
+			// the light's own colour, slowly brightening and dimming every 6 seconds
+			light := start
+			if light.R == 0 && light.G == 0 && light.B == 0 {
+				light.R, light.G, light.B = 255, 255, 255
+			}
+			phase := 2 * math.Pi * elapsed.Seconds() / 6
+			light.Level = 10 + int(45*(1-math.Cos(phase))+0.5)
+			return light
+		},
+	},
+	EffectStrobe: {
+		title:    "Strobe",
+		interval: 250 * time.Millisecond,
+		frame: func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light {
+			// on and off on alternate frames
+			level := 0
+			if f%2 == 0 {
+				level = 100
+			}
+			return yeelight.Light{ID: start.ID, R: 255, G: 255, B: 255, Level: level}
+		},
+	},
+	EffectParty: {
+		title:    "Party colours",
+		interval: time.Second,
+		frame: func(start yeelight.Light, i, n, f int, elapsed time.Duration, rnd *rand.Rand) yeelight.Light {
+			r, g, b := yeelight.HSVToRGB(rnd.Float64(), 1, 1)
+			return yeelight.Light{ID: start.ID, R: r, G: g, B: b, Level: 100}
+		},
+	},
+}
+
+// effectRun is an effect running on some lights
+type effectRun struct {
+	name   string
+	cancel context.CancelFunc
+}
+
+// effectRunner runs effects, making sure each light is in at most one effect at a time
+type effectRunner struct {
+	mu      sync.Mutex
+	running map[string]*effectRun // keyed by light ID
+}
+
+func newEffectRunner() *effectRunner {
+	return &effectRunner{running: make(map[string]*effectRun)}
+}
+
+// start runs an effect on lights (given their current state) until ctx is cancelled or stop is called for any of them.
+// Lights already running an effect are taken over, stopping the effect they were in.
+// The effect runs outside the driver lock mu, so it takes the lock for each command, and sends nothing more once
+// it has been stopped, even if a frame was waiting for the lock
+func (e *effectRunner) start(ctx context.Context, mu *sync.Mutex, hub sunflower.Client, name string, lights []yeelight.Light) error {
+	fx, ok := effects[name]
+	if !ok {
+		return fmt.Errorf("Unknown effect %v", name)
+	}
+	if len(lights) == 0 {
+		return fmt.Errorf("No lights to run %v on", fx.title)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	run := &effectRun{name: name, cancel: cancel}
+	e.mu.Lock()
+	for _, light := range lights {
+		if other, ok := e.running[light.ID]; ok {
+			other.cancel()
+		}
+		e.running[light.ID] = run
+	}
+	e.mu.Unlock()
+
+	interval := fx.interval
+	if min := time.Duration(len(lights)) * effectCommandInterval; interval < min {
+		interval = min
+	}
+	locked := &lockedHub{mu: mu, hub: hub, cancelled: func() bool { return ctx.Err() != nil }}
+	go func() {
+		defer e.finished(run)
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		began := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for f := 0; ; f++ {
+			elapsed := time.Since(began)
+			for i, start := range lights {
+				if ctx.Err() != nil {
+					return
+				}
+				light := fx.frame(start, i, len(lights), f, elapsed, rnd)
+				err := locked.SetLight(light.ID, light.R, light.G, light.B, light.Level)
+				if err == errCancelled {
+					return
+				}
+				if err != nil {
+					log.Printf("Effect %v on light %v: %v", name, light.ID, err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	log.Printf("Started effect %v on %d lights", name, len(lights))
+	return nil
+}
+
+// finished removes a run's lights once it has stopped, unless they have moved to another effect
+func (e *effectRunner) finished(run *effectRun) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, r := range e.running {
+		if r == run {
+			delete(e.running, id)
+		}
+	}
+}
+
+// stop stops the effect a light is in (on all of its lights), if there is one
+func (e *effectRunner) stop(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if run, ok := e.running[id]; ok {
+		run.cancel()
+		for other, r := range e.running {
+			if r == run {
+				delete(e.running, other)
+			}
+		}
+	}
+}
+
+// stopAll stops every effect
+func (e *effectRunner) stopAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, run := range e.running {
+		run.cancel()
+		delete(e.running, id)
+	}
+}
+
+// runningOn returns the effect each light is running, keyed by light ID
+func (e *effectRunner) runningOn() map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make(map[string]string)
+	for id, run := range e.running {
+		names[id] = run.name
+	}
+	return names
+}
+
+// StartEffect runs an effect on lights, which can include groups (like "group:Lounge") or "all".
+// The effect runs until it is stopped, or a light in it is changed through its device or a preset
+func (d *YeelightDriver) StartEffect(name string, lightIDs []string) error {
+	ids := d.expandGroups(lightIDs)
+	if containsString(lightIDs, "all") {
+		ids = d.config.LightIDs
+	}
+	current, err := d.hub.GetLights()
+	if err != nil {
+		return err
+	}
+	var lights []yeelight.Light
+	for _, id := range ids {
+		// an effect replaces any fade in progress
+		d.fader.cancel(id)
+		d.lightCommanded(id)
+		if light, found := findLight(current, id); found {
+			lights = append(lights, light)
+		}
+	}
+	return d.effects.start(d.ctx, &d.mu, d.hub, name, lights)
+}
+
+// StopEffects stops the effects running on lights (or groups), or every effect if lightIDs is empty
+func (d *YeelightDriver) StopEffects(lightIDs []string) {
+	if len(lightIDs) == 0 || containsString(lightIDs, "all") {
+		d.effects.stopAll()
+		return
+	}
+	for _, id := range d.expandGroups(lightIDs) {
+		d.effects.stop(id)
+	}
+}
+
+// RunningEffects describes the effects that are running, like "Candle flicker: Lounge, Hall", in effect order
+func (d *YeelightDriver) RunningEffects() []string {
+	byEffect := make(map[string][]string)
+	for id, name := range d.effects.runningOn() {
+		byEffect[name] = append(byEffect[name], d.config.Names[id])
+	}
+	var running []string
+	for _, name := range EffectNames {
+		if lights, ok := byEffect[name]; ok {
+			sort.Strings(lights)
+			running = append(running, fmt.Sprintf("%v: %v", effects[name].title, strings.Join(lights, ", ")))
+		}
+	}
+	return running
+}
+
+// effectService is exported so other drivers and apps can run effects over RPC
+type effectService struct {
+	driver *YeelightDriver
+}
+
+// EffectRequest is the argument to the effect service's methods
+type EffectRequest struct {
+	Effect   string   `json:"effect"`   // one of EffectNames, for Start
+	LightIDs []string `json:"lightIDs"` // light IDs, groups (like "group:Lounge") or "all"
+}
+
+// Start runs an effect on the requested lights
+func (s *effectService) Start(request *EffectRequest) error {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	return s.driver.StartEffect(request.Effect, request.LightIDs)
+}
+
+// Stop stops the effects on the requested lights, or all effects if none are given
+func (s *effectService) Stop(request *EffectRequest) error {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	s.driver.StopEffects(request.LightIDs)
+	return nil
+}
+
+// List returns the effects that can be run
+func (s *effectService) List() ([]string, error) {
+	return EffectNames, nil
+}
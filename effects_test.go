@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// waitForFrames waits until a hub has been sent at least n commands after the first skip, failing the test if it isn't
+func waitForFrames(t *testing.T, hub *fakeHub, skip, n int) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for len(fadeSteps(hub, skip)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("effect sent %d commands, want %d", len(fadeSteps(hub, skip)), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEffectCommandRate(t *testing.T) {
+	var lights []yeelight.Light
+	for i := 0; i < 10; i++ {
+		lights = append(lights, yeelight.Light{ID: fmt.Sprintf("L%d", i), Level: 50})
+	}
+	hub := newFakeHub(lights...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// strobe wants a frame every 250ms, but a frame for 10 lights may only go every 500ms
+	e := newEffectRunner()
+	began := time.Now()
+	if err := e.start(ctx, &sync.Mutex{}, hub, EffectStrobe, lights); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	cancel()
+	elapsed := time.Since(began)
+	time.Sleep(100 * time.Millisecond)
+
+	sent := len(fadeSteps(hub, 0))
+	if max := int(elapsed/effectCommandInterval) + len(lights); sent > max {
+		t.Errorf("effect sent %d commands in %v, want at most %d", sent, elapsed, max)
+	}
+	if sent < 2*len(lights) {
+		t.Errorf("effect sent %d commands in %v, want at least two frames", sent, elapsed)
+	}
+	if got := e.runningOn(); len(got) != 0 {
+		t.Errorf("effect still running on %v after its context was cancelled", got)
+	}
+}
+
+func TestStopEffects(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	d.mu.Lock()
+	err := d.StartEffect(EffectStrobe, []string{"A1", "B1"})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("StartEffect: %v", err)
+	}
+	waitForFrames(t, first, 0, 2)
+	if got := d.RunningEffects(); len(got) != 1 || got[0] != "Strobe: YeeA1, YeeB1" {
+		t.Errorf("RunningEffects = %q", got)
+	}
+
+	// stopping one light stops the effect on all of its lights, and nothing more is sent
+	d.mu.Lock()
+	d.StopEffects([]string{"B1"})
+	sentFirst, sentSecond := len(first.sent()), len(second.sent())
+	d.mu.Unlock()
+	time.Sleep(2 * effects[EffectStrobe].interval)
+	if more := fadeSteps(first, sentFirst); len(more) != 0 {
+		t.Errorf("A1 was sent %q after the effect stopped", more)
+	}
+	if more := fadeSteps(second, sentSecond); len(more) != 0 {
+		t.Errorf("B1 was sent %q after the effect stopped", more)
+	}
+	if got := d.RunningEffects(); len(got) != 0 {
+		t.Errorf("RunningEffects = %q after stopping", got)
+	}
+}
+
+func TestManualChangeStopsEffect(t *testing.T) {
+	d, first, _ := newFakeHubDriver(t)
+	d.mu.Lock()
+	err := d.StartEffect(EffectStrobe, []string{"A1", "B1"})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("StartEffect: %v", err)
+	}
+	waitForFrames(t, first, 0, 1)
+
+	// a slow manual change holds the lock while the effect's next frame waits for it
+	first.setDelay(effects[EffectStrobe].interval)
+	d.mu.Lock()
+	time.Sleep(2 * effects[EffectStrobe].interval)
+	brightness := 0.5
+	err = d.devices["A1"].applyLightState(&devices.LightDeviceState{Brightness: &brightness})
+	sent := len(first.sent())
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("applyLightState: %v", err)
+	}
+	first.setDelay(0)
+
+	time.Sleep(2 * effects[EffectStrobe].interval)
+	if more := fadeSteps(first, sent); len(more) != 0 {
+		t.Errorf("effect frame %q was sent after the light was changed", more)
+	}
+	if level := first.light("A1").Level; level != 50 {
+		t.Errorf("A1 level = %d, want the manual change's 50", level)
+	}
+	if got := d.RunningEffects(); len(got) != 0 {
+		t.Errorf("RunningEffects = %q after a manual change", got)
+	}
+}
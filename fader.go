@@ -0,0 +1,141 @@
+package main
+
+// Smooth transitions between light states
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// fadeStep is the time between commands to a bulb during a fade, which keeps the hub from being flooded
+const fadeStep = 100 * time.Millisecond
+
+// fader runs fades on lights, making sure each light only has one fade running at a time
+type fader struct {
+	mu    sync.Mutex
+	fades map[string]chan struct{} // closed to cancel the running fade of each light, keyed by light ID
+}
+
+func newFader() *fader {
+	return &fader{fades: make(map[string]chan struct{})}
+}
+
+// cancel stops any fade running on a light, called whenever a newer command is sent to it
+func (f *fader) cancel(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if quit, ok := f.fades[id]; ok {
+		close(quit)
+		delete(f.fades, id)
+	}
+}
+
+// cancelAll stops every fade that is running
+func (f *fader) cancelAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, quit := range f.fades {
+		close(quit)
+		delete(f.fades, id)
+	}
+}
+
+// start cancels any fade running on a light and registers a new one, returning the channel that cancels it.
+// Call it (with the driver lock held) before starting the fade's goroutine, so a newer command that arrives
+// before the goroutine runs still cancels the fade
+func (f *fader) start(id string) chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if quit, ok := f.fades[id]; ok {
+		close(quit)
+	}
+	quit := make(chan struct{})
+	f.fades[id] = quit
+	return quit
+}
+
+// fade steps a light from one colour and level to another over duration, stopping when quit (from start) is closed.
+// It blocks until the fade finishes or is cancelled (by cancel or ctx), so run it in a goroutine. hub should be a
+// lockedHub checking fadeCancelled, so a step waiting for the driver lock isn't sent after a newer command cancels the fade
+func (f *fader) fade(ctx context.Context, hub sunflower.Client, quit chan struct{}, from, to yeelight.Light, duration time.Duration) error {
+	defer func() {
+		f.mu.Lock()
+		if f.fades[to.ID] == quit {
+			delete(f.fades, to.ID)
+		}
+		f.mu.Unlock()
+	}()
+
+	steps := int(duration / fadeStep)
+	if steps < 1 {
+		steps = 1
+	}
+	ticker := time.NewTicker(fadeStep)
+	defer ticker.Stop()
+	for step := 1; step <= steps; step++ {
+		// cancelled before this step, like a newer command arriving before the goroutine got going
+		select {
+		case <-quit:
+			return nil
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		fraction := float64(step) / float64(steps)
+		mix := func(a, b int) int {
+			return a + int(fraction*float64(b-a)+0.5)
+		}
+		err := hub.SetLight(to.ID, mix(from.R, to.R), mix(from.G, to.G), mix(from.B, to.B), mix(from.Level, to.Level))
+		if err == errCancelled {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Fade of light %v stopped: %v", to.ID, err)
+		}
+		if step == steps {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// fadeCancelled returns whether a fade (given its quit channel from start, and ctx) has been cancelled,
+// for a lockedHub to check before each step
+func fadeCancelled(ctx context.Context, quit chan struct{}) func() bool {
+	return func() bool {
+		select {
+		case <-quit:
+			return true
+		case <-ctx.Done():
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// currentLight gets the state of a single light from its hub
+func currentLight(hub sunflower.Client, id string) (yeelight.Light, error) {
+	lights, err := hub.GetLights()
+	if err != nil {
+		return yeelight.Light{}, err
+	}
+	for _, light := range lights {
+		if light.ID == id {
+			return light, nil
+		}
+	}
+	return yeelight.Light{}, fmt.Errorf("Light %v not found on hub", id)
+}
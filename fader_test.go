@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+func TestFade(t *testing.T) {
+	hub := newFakeHub(yeelight.Light{ID: "A1"})
+	f := newFader()
+	from, to := yeelight.Light{ID: "A1"}, yeelight.Light{ID: "A1", R: 200, G: 100, B: 50, Level: 80}
+	quit := f.start("A1")
+	if err := f.fade(context.Background(), hub, quit, from, to, 5*fadeStep); err != nil {
+		t.Fatalf("fade: %v", err)
+	}
+	want := []string{"SetLight A1 40,20,10,16", "SetLight A1 80,40,20,32", "SetLight A1 120,60,30,48", "SetLight A1 160,80,40,64", "SetLight A1 200,100,50,80"}
+	if got := hub.sent(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("fade sent %q, want %q", got, want)
+	}
+	if len(f.fades) != 0 {
+		t.Errorf("finished fade is still registered")
+	}
+
+	// a cancelled fade sends nothing more, even if it hadn't started yet
+	quit = f.start("A1")
+	f.cancel("A1")
+	if err := f.fade(context.Background(), hub, quit, to, from, 5*fadeStep); err != nil {
+		t.Fatalf("fade: %v", err)
+	}
+	if got := len(hub.sent()); got != len(want) {
+		t.Errorf("cancelled fade sent %d commands", got-len(want))
+	}
+}
+
+// fadeSteps returns the SetLight commands sent to a hub after the first skip commands
+func fadeSteps(hub *fakeHub, skip int) []string {
+	var steps []string
+	for _, command := range hub.sent()[skip:] {
+		if strings.HasPrefix(command, "SetLight") {
+			steps = append(steps, command)
+		}
+	}
+	return steps
+}
+
+func TestNewerCommandCancelsFadeBeforeItStarts(t *testing.T) {
+	transition := 300
+	brightness := 0.2
+	tests := []struct {
+		name  string
+		start func(d *YeelightDriver) error
+	}{
+		{"device fade", func(d *YeelightDriver) error {
+			return d.devices["A1"].applyLightState(&devices.LightDeviceState{Brightness: &brightness, Transition: &transition})
+		}},
+		{"preset fade", func(d *YeelightDriver) error {
+			return d.ActivatePreset("Bright", time.Duration(transition)*time.Millisecond)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, hub, _ := newFakeHubDriver(t)
+			d.config.Presets["Bright"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "A1", R: 255, G: 255, B: 255, Level: 100}}}
+
+			// the fade and the newer command both happen in one hold of the driver lock, so the newer command
+			// comes before the fade's goroutine has done anything
+			d.mu.Lock()
+			if err := test.start(d); err != nil {
+				d.mu.Unlock()
+				t.Fatalf("starting the fade: %v", err)
+			}
+			sent := len(hub.sent())
+			off := false
+			err := d.devices["A1"].applyLightState(&devices.LightDeviceState{OnOff: &off})
+			d.mu.Unlock()
+			if err != nil {
+				t.Fatalf("newer command: %v", err)
+			}
+
+			time.Sleep(time.Duration(transition)*time.Millisecond + 2*fadeStep)
+			if steps := fadeSteps(hub, sent); len(steps) != 0 {
+				t.Errorf("fade carried on after a newer command: %q", steps)
+			}
+			if level := hub.light("A1").Level; level != 0 {
+				t.Errorf("A1 level = %d, want the newer command's 0", level)
+			}
+		})
+	}
+}
+
+func TestNewerCommandCancelsWaitingFadeStep(t *testing.T) {
+	d, hub, _ := newFakeHubDriver(t)
+	transition := 2000
+	brightness := 1.0
+	d.mu.Lock()
+	err := d.devices["A1"].applyLightState(&devices.LightDeviceState{Brightness: &brightness, Transition: &transition})
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("starting the fade: %v", err)
+	}
+	time.Sleep(2 * fadeStep)
+
+	// a slow newer command holds the lock while the fade's next step waits for it
+	hub.setDelay(fadeStep)
+	d.mu.Lock()
+	time.Sleep(2 * fadeStep)
+	off := false
+	err = d.devices["A1"].applyLightState(&devices.LightDeviceState{OnOff: &off})
+	sent := len(hub.sent())
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("newer command: %v", err)
+	}
+
+	time.Sleep(4 * fadeStep)
+	if steps := fadeSteps(hub, sent); len(steps) != 0 {
+		t.Errorf("waiting fade step was sent after a newer command: %q", steps)
+	}
+	if level := hub.light("A1").Level; level != 0 {
+		t.Errorf("A1 level = %d, want the newer command's 0", level)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// Groups (rooms) of lights, each exported as a light device that controls all of its lights
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+// groupPrefix marks a group (rather than a light) in lists of light IDs from the config screens, like "group:Lounge"
+const groupPrefix = "group:"
+
+// Group is a named set of lights, like a room
+type Group struct {
+	//	Name   string	// name is the key in the map of Groups
+	LightIDs []string
+}
+
+// GroupDevice is a light device for a group, which passes every change on to the lights in the group
+type GroupDevice struct {
+	ninjaLight
+	name    string
+	removed bool // set when the group is deleted, as devices can't be unexported until the driver restarts
+}
+
+// NewGroupDevice creates a light device for a group, given a driver and the group name
+func NewGroupDevice(d *YeelightDriver, name string) *GroupDevice {
+	displayName := name
+	infoModel := &model.Device{
+		NaturalID:     groupNaturalID(name),
+		NaturalIDType: "light-group",
+		Name:          &displayName,
+		Signatures: &map[string]string{
+			"ninja:manufacturer": "Qingdao Yeelink",
+			"ninja:productName":  "Yeelight Group",
+			"ninja:productType":  "Light",
+			"ninja:thingType":    "light",
+		},
+	}
+
+	gd := &GroupDevice{name: name}
+
+	// ApplyLightState sends the same state to every light in the group, through each light's own device
+	apply := func(state *devices.LightDeviceState) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		log.Printf("Applying Light State to group %v: %v\n", name, *state)
+		if gd.removed {
+			return fmt.Errorf("Group %v has been deleted", name)
+		}
+		var failed sunflower.LightErrors
+		for _, device := range d.groupMembers(name) {
+			if err := device.applyLightState(copyLightState(state)); err != nil {
+				failed = append(failed, sunflower.LightError{ID: device.id, Err: err})
+			}
+		}
+		matchOnOffAndBrightness(state)
+		gd.UpdateLightState(state)
+		return failed.OrNil()
+	}
+
+	// a group is on if any of its lights are on
+	isOn := func() (bool, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if gd.removed {
+			return false, fmt.Errorf("Group %v has been deleted", name)
+		}
+		var err error
+		for _, device := range d.groupMembers(name) {
+			isOn, memberErr := device.applyIsOn()
+			if memberErr != nil {
+				err = memberErr
+				continue
+			}
+			if isOn {
+				return true, nil
+			}
+		}
+		return false, err
+	}
+
+	// with the same channels as the lights
+	lightDevice, err := d.exportLight(infoModel, apply, isOn)
+	if err != nil {
+		log.Printf("Error creating group device %v\n", name)
+	}
+	gd.ninjaLight = lightDevice
+	return gd
+}
+
+// groupNaturalID is the ID a group's device is known by, like "group-living-room" for "Living Room".
+// Different names can give the same ID, so SaveGroup doesn't allow two groups to share one (see collidingGroup)
+func groupNaturalID(name string) string {
+	return "group-" + strings.ToLower(strings.Replace(name, " ", "-", -1))
+}
+
+// copyLightState makes a copy of a state that can be changed without affecting the original
+func copyLightState(state *devices.LightDeviceState) *devices.LightDeviceState {
+	c := &devices.LightDeviceState{}
+	if state.OnOff != nil {
+		onOff := *state.OnOff
+		c.OnOff = &onOff
+	}
+	if state.Brightness != nil {
+		brightness := *state.Brightness
+		c.Brightness = &brightness
+	}
+	if state.Color != nil {
+		color := *state.Color
+		c.Color = &color
+	}
+	if state.Transition != nil {
+		transition := *state.Transition
+		c.Transition = &transition
+	}
+	return c
+}
+
+// groupMembers returns the devices of the lights in a group
+func (d *YeelightDriver) groupMembers(name string) []*YeelightDevice {
+	group, ok := d.config.Groups[name]
+	if !ok {
+		return nil
+	}
+	var members []*YeelightDevice
+	for _, id := range group.LightIDs {
+		if device, ok := d.devices[id]; ok {
+			members = append(members, device)
+		}
+	}
+	return members
+}
+
+// SaveGroup creates a group, or replaces the lights in an existing group, and exports a device for a new group
+func (d *YeelightDriver) SaveGroup(name string, lightIDs []string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("Groups need a name")
+	}
+	if d.config.Groups == nil {
+		d.config.Groups = make(map[string]*Group)
+	}
+	if other := d.collidingGroup(name); other != "" {
+		return fmt.Errorf("Group %v is too like group %v, choose another name", name, other)
+	}
+	if !containsString(d.config.GroupNames, name) {
+		d.config.GroupNames = append(d.config.GroupNames, name)
+	}
+	d.config.Groups[name] = &Group{LightIDs: lightIDs}
+	d.CreateGroupDevicesFromConfig()
+	log.Printf("Saving group: %v with lights %v\n", name, lightIDs)
+	// save the new configuration
+	return d.saveConfig()
+}
+
+// collidingGroup returns the name of another group whose device would have the same ID as a group called name,
+// which the Sphere would see as one device, or "" if there isn't one
+func (d *YeelightDriver) collidingGroup(name string) string {
+	for _, other := range d.config.GroupNames {
+		if other != name && groupNaturalID(other) == groupNaturalID(name) {
+			return other
+		}
+	}
+	return ""
+}
+
+// DeleteGroup takes the name of a group and deletes it from the config, stopping its device answering commands
+func (d *YeelightDriver) DeleteGroup(name string) error {
+	delete(d.config.Groups, name)
+	d.config.GroupNames = removeString(d.config.GroupNames, name)
+	if device, ok := d.groupDevices[name]; ok {
+		device.removed = true
+		delete(d.groupDevices, name)
+	}
+	// save the new configuration
+	return d.saveConfig()
+}
+
+// CreateGroupDevicesFromConfig creates a device (exporting it) for each group in the config that doesn't have one yet
+func (d *YeelightDriver) CreateGroupDevicesFromConfig() {
+	for _, name := range d.config.GroupNames {
+		if _, exists := d.groupDevices[name]; exists {
+			continue
+		}
+		log.Printf("Creating new Yeelight group, %v", name)
+		d.groupDevices[name] = NewGroupDevice(d, name)
+	}
+}
+
+// expandGroups replaces any groups (like "group:Lounge") in a list of light IDs with the lights in the group
+func (d *YeelightDriver) expandGroups(ids []string) []string {
+	var expanded []string
+	for _, id := range ids {
+		lightIDs := []string{id}
+		if strings.HasPrefix(id, groupPrefix) {
+			lightIDs = nil
+			if group, ok := d.config.Groups[strings.TrimPrefix(id, groupPrefix)]; ok {
+				lightIDs = group.LightIDs
+			}
+		}
+		for _, lightID := range lightIDs {
+			if !containsString(expanded, lightID) {
+				expanded = append(expanded, lightID)
+			}
+		}
+	}
+	return expanded
+}
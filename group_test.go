@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+func TestSaveGroup(t *testing.T) {
+	d, _, _ := newFakeHubDriver(t)
+	if err := d.SaveGroup(" Lounge Lamp ", []string{"A1"}); err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+	device, ok := d.groupDevices["Lounge Lamp"]
+	if !ok || device.GetDeviceInfo().NaturalID != "group-lounge-lamp" {
+		t.Fatalf("group devices = %v after saving", d.groupDevices)
+	}
+
+	// names that would be the same device are refused
+	for _, name := range []string{"lounge-lamp", "LOUNGE LAMP"} {
+		if err := d.SaveGroup(name, []string{"B1"}); err == nil || !strings.Contains(err.Error(), "Lounge Lamp") {
+			t.Errorf("SaveGroup(%q) = %v, want it refused as too like Lounge Lamp", name, err)
+		}
+	}
+	if err := d.SaveGroup("", []string{"B1"}); err == nil {
+		t.Errorf("SaveGroup without a name succeeded")
+	}
+
+	// but the group itself can be saved again, keeping its device
+	if err := d.SaveGroup("Lounge Lamp", []string{"A1", "B1"}); err != nil {
+		t.Fatalf("SaveGroup again: %v", err)
+	}
+	if d.groupDevices["Lounge Lamp"] != device || !reflect.DeepEqual(d.config.Groups["Lounge Lamp"].LightIDs, []string{"A1", "B1"}) {
+		t.Errorf("group = %+v after saving it again", d.config.Groups["Lounge Lamp"])
+	}
+	if !reflect.DeepEqual(d.config.GroupNames, []string{"Lounge Lamp"}) {
+		t.Errorf("GroupNames = %v", d.config.GroupNames)
+	}
+}
+
+func TestRenameGroup(t *testing.T) {
+	d, _, _ := newFakeHubDriver(t)
+	c := &configService{driver: d}
+	for _, name := range []string{"Lounge", "Kitchen"} {
+		if err := d.SaveGroup(name, []string{"A1"}); err != nil {
+			t.Fatalf("SaveGroup: %v", err)
+		}
+	}
+
+	// renaming a group to a name too like another's keeps it
+	configure(t, c, "editGroup", map[string]string{"groupName": "Kitchen"})
+	if message := screenError(configure(t, c, "saveGroup", saveGroupData{Name: "lounge", LightIDs: []string{"B1"}})); message == "" {
+		t.Errorf("renaming Kitchen to lounge showed no error")
+	}
+	if !reflect.DeepEqual(d.config.GroupNames, []string{"Lounge", "Kitchen"}) {
+		t.Errorf("GroupNames = %v after a refused rename", d.config.GroupNames)
+	}
+
+	// but changing the case of its own name is fine
+	if message := screenError(configure(t, c, "saveGroup", saveGroupData{Name: "KITCHEN", LightIDs: []string{"B1"}})); message != "" {
+		t.Errorf("renaming Kitchen to KITCHEN failed: %v", message)
+	}
+	if !reflect.DeepEqual(d.config.GroupNames, []string{"Lounge", "KITCHEN"}) {
+		t.Errorf("GroupNames = %v after renaming", d.config.GroupNames)
+	}
+}
+
+func TestGroupDevice(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+	if err := d.SaveGroup("Lounge", []string{"A1", "B1"}); err != nil {
+		t.Fatalf("SaveGroup: %v", err)
+	}
+	group := d.groupDevices["Lounge"].ninjaLight.(*testLight)
+
+	// a change goes to each light in the group, on whichever hub it's on, and to their devices for the UI
+	brightness := 0.3
+	if err := group.apply(&devices.LightDeviceState{Brightness: &brightness}); err != nil {
+		t.Fatalf("ApplyLightState: %v", err)
+	}
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, Level: 30}) {
+		t.Errorf("A1 = %+v after changing the group", got)
+	}
+	if got := second.light("B1"); got != (yeelight.Light{ID: "B1", B: 255, Level: 30}) {
+		t.Errorf("B1 = %+v after changing the group", got)
+	}
+	if got := first.light("A2"); got.Level != 0 {
+		t.Errorf("A2 = %+v, changed without being in the group", got)
+	}
+	for _, id := range []string{"A1", "B1"} {
+		light := d.devices[id].ninjaLight.(*testLight)
+		light.mu.Lock()
+		states := len(light.states)
+		light.mu.Unlock()
+		if states != 1 {
+			t.Errorf("%v's device was sent %d states, want 1", id, states)
+		}
+	}
+	if on, err := group.isOn(); err != nil || !on {
+		t.Errorf("group isOn = %v, %v", on, err)
+	}
+
+	// lights that fail don't stop the others
+	off := false
+	second.setErr(fmt.Errorf("Hub 2 is unplugged"))
+	err := group.apply(&devices.LightDeviceState{OnOff: &off})
+	if failed, ok := err.(sunflower.LightErrors); !ok || len(failed) != 1 || failed[0].ID != "B1" {
+		t.Errorf("ApplyLightState with hub 2 unplugged = %v, want an error for B1", err)
+	}
+	if got := first.light("A1"); got.Level != 0 {
+		t.Errorf("A1 = %+v after turning the group off", got)
+	}
+	second.setErr(nil)
+
+	// and a deleted group stops answering
+	if err := d.DeleteGroup("Lounge"); err != nil {
+		t.Fatalf("DeleteGroup: %v", err)
+	}
+	if err := group.apply(&devices.LightDeviceState{Brightness: &brightness}); err == nil {
+		t.Errorf("ApplyLightState on a deleted group succeeded")
+	}
+	if got := first.light("A1"); got.Level != 0 {
+		t.Errorf("A1 = %+v after changing a deleted group", got)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+// Access to the Yeelight Sunflower hub
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// hubSet is a sunflower.Client covering all of the driver's hubs.
+// Commands for a light go to the hub it is paired with, other commands go to every hub.
+// It reads the driver's config, so the driver lock must be held while using it
+type hubSet struct {
+	driver *YeelightDriver
+}
+
+// client returns the client for the hub a light is paired with
+func (h *hubSet) client(id string) (sunflower.Client, error) {
+	hub := h.driver.hubForLight(id)
+	if hub == nil {
+		return nil, fmt.Errorf("Light %v is not on any hub", id)
+	}
+	return h.driver.hubClient(hub.ID), nil
+}
+
+// GetLights returns the lights from every hub that responds, only failing if none of them do
+func (h *hubSet) GetLights() ([]yeelight.Light, error) {
+	return allLights(h.driver.hubSnapshots())
+}
+
+func (h *hubSet) SetLight(id string, r, g, b, level int) error {
+	client, err := h.client(id)
+	if err != nil {
+		return err
+	}
+	return client.SetLight(id, r, g, b, level)
+}
+
+func (h *hubSet) SetOnOff(id string, on bool) error {
+	client, err := h.client(id)
+	if err != nil {
+		return err
+	}
+	return client.SetOnOff(id, on)
+}
+
+func (h *hubSet) SetBrightness(id string, brightness float64) error {
+	client, err := h.client(id)
+	if err != nil {
+		return err
+	}
+	return client.SetBrightness(id, brightness)
+}
+
+func (h *hubSet) SetColor(id string, r, g, b int) error {
+	client, err := h.client(id)
+	if err != nil {
+		return err
+	}
+	return client.SetColor(id, r, g, b)
+}
+
+func (h *hubSet) IsOn(id string) (bool, error) {
+	client, err := h.client(id)
+	if err != nil {
+		return false, err
+	}
+	return client.IsOn(id)
+}
+
+// Heartbeat pings every hub, returning the last error if any of them don't respond
+func (h *hubSet) Heartbeat() error {
+	var err error
+	for _, hub := range h.driver.config.Hubs {
+		if hubErr := h.driver.hubClient(hub.ID).Heartbeat(); hubErr != nil {
+			err = fmt.Errorf("%v: %v", hub.Label(), hubErr)
+		}
+	}
+	return err
+}
+
+// TurnOffAllLights turns off the lights on every hub, returning the last error if any fail
+func (h *hubSet) TurnOffAllLights() error {
+	var err error
+	for _, hub := range h.driver.config.Hubs {
+		if hubErr := h.driver.hubClient(hub.ID).TurnOffAllLights(); hubErr != nil {
+			err = fmt.Errorf("%v: %v", hub.Label(), hubErr)
+		}
+	}
+	return err
+}
+
+// hubSnapshot is a hub as it was configured when the snapshot was taken, with a client fixed to its address then.
+// Background work uses snapshots to talk to the hubs without holding the driver lock, which slow hubs would hold up
+type hubSnapshot struct {
+	config *HubConfig // a copy of the hub's ID and IP, for its label and status
+	client sunflower.Client
+}
+
+// hubSnapshot takes a snapshot of a hub. The driver lock must be held
+func (d *YeelightDriver) hubSnapshot(hub *HubConfig) hubSnapshot {
+	return hubSnapshot{
+		config: &HubConfig{ID: hub.ID, IP: hub.IP},
+		client: sunflower.Resolve(d.hubClient(hub.ID)),
+	}
+}
+
+// hubSnapshots takes a snapshot of every hub. The driver lock must be held
+func (d *YeelightDriver) hubSnapshots() []hubSnapshot {
+	hubs := make([]hubSnapshot, 0, len(d.config.Hubs))
+	for _, hub := range d.config.Hubs {
+		hubs = append(hubs, d.hubSnapshot(hub))
+	}
+	return hubs
+}
+
+// allLights gets the lights from every hub that responds, only failing if none of them do
+func allLights(hubs []hubSnapshot) ([]yeelight.Light, error) {
+	var all []yeelight.Light
+	var err error
+	responded := 0
+	for _, hub := range hubs {
+		lights, hubErr := hub.client.GetLights()
+		if hubErr != nil {
+			log.Printf("Unable to get lights from %v - %v", hub.config.Label(), hubErr)
+			err = hubErr
+			continue
+		}
+		responded++
+		all = append(all, lights...)
+	}
+	if responded == 0 && err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// errCancelled is returned by a lockedHub whose work was cancelled while it waited for the driver lock
+var errCancelled = errors.New("Cancelled by a newer command")
+
+// lockedHub is a sunflower.Client for use outside the driver lock, like fades running in the background.
+// It takes the lock around each command to hub (whose addresses come from the config). If cancelled is set,
+// it is checked once the lock is held, and the command isn't sent if it returns true: a newer command that
+// cancelled the work may have held the lock while this one waited, and must not be overwritten
+type lockedHub struct {
+	mu        *sync.Mutex
+	hub       sunflower.Client
+	cancelled func() bool
+}
+
+// lock takes the driver lock, returning errCancelled (without the lock) if the work using the hub has been cancelled
+func (h *lockedHub) lock() error {
+	h.mu.Lock()
+	if h.cancelled != nil && h.cancelled() {
+		h.mu.Unlock()
+		return errCancelled
+	}
+	return nil
+}
+
+func (h *lockedHub) GetLights() ([]yeelight.Light, error) {
+	if err := h.lock(); err != nil {
+		return nil, err
+	}
+	defer h.mu.Unlock()
+	return h.hub.GetLights()
+}
+
+func (h *lockedHub) SetLight(id string, r, g, b, level int) error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.SetLight(id, r, g, b, level)
+}
+
+func (h *lockedHub) SetOnOff(id string, on bool) error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.SetOnOff(id, on)
+}
+
+func (h *lockedHub) SetBrightness(id string, brightness float64) error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.SetBrightness(id, brightness)
+}
+
+func (h *lockedHub) SetColor(id string, r, g, b int) error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.SetColor(id, r, g, b)
+}
+
+func (h *lockedHub) IsOn(id string) (bool, error) {
+	if err := h.lock(); err != nil {
+		return false, err
+	}
+	defer h.mu.Unlock()
+	return h.hub.IsOn(id)
+}
+
+func (h *lockedHub) Heartbeat() error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.Heartbeat()
+}
+
+func (h *lockedHub) TurnOffAllLights() error {
+	if err := h.lock(); err != nil {
+		return err
+	}
+	defer h.mu.Unlock()
+	return h.hub.TurnOffAllLights()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// fakeHub is an in-memory sunflower.Client for tests that don't need the hub protocol, keeping the state
+// of its lights and the commands sent to it
+type fakeHub struct {
+	mu       sync.Mutex
+	lights   []*yeelight.Light
+	commands []string
+	err      error         // returned by every command while set
+	delay    time.Duration // how long each command takes, like a slow or busy hub
+}
+
+func newFakeHub(lights ...yeelight.Light) *fakeHub {
+	h := &fakeHub{}
+	for i := range lights {
+		h.lights = append(h.lights, &lights[i])
+	}
+	return h
+}
+
+// useFakeHubs makes the driver talk to in-memory hubs, keyed by IP address, instead of hubs on the network
+func useFakeHubs(d *YeelightDriver, hubs map[string]*fakeHub) {
+	d.newHub = func(ip func() string) sunflower.Client {
+		return &fakeHubAt{hubs: hubs, ip: ip}
+	}
+}
+
+// fakeHubAt is the client for whichever fake hub is at an address, like go-yeelight reading the IP for every command
+type fakeHubAt struct {
+	hubs map[string]*fakeHub
+	ip   func() string
+}
+
+// Resolve fixes the client to the fake hub at the current address
+func (h *fakeHubAt) Resolve() sunflower.Client {
+	ip := h.ip()
+	return &fakeHubAt{hubs: h.hubs, ip: func() string { return ip }}
+}
+
+func (h *fakeHubAt) hub() (*fakeHub, error) {
+	hub, ok := h.hubs[h.ip()]
+	if !ok {
+		return nil, fmt.Errorf("No hub at %q", h.ip())
+	}
+	return hub, nil
+}
+
+func (h *fakeHubAt) GetLights() ([]yeelight.Light, error) {
+	hub, err := h.hub()
+	if err != nil {
+		return nil, err
+	}
+	return hub.GetLights()
+}
+
+func (h *fakeHubAt) SetLight(id string, r, g, b, level int) error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.SetLight(id, r, g, b, level)
+}
+
+func (h *fakeHubAt) SetOnOff(id string, on bool) error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.SetOnOff(id, on)
+}
+
+func (h *fakeHubAt) SetBrightness(id string, brightness float64) error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.SetBrightness(id, brightness)
+}
+
+func (h *fakeHubAt) SetColor(id string, r, g, b int) error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.SetColor(id, r, g, b)
+}
+
+func (h *fakeHubAt) IsOn(id string) (bool, error) {
+	hub, err := h.hub()
+	if err != nil {
+		return false, err
+	}
+	return hub.IsOn(id)
+}
+
+func (h *fakeHubAt) Heartbeat() error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.Heartbeat()
+}
+
+func (h *fakeHubAt) TurnOffAllLights() error {
+	hub, err := h.hub()
+	if err != nil {
+		return err
+	}
+	return hub.TurnOffAllLights()
+}
+
+// update records a command and, unless the hub is failing, changes the light with the given ID ("" for all of them)
+func (h *fakeHub) update(command, id string, change func(light *yeelight.Light)) error {
+	h.mu.Lock()
+	delay := h.delay
+	h.mu.Unlock()
+	time.Sleep(delay)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, command)
+	if h.err != nil {
+		return h.err
+	}
+	found := false
+	for _, light := range h.lights {
+		if id == "" || light.ID == id {
+			change(light)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("No light %v on the hub", id)
+	}
+	return nil
+}
+
+func (h *fakeHub) GetLights() ([]yeelight.Light, error) {
+	lights := make([]yeelight.Light, 0, len(h.lights))
+	err := h.update("GetLights", "", func(light *yeelight.Light) { lights = append(lights, *light) })
+	if err != nil {
+		return nil, err
+	}
+	return lights, nil
+}
+
+func (h *fakeHub) SetLight(id string, r, g, b, level int) error {
+	return h.update(fmt.Sprintf("SetLight %v %d,%d,%d,%d", id, r, g, b, level), id, func(light *yeelight.Light) {
+		light.R, light.G, light.B, light.Level = r, g, b, level
+	})
+}
+
+func (h *fakeHub) SetOnOff(id string, on bool) error {
+	return h.update(fmt.Sprintf("SetOnOff %v %v", id, on), id, func(light *yeelight.Light) {
+		light.Level = 0
+		if on {
+			light.Level = 100
+		}
+	})
+}
+
+func (h *fakeHub) SetBrightness(id string, brightness float64) error {
+	return h.update(fmt.Sprintf("SetBrightness %v %.2f", id, brightness), id, func(light *yeelight.Light) {
+		light.Level = int(brightness*100 + 0.5)
+	})
+}
+
+func (h *fakeHub) SetColor(id string, r, g, b int) error {
+	return h.update(fmt.Sprintf("SetColor %v %d,%d,%d", id, r, g, b), id, func(light *yeelight.Light) {
+		light.R, light.G, light.B = r, g, b
+	})
+}
+
+func (h *fakeHub) IsOn(id string) (bool, error) {
+	on := false
+	err := h.update("IsOn "+id, id, func(light *yeelight.Light) { on = light.Level > 0 })
+	return on, err
+}
+
+func (h *fakeHub) Heartbeat() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, "Heartbeat")
+	return h.err
+}
+
+func (h *fakeHub) TurnOffAllLights() error {
+	return h.update("TurnOffAllLights", "", func(light *yeelight.Light) { light.Level = 0 })
+}
+
+// light returns the state of a light on the hub
+func (h *fakeHub) light(id string) yeelight.Light {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, light := range h.lights {
+		if light.ID == id {
+			return *light
+		}
+	}
+	return yeelight.Light{}
+}
+
+// sent returns the commands sent to the hub so far
+func (h *fakeHub) sent() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.commands...)
+}
+
+// setErr makes every command fail with err, or work again if err is nil
+func (h *fakeHub) setErr(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+}
+
+// setDelay makes every command take delay before the hub answers
+func (h *fakeHub) setDelay(delay time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.delay = delay
+}
+
+// newFakeHubDriver creates a test driver with two in-memory hubs, "1" with lights A1 and A2 and "2" with B1
+func newFakeHubDriver(t *testing.T) (*YeelightDriver, *fakeHub, *fakeHub) {
+	t.Helper()
+	first := newFakeHub(yeelight.Light{ID: "A1", R: 255, Level: 50}, yeelight.Light{ID: "A2", G: 255})
+	second := newFakeHub(yeelight.Light{ID: "B1", B: 255, Level: 100})
+	d := newTestDriver(t)
+	useFakeHubs(d, map[string]*fakeHub{"10.0.0.1": first, "10.0.0.2": second})
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: "10.0.0.1"}, {ID: "2", IP: "10.0.0.2"}}
+	if err := d.ScanLightsToConfig(); err != nil {
+		t.Fatalf("ScanLightsToConfig: %v", err)
+	}
+	d.CreateDevicesFromConfig()
+	return d, first, second
+}
+
+func TestHubSet(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+
+	// commands for a light go to its own hub
+	if err := d.hub.SetLight("B1", 1, 2, 3, 4); err != nil {
+		t.Fatalf("SetLight: %v", err)
+	}
+	if got := second.light("B1"); got != (yeelight.Light{ID: "B1", R: 1, G: 2, B: 3, Level: 4}) {
+		t.Errorf("B1 = %+v", got)
+	}
+	for _, command := range first.sent() {
+		if command != "GetLights" {
+			t.Errorf("hub 1 was sent %q", command)
+		}
+	}
+	if err := d.hub.SetOnOff("C1", true); err == nil {
+		t.Errorf("SetOnOff for a light on no hub succeeded")
+	}
+
+	// the lights come from every hub that answers
+	lights, err := d.hub.GetLights()
+	if err != nil || len(lights) != 3 {
+		t.Errorf("GetLights = %v, %v", lights, err)
+	}
+	second.setErr(fmt.Errorf("Hub 2 is unplugged"))
+	lights, err = d.hub.GetLights()
+	if err != nil || len(lights) != 2 {
+		t.Errorf("GetLights with hub 2 down = %v, %v, want the lights on hub 1", lights, err)
+	}
+	first.setErr(fmt.Errorf("Hub 1 is unplugged"))
+	if _, err := d.hub.GetLights(); err == nil {
+		t.Errorf("GetLights with every hub down succeeded")
+	}
+
+	// and all off goes to every hub, carrying on past hubs that fail
+	first.setErr(nil)
+	if err := d.hub.TurnOffAllLights(); err == nil {
+		t.Errorf("TurnOffAllLights with hub 2 down succeeded")
+	}
+	if first.light("A1").Level != 0 {
+		t.Errorf("A1 is still on after all off")
+	}
+}
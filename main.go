@@ -2,20 +2,24 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"syscall"
 )
 
 // main creates the Yeelight driver and starts it in the Ninja Sphere way
 func main() {
 
-	NewYeelightDriver()
+	driver, _ := NewYeelightDriver()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
-	// Block until a signal is received.
+	// Block until a signal is received, then shut down cleanly
 	s := <-c
 	fmt.Println("Got signal:", s)
-
+	if err := driver.Stop(); err != nil {
+		log.Printf("Error stopping driver: %v", err)
+	}
 }
@@ -0,0 +1,344 @@
+package main
+
+// Prometheus metrics, served at /metrics by the HTTP API (and on their own address, so they can be scraped
+// without turning on the API's controls), to see how reliable the hubs are
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// latencyBuckets are the upper bounds (in seconds) of the command latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations into buckets, like a Prometheus histogram
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// commandKey identifies the commands sent to a hub with one operation
+type commandKey struct {
+	hub, op string
+}
+
+// hubMetrics records what happens to the commands sent to the hubs
+type hubMetrics struct {
+	mu         sync.Mutex
+	heartbeats map[string]*[2]uint64 // successes and failures, keyed by hub ID
+	latency    map[commandKey]*histogram
+	errors     map[commandKey]uint64
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{
+		heartbeats: make(map[string]*[2]uint64),
+		latency:    make(map[commandKey]*histogram),
+		errors:     make(map[commandKey]uint64),
+	}
+}
+
+// command records how long a command took and whether it failed
+func (m *hubMetrics) command(hubID, op string, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := commandKey{hub: hubID, op: op}
+	h, ok := m.latency[key]
+	if !ok {
+		h = &histogram{}
+		m.latency[key] = h
+	}
+	h.observe(took.Seconds())
+	if err != nil {
+		m.errors[key]++
+	}
+}
+
+// heartbeat records whether a heartbeat to a hub was answered
+func (m *hubMetrics) heartbeat(hubID string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts, ok := m.heartbeats[hubID]
+	if !ok {
+		counts = &[2]uint64{}
+		m.heartbeats[hubID] = counts
+	}
+	if err == nil {
+		counts[0]++
+	} else {
+		counts[1]++
+	}
+}
+
+// meteredHub is a sunflower.Client that records the latency of each command and the result of each heartbeat
+type meteredHub struct {
+	hubID   string
+	client  sunflower.Client
+	metrics *hubMetrics
+}
+
+func (h *meteredHub) GetLights() ([]yeelight.Light, error) {
+	start := time.Now()
+	lights, err := h.client.GetLights()
+	h.metrics.command(h.hubID, "GetLights", time.Since(start), err)
+	return lights, err
+}
+
+func (h *meteredHub) SetLight(id string, r, g, b, level int) error {
+	start := time.Now()
+	err := h.client.SetLight(id, r, g, b, level)
+	h.metrics.command(h.hubID, "SetLight", time.Since(start), err)
+	return err
+}
+
+func (h *meteredHub) SetOnOff(id string, on bool) error {
+	start := time.Now()
+	err := h.client.SetOnOff(id, on)
+	h.metrics.command(h.hubID, "SetOnOff", time.Since(start), err)
+	return err
+}
+
+func (h *meteredHub) SetBrightness(id string, brightness float64) error {
+	start := time.Now()
+	err := h.client.SetBrightness(id, brightness)
+	h.metrics.command(h.hubID, "SetBrightness", time.Since(start), err)
+	return err
+}
+
+func (h *meteredHub) SetColor(id string, r, g, b int) error {
+	start := time.Now()
+	err := h.client.SetColor(id, r, g, b)
+	h.metrics.command(h.hubID, "SetColor", time.Since(start), err)
+	return err
+}
+
+func (h *meteredHub) IsOn(id string) (bool, error) {
+	start := time.Now()
+	on, err := h.client.IsOn(id)
+	h.metrics.command(h.hubID, "IsOn", time.Since(start), err)
+	return on, err
+}
+
+func (h *meteredHub) Heartbeat() error {
+	err := h.client.Heartbeat()
+	h.metrics.heartbeat(h.hubID, err)
+	return err
+}
+
+func (h *meteredHub) TurnOffAllLights() error {
+	start := time.Now()
+	err := h.client.TurnOffAllLights()
+	h.metrics.command(h.hubID, "TurnOffAllLights", time.Since(start), err)
+	return err
+}
+
+// Resolve returns a meteredHub for the client fixed to its current address
+func (h *meteredHub) Resolve() sunflower.Client {
+	return &meteredHub{hubID: h.hubID, metrics: h.metrics, client: sunflower.Resolve(h.client)}
+}
+
+// Close closes the underlying client, if it can be closed
+func (h *meteredHub) Close() error {
+	if closer, ok := h.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// metricsServer serves /metrics on its own address
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// startMetrics serves /metrics on its own address if one is configured. The driver lock must be held
+func (d *YeelightDriver) startMetrics() error {
+	if d.config.MetricsAddress == "" {
+		return nil
+	}
+	// like the API, an address without a host is this machine only
+	listener, err := net.Listen("tcp", apiListenAddress(d.config.MetricsAddress))
+	if err != nil {
+		return fmt.Errorf("Could not serve metrics on %v: %v", d.config.MetricsAddress, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", d.serveMetrics)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics stopped: %v", err)
+		}
+	}()
+	d.metricsHTTP = &metricsServer{server: server, listener: listener}
+	log.Printf("Metrics listening on %v", listener.Addr())
+	return nil
+}
+
+// stopMetrics stops serving metrics on their own address, freeing it straight away. The driver lock must be held.
+// Unlike the API, it doesn't wait for scrapes in progress, which can simply be tried again
+func (d *YeelightDriver) stopMetrics() {
+	if d.metricsHTTP == nil {
+		return
+	}
+	// closing the listener here, rather than leaving it to the server, frees the address before Serve has even started
+	if err := d.metricsHTTP.listener.Close(); err != nil {
+		log.Printf("Error stopping metrics: %v", err)
+	}
+	// which leaves only the connections for the server to close, so its error from closing the listener again is expected
+	d.metricsHTTP.server.Close()
+	d.metricsHTTP = nil
+}
+
+// SetMetricsAddress changes the address metrics are served on, restarting them, or stops them if address is empty
+func (d *YeelightDriver) SetMetricsAddress(address string) error {
+	address = strings.TrimSpace(address)
+	d.config.MetricsAddress = address
+	d.stopMetrics()
+	err := d.startMetrics()
+	if saveErr := d.saveConfig(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// serveMetrics writes the metrics in the Prometheus text format
+func (d *YeelightDriver) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("%v is not allowed here", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	var out strings.Builder
+	d.mu.Lock()
+	d.writeDriverMetrics(&out)
+	d.mu.Unlock()
+	d.metrics.write(&out)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := io.WriteString(w, out.String()); err != nil {
+		log.Printf("Could not send metrics: %v", err)
+	}
+}
+
+// writeDriverMetrics writes the uptime, preset count and the state of each light as last polled.
+// The driver lock must be held
+func (d *YeelightDriver) writeDriverMetrics(out *strings.Builder) {
+	writeHeader(out, "yeelight_driver_uptime_seconds", "gauge", "Seconds since the driver was started.")
+	uptime := 0.0
+	if !d.started.IsZero() {
+		uptime = time.Since(d.started).Seconds()
+	}
+	fmt.Fprintf(out, "yeelight_driver_uptime_seconds %g\n", uptime)
+
+	writeHeader(out, "yeelight_presets", "gauge", "Number of presets.")
+	fmt.Fprintf(out, "yeelight_presets %d\n", len(d.config.PresetNames))
+
+	// the poller's last reading, so scraping doesn't send commands to the hubs
+	var polled map[string]yeelight.Light
+	if d.poller != nil {
+		polled = d.poller.last
+	}
+	type gauge struct {
+		name, help string
+		value      func(light yeelight.Light) int
+	}
+	gauges := []gauge{
+		{"yeelight_light_brightness", "Brightness of each light (0-100) when last polled.", func(light yeelight.Light) int { return light.Level }},
+		{"yeelight_light_on", "Whether each light was on (1) or off (0) when last polled.", func(light yeelight.Light) int {
+			if light.Level > 0 {
+				return 1
+			}
+			return 0
+		}},
+		{"yeelight_light_lqi", "Link quality reported by the hub for each light when last polled.", func(light yeelight.Light) int { return light.LQI }},
+	}
+	for _, g := range gauges {
+		writeHeader(out, g.name, "gauge", g.help)
+		for _, id := range d.config.LightIDs {
+			if light, ok := polled[id]; ok {
+				fmt.Fprintf(out, "%v{id=%v,name=%v} %d\n", g.name, quoteLabel(id), quoteLabel(d.config.Names[id]), g.value(light))
+			}
+		}
+	}
+}
+
+// write writes the hub metrics
+func (m *hubMetrics) write(out *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(out, "yeelight_hub_heartbeats_total", "counter", "Heartbeats sent to each hub, by whether they were answered (after retrying).")
+	var hubs []string
+	for hub := range m.heartbeats {
+		hubs = append(hubs, hub)
+	}
+	sort.Strings(hubs)
+	for _, hub := range hubs {
+		fmt.Fprintf(out, "yeelight_hub_heartbeats_total{hub=%v,result=\"success\"} %d\n", quoteLabel(hub), m.heartbeats[hub][0])
+		fmt.Fprintf(out, "yeelight_hub_heartbeats_total{hub=%v,result=\"failure\"} %d\n", quoteLabel(hub), m.heartbeats[hub][1])
+	}
+
+	var keys []commandKey
+	for key := range m.latency {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hub != keys[j].hub {
+			return keys[i].hub < keys[j].hub
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	writeHeader(out, "yeelight_hub_command_duration_seconds", "histogram", "Time taken by commands sent to each hub, including retries, by operation.")
+	for _, key := range keys {
+		h := m.latency[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(out, "yeelight_hub_command_duration_seconds_bucket{hub=%v,op=%v,le=\"%g\"} %d\n", quoteLabel(key.hub), quoteLabel(key.op), bound, cumulative)
+		}
+		fmt.Fprintf(out, "yeelight_hub_command_duration_seconds_bucket{hub=%v,op=%v,le=\"+Inf\"} %d\n", quoteLabel(key.hub), quoteLabel(key.op), h.count)
+		fmt.Fprintf(out, "yeelight_hub_command_duration_seconds_sum{hub=%v,op=%v} %g\n", quoteLabel(key.hub), quoteLabel(key.op), h.sum)
+		fmt.Fprintf(out, "yeelight_hub_command_duration_seconds_count{hub=%v,op=%v} %d\n", quoteLabel(key.hub), quoteLabel(key.op), h.count)
+	}
+
+	writeHeader(out, "yeelight_hub_command_errors_total", "counter", "Commands sent to each hub that failed after retrying, by operation.")
+	for _, key := range keys {
+		fmt.Fprintf(out, "yeelight_hub_command_errors_total{hub=%v,op=%v} %d\n", quoteLabel(key.hub), quoteLabel(key.op), m.errors[key])
+	}
+}
+
+// labelEscaper escapes label values for the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func writeHeader(out *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the driver's metrics, keyed by each sample's name and labels
+func scrapeMetrics(t *testing.T, d *YeelightDriver) map[string]string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	d.serveMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", recorder.Code)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(recorder.Body.String(), "\n") {
+		if i := strings.LastIndex(line, " "); i > 0 && !strings.HasPrefix(line, "#") {
+			samples[line[:i]] = line[i+1:]
+		}
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	d, first, second := newFakeHubDriver(t)
+
+	// commands are timed by hub and operation, one fast and one slow
+	if err := d.hub.SetLight("B1", 0, 0, 255, 100); err != nil {
+		t.Fatalf("SetLight: %v", err)
+	}
+	second.setDelay(60 * time.Millisecond)
+	if err := d.hub.SetLight("B1", 0, 0, 255, 40); err != nil {
+		t.Fatalf("SetLight: %v", err)
+	}
+	second.setDelay(0)
+	// and failures are counted for the operation that failed
+	first.setErr(fmt.Errorf("Hub 1 is unplugged"))
+	if err := d.hub.SetColor("A1", 0, 255, 0); err == nil {
+		t.Fatalf("SetColor succeeded on an unplugged hub")
+	}
+	d.hubs["1"].Heartbeat()
+	first.setErr(nil)
+	d.hubs["2"].Heartbeat()
+	d.hubs["2"].Heartbeat()
+	// lights are as the poller last saw them
+	d.poller = newStatePoller(d.ctx, d, time.Hour)
+	d.poller.poll()
+
+	samples := scrapeMetrics(t, d)
+	want := map[string]string{
+		`yeelight_hub_command_duration_seconds_bucket{hub="2",op="SetLight",le="0.05"}`: "1",
+		`yeelight_hub_command_duration_seconds_bucket{hub="2",op="SetLight",le="10"}`:   "2",
+		`yeelight_hub_command_duration_seconds_bucket{hub="2",op="SetLight",le="+Inf"}`: "2",
+		`yeelight_hub_command_duration_seconds_count{hub="2",op="SetLight"}`:            "2",
+		`yeelight_hub_command_errors_total{hub="2",op="SetLight"}`:                      "0",
+		`yeelight_hub_command_duration_seconds_count{hub="1",op="SetColor"}`:            "1",
+		`yeelight_hub_command_errors_total{hub="1",op="SetColor"}`:                      "1",
+		`yeelight_hub_heartbeats_total{hub="1",result="success"}`:                       "0",
+		`yeelight_hub_heartbeats_total{hub="1",result="failure"}`:                       "1",
+		`yeelight_hub_heartbeats_total{hub="2",result="success"}`:                       "2",
+		`yeelight_hub_heartbeats_total{hub="2",result="failure"}`:                       "0",
+		`yeelight_light_brightness{id="A1",name="YeeA1"}`:                               "50",
+		`yeelight_light_brightness{id="B1",name="YeeB1"}`:                               "40",
+		`yeelight_light_on{id="A1",name="YeeA1"}`:                                       "1",
+		`yeelight_light_on{id="A2",name="YeeA2"}`:                                       "0",
+		`yeelight_light_lqi{id="A2",name="YeeA2"}`:                                      "0",
+		`yeelight_presets`: "0",
+	}
+	for sample, value := range want {
+		if got, ok := samples[sample]; !ok || got != value {
+			t.Errorf("%v = %q, want %v", sample, got, value)
+		}
+	}
+	if _, ok := samples[`yeelight_hub_command_duration_seconds_count{hub="1",op="SetLight"}`]; ok {
+		t.Errorf("hub 1 has SetLight timings when it was never sent one")
+	}
+}
+
+func TestMetricsAddress(t *testing.T) {
+	d, _, _ := newFakeHubDriver(t)
+	// a free port, so the address is known before serving on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// metrics are served without the API, and again straight away after restarting on the same address
+	d.mu.Lock()
+	err = d.SetMetricsAddress(address)
+	if err == nil {
+		err = d.SetMetricsAddress(" " + address)
+	}
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("SetMetricsAddress: %v", err)
+	}
+	if d.config.HTTPAddress != "" || d.config.MetricsAddress != address {
+		t.Errorf("addresses are API %q, metrics %q", d.config.HTTPAddress, d.config.MetricsAddress)
+	}
+	response, err := http.Get("http://" + address + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), "yeelight_presets 0") {
+		t.Errorf("GET /metrics = %d, %s", response.StatusCode, body)
+	}
+	// but not the API's controls
+	response, err = http.Get("http://" + address + "/api/lights")
+	if err != nil {
+		t.Fatalf("GET /api/lights: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /api/lights on the metrics address = %d, want %d", response.StatusCode, http.StatusNotFound)
+	}
+
+	d.mu.Lock()
+	err = d.SetMetricsAddress("")
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("SetMetricsAddress: %v", err)
+	}
+	if response, err := http.Get("http://" + address + "/metrics"); err == nil {
+		response.Body.Close()
+		t.Errorf("GET /metrics after turning them off = %d, want the connection refused", response.StatusCode)
+	}
+}
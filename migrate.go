@@ -0,0 +1,90 @@
+package main
+
+// Upgrading configs saved by older versions of the driver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+// configMigrations upgrade a config from one schema version to the next: configMigrations[0] upgrades
+// version 0 (configs saved before versioning) to version 1, and so on. Add new migrations to the end
+var configMigrations = []func(config *YeelightDriverConfig){
+	migrateHubs,
+	migratePresets,
+}
+
+// configVersion is the schema version of configs this driver saves
+var configVersion = len(configMigrations)
+
+// migrateConfig upgrades a config to the current schema version, returning whether it changed.
+// Configs saved by a newer driver are an error, as saving them would lose what this driver doesn't know about
+func migrateConfig(config *YeelightDriverConfig) (bool, error) {
+	if config.Version > configVersion {
+		return false, fmt.Errorf("Config version %d is newer than this driver supports (%d)", config.Version, configVersion)
+	}
+	if config.Version == configVersion {
+		return false, nil
+	}
+	for version := config.Version; version < configVersion; version++ {
+		log.Printf("Upgrading config from version %d to %d", version, version+1)
+		configMigrations[version](config)
+	}
+	config.Version = configVersion
+	return true, nil
+}
+
+// migrateHubs moves the lights of configs from before multiple hubs were supported, which have one IP for all lights,
+// to hub "1" (version 0 to 1)
+func migrateHubs(config *YeelightDriverConfig) {
+	if len(config.Hubs) == 0 && config.IP != "" {
+		log.Printf("Moving lights to hub at %v\n", config.IP)
+		config.Hubs = []*HubConfig{&HubConfig{ID: "1", IP: config.IP, LightIDs: append([]string{}, config.LightIDs...)}}
+		config.IP = ""
+	}
+}
+
+// migratePresets tidies presets from before the compact sunflower.PresetLight (version 1 to 2).
+// Their LQI and Effect values are dropped when loading, but some have blank entries that are dropped here.
+// It also creates maps added to the config since, so older configs can be used without checking for nil
+func migratePresets(config *YeelightDriverConfig) {
+	for name, preset := range config.Presets {
+		if preset == nil {
+			delete(config.Presets, name)
+			continue
+		}
+		lights := preset.Lights[:0]
+		for _, light := range preset.Lights {
+			if light.ID != "" {
+				lights = append(lights, light)
+			}
+		}
+		preset.Lights = lights
+	}
+	// names listed without a preset can't be activated, and would break the presets screen
+	names := config.PresetNames[:0]
+	for _, name := range config.PresetNames {
+		if _, ok := config.Presets[name]; ok {
+			names = append(names, name)
+		}
+	}
+	config.PresetNames = names
+
+	if config.Names == nil {
+		config.Names = make(map[string]string)
+	}
+	if config.ThingNames == nil {
+		config.ThingNames = make(map[string]string)
+	}
+	if config.Presets == nil {
+		config.Presets = make(map[string]*sunflower.Preset)
+	}
+	if config.Groups == nil {
+		config.Groups = make(map[string]*Group)
+	}
+	if config.Calibrations == nil {
+		config.Calibrations = make(map[string][]TemperaturePoint)
+	}
+}
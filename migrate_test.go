@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+// loadConfig reads a config saved by a driver, from testdata
+func loadConfig(t *testing.T, name string) *YeelightDriverConfig {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Could not read %v: %v", name, err)
+	}
+	config := &YeelightDriverConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		t.Fatalf("Could not load %v: %v", name, err)
+	}
+	return config
+}
+
+func TestMigrateConfig(t *testing.T) {
+	evening := []sunflower.PresetLight{{ID: "4F1A", R: 255, G: 136, Level: 40}, {ID: "238B", B: 255, Level: 80}}
+	tests := []struct {
+		file        string
+		hubs        []*HubConfig
+		presetNames []string
+		presets     map[string]*sunflower.Preset
+	}{
+		// one IP for all lights, and presets with the blank entries of old drivers
+		{"config-v0.json",
+			[]*HubConfig{{ID: "1", IP: "192.168.1.20", LightIDs: []string{"4F1A", "238B"}}},
+			[]string{"Evening", "Hall Only"},
+			map[string]*sunflower.Preset{
+				"Evening":   {Lights: evening},
+				"Hall Only": {Lights: []sunflower.PresetLight{{ID: "238B", R: 255, G: 255, B: 255, Level: 100}}},
+			}},
+		// saved with hubs, but before versioning
+		{"config-v0-hubs.json",
+			[]*HubConfig{
+				{ID: "1", IP: "192.168.1.20", LightIDs: []string{"4F1A"}},
+				{ID: "2", IP: "192.168.1.21", LightIDs: []string{"238B"}},
+			},
+			[]string{"Evening"},
+			map[string]*sunflower.Preset{"Evening": {Lights: evening}}},
+		// presets that were deleted or lost are dropped, along with their names
+		{"config-v1.json",
+			[]*HubConfig{{ID: "1", IP: "192.168.1.20", LightIDs: []string{"4F1A", "238B"}, Missing: []string{"238B"}}},
+			[]string{"Evening"},
+			map[string]*sunflower.Preset{"Evening": {Lights: evening[:1]}}},
+	}
+	for _, test := range tests {
+		config := loadConfig(t, test.file)
+		changed, err := migrateConfig(config)
+		if err != nil || !changed {
+			t.Errorf("%v: migrateConfig = %v, %v, want it changed", test.file, changed, err)
+			continue
+		}
+		if config.Version != configVersion {
+			t.Errorf("%v: migrated to version %d, want %d", test.file, config.Version, configVersion)
+		}
+		if config.IP != "" || !reflect.DeepEqual(config.Hubs, test.hubs) {
+			t.Errorf("%v: IP %q and hubs %+v, want hubs %+v", test.file, config.IP, config.Hubs, test.hubs)
+		}
+		if !reflect.DeepEqual(config.PresetNames, test.presetNames) || !reflect.DeepEqual(config.Presets, test.presets) {
+			t.Errorf("%v: presets %v %+v, want %v %+v", test.file, config.PresetNames, config.Presets, test.presetNames, test.presets)
+		}
+		if config.Names["4F1A"] != "Lounge" || config.Groups == nil || config.Calibrations == nil || config.ThingNames == nil {
+			t.Errorf("%v: names %v and maps not kept or created", test.file, config.Names)
+		}
+
+		// and a migrated config is left alone
+		if changed, err := migrateConfig(config); err != nil || changed {
+			t.Errorf("%v: migrating again = %v, %v", test.file, changed, err)
+		}
+	}
+
+	// a config from a newer driver is refused, without touching it
+	config := loadConfig(t, "config-too-new.json")
+	if _, err := migrateConfig(config); err == nil {
+		t.Errorf("config-too-new.json: migrateConfig succeeded")
+	}
+	if !reflect.DeepEqual(config, loadConfig(t, "config-too-new.json")) {
+		t.Errorf("config-too-new.json: changed to %+v", config)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+// Background health checks of the Yeelight hubs, with rediscovery when a hub's address changes
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+const (
+	heartbeatInterval    = 30 * time.Second // time between heartbeats to each hub
+	failuresToRediscover = 3                // consecutive failed heartbeats before searching for the hub again
+)
+
+// HubStatus is the health of a hub as last seen by the monitor
+type HubStatus struct {
+	Online   bool
+	Since    time.Time // when the hub last went online or offline
+	Failures int       // consecutive failed heartbeats
+}
+
+// hubMonitor sends heartbeats to every hub on an interval, keeping track of which are online.
+// When a hub stops responding it searches for it with SSDP in case it has a new IP address
+type hubMonitor struct {
+	driver   *YeelightDriver
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu     sync.Mutex
+	status map[string]*HubStatus // keyed by hub ID
+}
+
+// newHubMonitor creates a monitor for the driver's hubs, which stops when ctx is cancelled. Call run to start it
+func newHubMonitor(ctx context.Context, d *YeelightDriver, interval time.Duration) *hubMonitor {
+	ctx, cancel := context.WithCancel(ctx)
+	return &hubMonitor{
+		driver:   d,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		status:   make(map[string]*HubStatus),
+	}
+}
+
+// run checks the hubs every interval until stop is called or its context is cancelled
+func (m *hubMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	m.checkHubs()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkHubs()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends the monitor's goroutine
+func (m *hubMonitor) stop() {
+	m.cancel()
+}
+
+// checkHubs sends a heartbeat to each hub, rediscovering any that have failed too many times in a row.
+// The heartbeats are sent without the driver lock, so a hub that doesn't answer doesn't hold up commands
+func (m *hubMonitor) checkHubs() {
+	m.driver.mu.Lock()
+	hubs := m.driver.hubSnapshots()
+	m.driver.mu.Unlock()
+	rediscover := false
+	for _, hub := range hubs {
+		if m.record(hub.config, hub.client.Heartbeat()) >= failuresToRediscover {
+			rediscover = true
+		}
+	}
+	if rediscover && m.ctx.Err() == nil {
+		m.rediscover()
+	}
+}
+
+// record updates the status of a hub from a heartbeat result, logging changes, and returns the number of consecutive failures
+func (m *hubMonitor) record(hub *HubConfig, err error) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status, ok := m.status[hub.ID]
+	if !ok {
+		// assume online until we hear otherwise, so the first result is logged as a change only if it fails
+		status = &HubStatus{Online: true, Since: time.Now()}
+		m.status[hub.ID] = status
+	}
+	if err != nil {
+		status.Failures++
+		if status.Online {
+			log.Printf("%v has gone offline: %v", hub.Label(), err)
+			status.Online = false
+			status.Since = time.Now()
+		}
+	} else {
+		if !status.Online {
+			log.Printf("%v is back online after %d failed heartbeats", hub.Label(), status.Failures)
+			status.Online = true
+			status.Since = time.Now()
+		}
+		status.Failures = 0
+	}
+	return status.Failures
+}
+
+// rediscover searches for a hub with SSDP. If it's one of ours at a new address, the address is updated and saved.
+// The driver lock is only taken to look up and update the config, not while searching or asking the hub for its lights
+func (m *hubMonitor) rediscover() {
+	d := m.driver
+	found, err := d.discover()
+	if err != nil {
+		log.Printf("Rediscovery failed: %v", err)
+		return
+	}
+	// knownHub and hubWithLights update the IP of a known hub that has moved
+	d.mu.Lock()
+	before := make(map[string]string)
+	for _, hub := range d.config.Hubs {
+		before[hub.ID] = hub.IP
+	}
+	hub := d.knownHub(found.IP, found.USN)
+	client := sunflower.Resolve(d.hubAt(found.IP))
+	d.mu.Unlock()
+	if hub == nil {
+		lights, err := client.GetLights()
+		if err != nil {
+			log.Printf("Unable to get lights from rediscovered hub at %v: %v", found.IP, err)
+			return
+		}
+		d.mu.Lock()
+		hub = d.hubWithLights(found.IP, found.USN, lights)
+		d.mu.Unlock()
+	}
+	if hub == nil {
+		log.Printf("Rediscovered a new hub at %v, use Scan for New Lights to add it", found.IP)
+		return
+	}
+
+	d.mu.Lock()
+	if m.ctx.Err() != nil {
+		// the driver stopped while searching
+		d.mu.Unlock()
+		return
+	}
+	if before[hub.ID] == hub.IP {
+		log.Printf("Rediscovered %v at the same address", hub.Label())
+		d.mu.Unlock()
+		return
+	}
+	log.Printf("Rediscovered %v (was %v), saving new address", hub.Label(), before[hub.ID])
+	if err := d.saveConfig(); err != nil {
+		log.Printf("Unable to save config: %v", err)
+	}
+	moved := d.hubSnapshot(hub)
+	d.mu.Unlock()
+	m.record(moved.config, moved.client.Heartbeat())
+}
+
+// Status returns the last known status of a hub. Hubs that haven't been checked yet are reported as online
+func (m *hubMonitor) Status(hubID string) HubStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if status, ok := m.status[hubID]; ok {
+		return *status
+	}
+	return HubStatus{Online: true}
+}
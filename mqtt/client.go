@@ -0,0 +1,377 @@
+// Package mqtt is a small MQTT 3.1.1 client, enough for the driver to bridge its lights to a broker:
+// publishing (optionally retained) and subscribing with QoS 0, a last will, and keep-alive pings.
+//
+// Handlers run on the client's read goroutine, one message at a time, so a slow handler holds up later messages
+// (but not pings, which are sent from their own goroutine).
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout      = 10 * time.Second
+	defaultKeepAlive = 30 * time.Second
+)
+
+// Packet types (the top four bits of the first byte)
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetPingreq    = 12
+	packetDisconnect = 14
+)
+
+// ErrClosed is returned by a client that has been closed
+var ErrClosed = errors.New("MQTT connection closed")
+
+// Options are the settings for connecting to a broker
+type Options struct {
+	ClientID  string
+	Username  string // left out if empty
+	Password  string
+	KeepAlive time.Duration // how often to ping the broker, 30 seconds if zero
+	// a message the broker publishes if the connection is lost without Close, like "offline" on a status topic
+	WillTopic   string
+	WillPayload []byte
+	WillRetain  bool
+}
+
+// Handler is called with each message that arrives on a subscribed topic
+type Handler func(topic string, payload []byte)
+
+type subscription struct {
+	filter  string
+	handler Handler
+}
+
+// Client is a connection to an MQTT broker
+type Client struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	keepAlive time.Duration
+
+	writeMu sync.Mutex // one packet written at a time
+
+	mu     sync.Mutex
+	subs   []subscription
+	nextID uint16
+	err    error // why the connection ended
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the broker at addr (host:port) and waits for it to accept the connection
+func Dial(addr string, options Options) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, reader: bufio.NewReader(conn), keepAlive: options.KeepAlive, done: make(chan struct{})}
+	if c.keepAlive <= 0 {
+		c.keepAlive = defaultKeepAlive
+	}
+	if err := c.connect(options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+// connect sends CONNECT and reads the broker's CONNACK
+func (c *Client) connect(options Options) error {
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	flags := byte(0x02)    // clean session
+	if options.WillTopic != "" {
+		flags |= 0x04
+		if options.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if options.Username != "" {
+		flags |= 0x80
+		if options.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, flags)
+	body = appendUint16(body, uint16(c.keepAlive/time.Second))
+	body = appendString(body, options.ClientID)
+	if options.WillTopic != "" {
+		body = appendString(body, options.WillTopic)
+		body = appendBytes(body, options.WillPayload)
+	}
+	if options.Username != "" {
+		body = appendString(body, options.Username)
+		if options.Password != "" {
+			body = appendString(body, options.Password)
+		}
+	}
+	if err := c.write(packetConnect<<4, body); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	header, ack, err := readPacket(c.reader)
+	if err != nil {
+		return fmt.Errorf("No reply from MQTT broker: %v", err)
+	}
+	if header>>4 != packetConnack || len(ack) != 2 {
+		return fmt.Errorf("Unexpected reply from MQTT broker")
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("MQTT broker refused the connection: %v", connackError(ack[1]))
+	}
+	return nil
+}
+
+func connackError(code byte) string {
+	switch code {
+	case 1:
+		return "unsupported protocol version"
+	case 2:
+		return "client ID rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorised"
+	}
+	return fmt.Sprintf("code %d", code)
+}
+
+// Publish sends a message with QoS 0. Retained messages are kept by the broker for later subscribers
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	header := byte(packetPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return c.write(header, body)
+}
+
+// Subscribe asks for messages on topics matching filter (which can use the + and # wildcards) to be passed to handler
+func (c *Client) Subscribe(filter string, handler Handler) error {
+	c.mu.Lock()
+	c.subs = append(c.subs, subscription{filter: filter, handler: handler})
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.mu.Unlock()
+
+	body := appendUint16(nil, id)
+	body = appendString(body, filter)
+	body = append(body, 0) // QoS 0
+	return c.write(packetSubscribe<<4|0x02, body)
+}
+
+// Close disconnects from the broker cleanly, so it doesn't publish the will
+func (c *Client) Close() error {
+	err := c.write(packetDisconnect<<4, nil)
+	c.shutdown(ErrClosed)
+	return err
+}
+
+// Done is closed when the connection ends, after which Err says why
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, or nil while it's open
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// shutdown closes the connection (once), recording why
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// write sends one packet
+func (c *Client) write(header byte, body []byte) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	packet := append([]byte{header}, encodeLength(len(body))...)
+	packet = append(packet, body...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+	if _, err := c.conn.Write(packet); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads packets until the connection ends, passing published messages to their handlers
+func (c *Client) readLoop() {
+	for {
+		// the broker answers our pings, so something arrives at least every keep-alive interval
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.keepAlive))
+		header, body, err := readPacket(c.reader)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		if header>>4 == packetPublish {
+			c.received(header, body)
+		}
+	}
+}
+
+// received handles a PUBLISH packet from the broker
+func (c *Client) received(header byte, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+length {
+		return
+	}
+	topic := string(body[2 : 2+length])
+	payload := body[2+length:]
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		// QoS 1 and 2 messages have a packet ID, which QoS 1 messages are acknowledged with
+		if len(payload) < 2 {
+			return
+		}
+		id := payload[:2]
+		payload = payload[2:]
+		if qos == 1 {
+			c.write(packetPuback<<4, id)
+		}
+	}
+
+	c.mu.Lock()
+	var handlers []Handler
+	for _, sub := range c.subs {
+		if Match(sub.filter, topic) {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	c.mu.Unlock()
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
+
+// pingLoop keeps the connection alive until it ends
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.write(packetPingreq<<4, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Match returns true if topic matches filter, where + matches one level and # (at the end) matches any number of levels
+func Match(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// readPacket reads one packet, returning its first byte and the rest after the length
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, fmt.Errorf("Bad MQTT packet length")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// encodeLength encodes a packet's remaining length, 7 bits to a byte
+func encodeLength(length int) []byte {
+	var encoded []byte
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	return append(appendUint16(b, uint16(len(data))), data...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/mqtt/mqtttest"
+)
+
+func TestEncodeLength(t *testing.T) {
+	// examples from the MQTT 3.1.1 spec, section 2.2.3
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, test := range tests {
+		if got := encodeLength(test.length); !bytes.Equal(got, test.want) {
+			t.Errorf("encodeLength(%d) = % x, want % x", test.length, got, test.want)
+		}
+	}
+}
+
+func TestReadPacket(t *testing.T) {
+	// each length is read back, including ones that need more than one byte
+	for _, length := range []int{0, 5, 127, 128, 300, 16384} {
+		body := bytes.Repeat([]byte{0xab}, length)
+		packet := append([]byte{packetPublish<<4 | 0x01}, encodeLength(length)...)
+		packet = append(packet, body...)
+		header, got, err := readPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || header != packetPublish<<4|0x01 || !bytes.Equal(got, body) {
+			t.Errorf("reading a packet of %d bytes = %x, %d bytes, %v", length, header, len(got), err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   string
+	}{
+		{"empty", nil, io.EOF.Error()},
+		{"no length", []byte{0x30}, io.EOF.Error()},
+		{"length too long", []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}, "Bad MQTT packet length"},
+		{"short body", []byte{0x30, 0x05, 0x00, 0x01}, io.ErrUnexpectedEOF.Error()},
+	}
+	for _, test := range tests {
+		if _, _, err := readPacket(bufio.NewReader(bytes.NewReader(test.packet))); err == nil || err.Error() != test.want {
+			t.Errorf("%v: readPacket error = %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestAppendString(t *testing.T) {
+	if got := appendString([]byte{0x01}, "MQTT"); !bytes.Equal(got, []byte{0x01, 0x00, 0x04, 'M', 'Q', 'T', 'T'}) {
+		t.Errorf("appendString = % x", got)
+	}
+	long := strings.Repeat("x", 300)
+	if got := appendString(nil, long); got[0] != 0x01 || got[1] != 0x2c || len(got) != 302 {
+		t.Errorf("appendString of 300 bytes starts % x, %d bytes", got[:2], len(got))
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"yeelight/status", "yeelight/status", true},
+		{"yeelight/status", "yeelight/statuses", false},
+		{"yeelight/+/set", "yeelight/4F1A/set", true},
+		{"yeelight/+/set", "yeelight/preset/evening/set", false},
+		{"yeelight/+/set", "yeelight/4F1A", false},
+		{"yeelight/preset/+/set", "yeelight/preset/evening/set", true},
+		{"yeelight/#", "yeelight/4F1A/state", true},
+		{"yeelight/#", "yeelight", true}, // # includes the parent level
+		{"#", "anything/at/all", true},
+		{"+", "yeelight", true},
+		{"+", "yeelight/status", false},
+	}
+	for _, test := range tests {
+		if got := Match(test.filter, test.topic); got != test.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+// newBroker starts a broker stand-in for a test
+func newBroker(t *testing.T) *mqtttest.Broker {
+	t.Helper()
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Could not start broker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func TestDial(t *testing.T) {
+	broker := newBroker(t)
+	options := Options{
+		ClientID:    "driver-yeelight-test",
+		Username:    "sphere",
+		Password:    "secret",
+		WillTopic:   "yeelight/status",
+		WillPayload: []byte("offline"),
+		WillRetain:  true,
+	}
+	client, err := Dial(broker.Addr(), options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	want := []mqtttest.Connect{{
+		ClientID:     "driver-yeelight-test",
+		Username:     "sphere",
+		Password:     "secret",
+		KeepAlive:    defaultKeepAlive,
+		CleanSession: true,
+		Will:         &mqtttest.Message{Topic: "yeelight/status", Payload: []byte("offline"), Retain: true},
+	}}
+	if got := broker.Connects(); !reflect.DeepEqual(got, want) {
+		t.Errorf("broker got CONNECT %+v, want %+v", got, want)
+	}
+
+	// without a username the password isn't sent either, and there's no will
+	other, err := Dial(broker.Addr(), Options{ClientID: "other", Password: "ignored", KeepAlive: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Dial without a username: %v", err)
+	}
+	defer other.Close()
+	if got := broker.Connects()[1]; got != (mqtttest.Connect{ClientID: "other", KeepAlive: 5 * time.Second, CleanSession: true}) {
+		t.Errorf("broker got CONNECT %+v without a username", got)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	broker := newBroker(t)
+	broker.Refuse(4)
+	if _, err := Dial(broker.Addr(), Options{ClientID: "driver-yeelight-test", Username: "sphere", Password: "wrong"}); err == nil || !strings.Contains(err.Error(), "bad username or password") {
+		t.Errorf("Dial = %v, want the connection refused for a bad password", err)
+	}
+}
+
+func TestPublishAndSubscribe(t *testing.T) {
+	broker := newBroker(t)
+	client, err := Dial(broker.Addr(), Options{ClientID: "driver-yeelight-test"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// retained and not
+	if err := client.Publish("yeelight/4F1A/state", []byte(`{"state":"ON"}`), true); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := client.Publish("yeelight/event", bytes.Repeat([]byte("x"), 200), false); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	want := []mqtttest.Message{
+		{Topic: "yeelight/4F1A/state", Payload: []byte(`{"state":"ON"}`), Retain: true},
+		{Topic: "yeelight/event", Payload: bytes.Repeat([]byte("x"), 200)},
+	}
+	if !broker.WaitFor(time.Second, func() bool { return len(broker.Published()) == 2 }) || !reflect.DeepEqual(broker.Published(), want) {
+		t.Errorf("broker got %+v, want %+v", broker.Published(), want)
+	}
+
+	// messages on subscribed topics reach the handler, at QoS 0 and 1
+	received := make(chan string, 10)
+	if err := client.Subscribe("yeelight/+/set", func(topic string, payload []byte) {
+		received <- topic + " " + string(payload)
+	}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if !broker.WaitFor(time.Second, func() bool { return broker.Subscribed("yeelight/4F1A/set") }) {
+		t.Fatalf("broker didn't get the subscription")
+	}
+	broker.Publish("yeelight/4F1A/set", []byte(`{"state":"OFF"}`), 0)
+	broker.Publish("yeelight/status", []byte("online"), 0)
+	broker.Publish("yeelight/238B/set", []byte(`{"state":"ON"}`), 1)
+	for _, want := range []string{`yeelight/4F1A/set {"state":"OFF"}`, `yeelight/238B/set {"state":"ON"}`} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("handler got %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handler didn't get %v", want)
+		}
+	}
+	if !broker.WaitFor(time.Second, func() bool { return broker.Acks() == 1 }) {
+		t.Errorf("QoS 1 message acknowledged %d times, want once", broker.Acks())
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	broker := newBroker(t)
+	client, err := Dial(broker.Addr(), Options{ClientID: "driver-yeelight-test", KeepAlive: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if !broker.WaitFor(time.Second, func() bool { return broker.Pings() >= 3 }) {
+		t.Errorf("client pinged %d times, want a ping every keep-alive interval", broker.Pings())
+	}
+	if client.Err() != nil {
+		t.Errorf("connection ended: %v", client.Err())
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	broker := newBroker(t)
+	options := Options{ClientID: "driver-yeelight-test", WillTopic: "yeelight/status", WillPayload: []byte("offline"), WillRetain: true}
+	client, err := Dial(broker.Addr(), options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// dropping the connection ends the client, and the broker publishes the will
+	broker.Drop()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("client didn't notice the connection was lost")
+	}
+	if client.Err() == nil || client.Err() == ErrClosed {
+		t.Errorf("Err = %v after losing the connection", client.Err())
+	}
+	if err := client.Publish("yeelight/status", []byte("online"), true); err == nil {
+		t.Errorf("Publish succeeded after losing the connection")
+	}
+	if !broker.WaitFor(time.Second, func() bool { payload, _ := broker.Retained("yeelight/status"); return string(payload) == "offline" }) {
+		t.Errorf("will wasn't published")
+	}
+
+	// but closing disconnects cleanly, without the will
+	client, err = Dial(broker.Addr(), options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client.Publish("yeelight/status", []byte("online"), true)
+	if err := client.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if client.Err() != ErrClosed {
+		t.Errorf("Err = %v after Close, want %v", client.Err(), ErrClosed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if payload, _ := broker.Retained("yeelight/status"); string(payload) != "online" {
+		t.Errorf("status = %q after closing, want the will not sent", payload)
+	}
+}
@@ -0,0 +1,492 @@
+// Package mqtttest is an in-process stand-in for an MQTT broker, for testing the mqtt client and the bridge
+// without a real broker.
+//
+// It speaks enough MQTT 3.1.1 for them, decoding packets itself so it checks the client's encoding:
+// CONNECT (with a will and credentials), SUBSCRIBE, PUBLISH at QoS 0 (and sending at QoS 1),
+// retained messages, PINGREQ and DISCONNECT. Wills are published when a connection ends without DISCONNECT,
+// including when the broker drops it.
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Packet types (the top four bits of the first byte)
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// Message is a message published to the broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Connect is what a client sent to connect
+type Connect struct {
+	ClientID     string
+	Username     string
+	Password     string
+	KeepAlive    time.Duration
+	CleanSession bool
+	Will         *Message // nil if the client didn't set one
+}
+
+// Broker is a broker listening on a loopback port
+type Broker struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	conns     map[*conn]bool
+	connects  []Connect
+	published []Message
+	retained  map[string][]byte
+	pings     int
+	acks      int
+	refuse    byte // CONNACK return code to refuse connections with, 0 to accept them
+}
+
+// conn is a client's connection
+type conn struct {
+	net.Conn
+	writeMu      sync.Mutex
+	filters      []string
+	will         *Message
+	disconnected bool // sent DISCONNECT, so the will isn't published
+}
+
+// NewBroker starts a broker on a free loopback port
+func NewBroker() (*Broker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{listener: listener, conns: make(map[*conn]bool), retained: make(map[string][]byte)}
+	b.wg.Add(1)
+	go b.serve()
+	return b, nil
+}
+
+// Addr returns the host:port the broker is listening on
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Close stops the broker, dropping its connections, and waits for them to finish
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+	b.Drop()
+	b.wg.Wait()
+	return err
+}
+
+// Drop closes every client connection without warning, as if the network went down
+func (b *Broker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		c.Close()
+	}
+}
+
+// Refuse makes the broker refuse connections with a CONNACK return code (like 4, bad username or password),
+// or accept them again if code is 0
+func (b *Broker) Refuse(code byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = code
+}
+
+// Connects returns what each client sent to connect, in order
+func (b *Broker) Connects() []Connect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Connect(nil), b.connects...)
+}
+
+// Published returns the messages published to the broker by clients (and their wills), in order
+func (b *Broker) Published() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.published...)
+}
+
+// Retained returns the retained message on a topic, if there is one
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+// Pings returns how many PINGREQs clients have sent
+func (b *Broker) Pings() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pings
+}
+
+// Acks returns how many PUBACKs clients have sent for QoS 1 messages
+func (b *Broker) Acks() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acks
+}
+
+// Subscribed returns true if a connected client is subscribed to a filter matching topic
+func (b *Broker) Subscribed(topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		if c.subscribed(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends a message to the clients subscribed to its topic, with QoS 0 or 1, returning how many it was sent to
+func (b *Broker) Publish(topic string, payload []byte, qos byte) int {
+	b.mu.Lock()
+	var to []*conn
+	for c := range b.conns {
+		if c.subscribed(topic) {
+			to = append(to, c)
+		}
+	}
+	b.mu.Unlock()
+	for _, c := range to {
+		c.publish(&Message{Topic: topic, Payload: payload}, qos)
+	}
+	return len(to)
+}
+
+// WaitFor checks done every few milliseconds until it returns true, returning false if it doesn't within timeout
+func (b *Broker) WaitFor(timeout time.Duration, done func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		netConn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: netConn}
+		b.mu.Lock()
+		b.conns[c] = true
+		b.mu.Unlock()
+		b.wg.Add(1)
+		go b.handle(c)
+	}
+}
+
+// handle reads packets from a client until its connection ends, then publishes its will if it didn't disconnect
+func (b *Broker) handle(c *conn) {
+	defer b.wg.Done()
+	defer func() {
+		c.Close()
+		b.mu.Lock()
+		delete(b.conns, c)
+		b.mu.Unlock()
+		if c.will != nil && !c.disconnected {
+			b.received(c.will)
+		}
+	}()
+
+	reader := bufio.NewReader(c)
+	header, body, err := readPacket(reader)
+	if err != nil || header>>4 != packetConnect {
+		return
+	}
+	connect, err := parseConnect(body)
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.connects = append(b.connects, *connect)
+	refuse := b.refuse
+	b.mu.Unlock()
+	c.write(packetConnack<<4, []byte{0, refuse})
+	if refuse != 0 {
+		return
+	}
+	c.will = connect.Will
+
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case packetPublish:
+			message, err := parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			b.received(message)
+		case packetSubscribe:
+			if header&0x0f != 0x02 || len(body) < 2 {
+				return
+			}
+			filters, err := parseSubscribe(body[2:])
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			c.filters = append(c.filters, filters...)
+			var retained []*Message
+			for topic, payload := range b.retained {
+				for _, filter := range filters {
+					if match(filter, topic) {
+						retained = append(retained, &Message{Topic: topic, Payload: payload, Retain: true})
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			c.write(packetSuback<<4, append(body[:2:2], make([]byte, len(filters))...))
+			for _, message := range retained {
+				c.publish(message, 0)
+			}
+		case packetPuback:
+			b.mu.Lock()
+			b.acks++
+			b.mu.Unlock()
+		case packetPingreq:
+			b.mu.Lock()
+			b.pings++
+			b.mu.Unlock()
+			c.write(packetPingresp<<4, nil)
+		case packetDisconnect:
+			c.disconnected = true
+			return
+		default:
+			return
+		}
+	}
+}
+
+// received records a message published by a client, keeps it if it's retained, and sends it to subscribers
+func (b *Broker) received(message *Message) {
+	b.mu.Lock()
+	b.published = append(b.published, *message)
+	if message.Retain {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message.Payload
+		}
+	}
+	b.mu.Unlock()
+	b.Publish(message.Topic, message.Payload, 0)
+}
+
+// subscribed returns true if the client has a filter matching topic. The broker lock must be held
+func (c *conn) subscribed(topic string) bool {
+	for _, filter := range c.filters {
+		if match(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish sends a message to the client
+func (c *conn) publish(message *Message, qos byte) {
+	header := byte(packetPublish<<4) | qos<<1
+	if message.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, message.Topic)
+	if qos > 0 {
+		body = append(body, 0, 1) // packet ID
+	}
+	c.write(header, append(body, message.Payload...))
+}
+
+func (c *conn) write(header byte, body []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	packet := append([]byte{header}, encodeLength(len(body))...)
+	c.Write(append(packet, body...))
+}
+
+// parseConnect decodes the body of a CONNECT packet
+func parseConnect(body []byte) (*Connect, error) {
+	r := &fieldReader{data: body}
+	if protocol := r.string(); protocol != "MQTT" {
+		return nil, fmt.Errorf("protocol %q", protocol)
+	}
+	if level := r.byte(); level != 4 {
+		return nil, fmt.Errorf("protocol level %d", level)
+	}
+	flags := r.byte()
+	connect := &Connect{
+		KeepAlive:    time.Duration(r.uint16()) * time.Second,
+		ClientID:     r.string(),
+		CleanSession: flags&0x02 != 0,
+	}
+	if flags&0x04 != 0 {
+		connect.Will = &Message{Topic: r.string(), Payload: r.bytes(), Retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		connect.Username = r.string()
+	}
+	if flags&0x40 != 0 {
+		connect.Password = r.string()
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%d bytes left over", len(r.data))
+	}
+	return connect, r.err
+}
+
+// parsePublish decodes a PUBLISH packet
+func parsePublish(header byte, body []byte) (*Message, error) {
+	r := &fieldReader{data: body}
+	message := &Message{Topic: r.string(), Retain: header&0x01 != 0}
+	if (header>>1)&0x03 > 0 {
+		r.uint16() // packet ID
+	}
+	message.Payload = append([]byte(nil), r.data...)
+	return message, r.err
+}
+
+// parseSubscribe decodes the topic filters of a SUBSCRIBE packet, after its packet ID
+func parseSubscribe(body []byte) ([]string, error) {
+	r := &fieldReader{data: body}
+	var filters []string
+	for len(r.data) > 0 && r.err == nil {
+		filters = append(filters, r.string())
+		r.byte() // requested QoS
+	}
+	if len(filters) == 0 && r.err == nil {
+		r.err = fmt.Errorf("no topic filters")
+	}
+	return filters, r.err
+}
+
+// fieldReader reads the fields of a packet, keeping the first error
+type fieldReader struct {
+	data []byte
+	err  error
+}
+
+func (r *fieldReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	field := r.data[:n]
+	r.data = r.data[n:]
+	return field
+}
+
+func (r *fieldReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *fieldReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *fieldReader) bytes() []byte {
+	return append([]byte(nil), r.take(int(r.uint16()))...)
+}
+
+func (r *fieldReader) string() string {
+	return string(r.bytes())
+}
+
+// match returns true if topic matches filter, where + matches one level and # (at the end) matches any number
+func match(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// readPacket reads one packet, returning its first byte and the rest after the length
+func readPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift == 28 {
+			return 0, nil, fmt.Errorf("bad packet length")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader, body)
+	return header, body, err
+}
+
+func encodeLength(length int) []byte {
+	var encoded []byte
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		encoded = append(encoded, b)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s)>>8), byte(len(s))), s...)
+}
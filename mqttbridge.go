@@ -0,0 +1,487 @@
+package main
+
+// Bridging the lights and presets to an MQTT broker, announced with Home Assistant's MQTT discovery,
+// so they can be used without the Ninja stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/mqtt"
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+const (
+	mqttBaseTopic         = "yeelight"      // each Sphere's state and command topics are under here, in its own level
+	hassDiscoveryPrefix   = "homeassistant" // where Home Assistant looks for discovery messages
+	mqttReconnectInterval = 30 * time.Second
+)
+
+// hassDevice groups entities into a device in Home Assistant
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// hassLight is the discovery config for a light, using the JSON schema so a command can change several things at once
+type hassLight struct {
+	Name                string     `json:"name"`
+	UniqueID            string     `json:"unique_id"`
+	Schema              string     `json:"schema"`
+	StateTopic          string     `json:"state_topic"`
+	CommandTopic        string     `json:"command_topic"`
+	AvailabilityTopic   string     `json:"availability_topic"`
+	Brightness          bool       `json:"brightness"`
+	BrightnessScale     int        `json:"brightness_scale"`
+	SupportedColorModes []string   `json:"supported_color_modes"`
+	Device              hassDevice `json:"device"`
+}
+
+// hassScene is the discovery config for a preset
+type hassScene struct {
+	Name              string `json:"name"`
+	UniqueID          string `json:"unique_id"`
+	CommandTopic      string `json:"command_topic"`
+	PayloadOn         string `json:"payload_on"`
+	AvailabilityTopic string `json:"availability_topic"`
+}
+
+// hassColor is an RGB colour in a light's state or command
+type hassColor struct {
+	R int `json:"r"`
+	G int `json:"g"`
+	B int `json:"b"`
+}
+
+// hassLightState is the state published for a light, and the command Home Assistant sends to change it
+type hassLightState struct {
+	State      string     `json:"state"`                // "ON" or "OFF"
+	Brightness *int       `json:"brightness,omitempty"` // 0-100
+	ColorMode  string     `json:"color_mode,omitempty"`
+	Color      *hassColor `json:"color,omitempty"`
+	Transition *float64   `json:"transition,omitempty"` // seconds, commands only
+}
+
+// mqttBridge publishes the lights and presets to a broker and carries out commands from it,
+// reconnecting until it is stopped
+type mqttBridge struct {
+	driver    *YeelightDriver
+	broker    string
+	instance  string // identifies this Sphere in topics, unique IDs and the client ID, see mqttInstanceID
+	username  string
+	password  string
+	reconnect time.Duration // how long to wait before connecting again, mqttReconnectInterval unless testing
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu        sync.Mutex
+	published map[string][]byte // last payload sent to each retained topic, so only changes are sent
+	presets   map[string]string // preset names, keyed by the slug in their command topic
+}
+
+// newMQTTBridge creates a bridge to the broker (host:port) for the Sphere identified by instance,
+// which stops when ctx is cancelled. Call run to start it
+func newMQTTBridge(ctx context.Context, d *YeelightDriver, broker, instance, username, password string) *mqttBridge {
+	ctx, cancel := context.WithCancel(ctx)
+	return &mqttBridge{
+		driver:    d,
+		broker:    broker,
+		instance:  instance,
+		username:  username,
+		password:  password,
+		reconnect: mqttReconnectInterval,
+		published: make(map[string][]byte),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// run connects to the broker and serves it, connecting again whenever the connection is lost,
+// until stop is called or its context is cancelled
+func (b *mqttBridge) run() {
+	for {
+		client, err := mqtt.Dial(b.broker, mqtt.Options{
+			ClientID:    "driver-yeelight-" + b.instance,
+			Username:    b.username,
+			Password:    b.password,
+			WillTopic:   b.statusTopic(),
+			WillPayload: []byte("offline"),
+			WillRetain:  true,
+		})
+		if err != nil {
+			log.Printf("Could not connect to MQTT broker %v: %v", b.broker, err)
+		} else {
+			log.Printf("Connected to MQTT broker %v", b.broker)
+			b.serve(client)
+		}
+		select {
+		case <-time.After(b.reconnect):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends the bridge's goroutine, marking everything offline
+func (b *mqttBridge) stop() {
+	b.cancel()
+}
+
+// serve announces everything, then publishes light state every poll interval until the connection ends
+func (b *mqttBridge) serve(client *mqtt.Client) {
+	// a new connection may be to a broker that has lost our retained messages, so send everything again
+	b.mu.Lock()
+	b.published = make(map[string][]byte)
+	b.mu.Unlock()
+
+	if err := client.Subscribe(b.topic("+", "set"), func(topic string, payload []byte) {
+		b.lightCommand(client, b.topicLevels(topic)[0], payload)
+	}); err != nil {
+		log.Printf("Could not subscribe to light commands: %v", err)
+	}
+	if err := client.Subscribe(b.topic("preset", "+", "set"), func(topic string, payload []byte) {
+		b.presetCommand(b.topicLevels(topic)[1])
+	}); err != nil {
+		log.Printf("Could not subscribe to preset commands: %v", err)
+	}
+	client.Publish(b.statusTopic(), []byte("online"), true)
+
+	b.driver.mu.Lock()
+	interval := b.driver.pollInterval()
+	b.driver.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// discovery is sent on every update too, so renamed, added and removed lights and presets are picked up
+		b.update(client)
+		select {
+		case <-ticker.C:
+		case <-client.Done():
+			log.Printf("Lost connection to MQTT broker %v: %v", b.broker, client.Err())
+			return
+		case <-b.ctx.Done():
+			client.Publish(b.statusTopic(), []byte("offline"), true)
+			client.Close()
+			return
+		}
+	}
+}
+
+// update publishes discovery for the lights and presets, and the state of the lights.
+// Like the poller, it only holds the driver lock to read the config, asking the hubs for the lights without it
+func (b *mqttBridge) update(client *mqtt.Client) {
+	b.driver.mu.Lock()
+	if b.ctx.Err() != nil {
+		// the driver stopped while we waited for the lock
+		b.driver.mu.Unlock()
+		return
+	}
+	messages := b.discovery()
+	hubs := b.driver.hubSnapshots()
+	ids := append([]string(nil), b.driver.config.LightIDs...)
+	since := b.driver.commands
+	b.driver.mu.Unlock()
+
+	lights, err := allLights(hubs)
+	if err != nil {
+		log.Printf("Unable to get lights for MQTT: %v", err)
+	}
+	b.driver.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.driver.mu.Unlock()
+		return
+	}
+	for _, id := range ids {
+		// a light commanded since the hubs were asked has already published its new state
+		if light, found := findLight(lights, id); found && !b.driver.commandedSince(id, since) {
+			messages[b.topic(id, "state")] = lightStatePayload(light)
+		}
+	}
+	b.driver.mu.Unlock()
+
+	b.publish(client, messages, true)
+}
+
+// discovery returns the discovery config for every light and preset, keyed by topic. The driver lock must be held
+func (b *mqttBridge) discovery() map[string][]byte {
+	messages := make(map[string][]byte)
+	for _, id := range b.driver.config.LightIDs {
+		name := b.driver.config.Names[id]
+		if name == "" {
+			name = id
+		}
+		uniqueID := "yeelight_" + id
+		messages[hassDiscoveryPrefix+"/light/"+uniqueID+"/config"] = mustJSON(&hassLight{
+			Name:                name,
+			UniqueID:            uniqueID,
+			Schema:              "json",
+			StateTopic:          b.topic(id, "state"),
+			CommandTopic:        b.topic(id, "set"),
+			AvailabilityTopic:   b.statusTopic(),
+			Brightness:          true,
+			BrightnessScale:     100,
+			SupportedColorModes: []string{"rgb"},
+			Device: hassDevice{
+				Identifiers:  []string{uniqueID},
+				Name:         name,
+				Manufacturer: "Qingdao Yeelink",
+				Model:        "Yeelight Sunflower",
+			},
+		})
+	}
+
+	presets := make(map[string]string)
+	for _, name := range b.driver.config.PresetNames {
+		slug := topicSlug(name)
+		for n := 2; presets[slug] != ""; n++ {
+			slug = fmt.Sprintf("%v_%d", topicSlug(name), n)
+		}
+		presets[slug] = name
+		// presets are only unique to a Sphere, unlike lights
+		uniqueID := "yeelight_" + b.instance + "_preset_" + slug
+		messages[hassDiscoveryPrefix+"/scene/"+uniqueID+"/config"] = mustJSON(&hassScene{
+			Name:              name,
+			UniqueID:          uniqueID,
+			CommandTopic:      b.topic("preset", slug, "set"),
+			PayloadOn:         "ON",
+			AvailabilityTopic: b.statusTopic(),
+		})
+	}
+	b.mu.Lock()
+	b.presets = presets
+	b.mu.Unlock()
+	return messages
+}
+
+// publish sends retained messages that have changed since they were last sent.
+// If messages has all the discovery config (complete is set), the config of lights and presets that have gone
+// is cleared so Home Assistant removes them
+func (b *mqttBridge) publish(client *mqtt.Client, messages map[string][]byte, complete bool) {
+	b.mu.Lock()
+	var changed []string
+	for topic, payload := range messages {
+		if !bytes.Equal(b.published[topic], payload) {
+			changed = append(changed, topic)
+		}
+	}
+	var gone []string
+	for topic := range b.published {
+		if _, ok := messages[topic]; complete && !ok && strings.HasPrefix(topic, hassDiscoveryPrefix+"/") {
+			gone = append(gone, topic)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, topic := range changed {
+		if err := client.Publish(topic, messages[topic], true); err != nil {
+			log.Printf("Could not publish to MQTT: %v", err)
+			return
+		}
+		b.mu.Lock()
+		b.published[topic] = messages[topic]
+		b.mu.Unlock()
+	}
+	for _, topic := range gone {
+		if err := client.Publish(topic, nil, true); err != nil {
+			log.Printf("Could not publish to MQTT: %v", err)
+			return
+		}
+		b.mu.Lock()
+		delete(b.published, topic)
+		b.mu.Unlock()
+	}
+}
+
+// lightCommand changes a light the way its device's ApplyLightState does, then publishes its new state
+func (b *mqttBridge) lightCommand(client *mqtt.Client, id string, payload []byte) {
+	command := &hassLightState{}
+	if err := json.Unmarshal(payload, command); err != nil {
+		log.Printf("Bad MQTT command for light %v: %v", id, err)
+		return
+	}
+
+	b.driver.mu.Lock()
+	device, ok := b.driver.devices[id]
+	if !ok {
+		b.driver.mu.Unlock()
+		log.Printf("MQTT command for unknown light %v", id)
+		return
+	}
+	isOn := true
+	if command.State == "ON" && command.Brightness == nil {
+		var err error
+		if isOn, err = device.applyIsOn(); err != nil {
+			log.Printf("Unable to get whether light %v is on for an MQTT command: %v", id, err)
+			isOn = true
+		}
+	}
+	if err := device.applyLightState(commandLightState(command, isOn)); err != nil {
+		log.Printf("Unable to apply MQTT command to light %v: %v", id, err)
+	}
+	light, err := currentLight(device.hub, id)
+	b.driver.mu.Unlock()
+
+	if err == nil {
+		b.publish(client, map[string][]byte{b.topic(id, "state"): lightStatePayload(light)}, false)
+	}
+}
+
+// presetCommand activates a preset, fading over the Labs fade time
+func (b *mqttBridge) presetCommand(slug string) {
+	b.mu.Lock()
+	name, ok := b.presets[slug]
+	b.mu.Unlock()
+	if !ok {
+		log.Printf("MQTT command for unknown preset %v", slug)
+		return
+	}
+	b.driver.mu.Lock()
+	err := b.driver.ActivatePreset(name, time.Duration(b.driver.config.FadeSeconds)*time.Second)
+	b.driver.mu.Unlock()
+	if err != nil {
+		log.Printf("Unable to activate preset %v from MQTT: %v", name, err)
+	}
+}
+
+// commandLightState converts a Home Assistant command to the state ApplyLightState takes.
+// A colour or brightness on its own leaves the light's on/off alone (as the app does), since on/off sets full brightness,
+// but "ON" with a colour turns on a light that is off, as Home Assistant expects
+func commandLightState(command *hassLightState, isOn bool) *devices.LightDeviceState {
+	state := &devices.LightDeviceState{}
+	if command.State == "OFF" {
+		onOff := false
+		state.OnOff = &onOff
+	} else if command.Brightness != nil {
+		brightness := float64(*command.Brightness) / 100
+		state.Brightness = &brightness
+	} else if command.State == "ON" && (command.Color == nil || !isOn) {
+		onOff := true
+		state.OnOff = &onOff
+	}
+	if command.Color != nil && command.State != "OFF" {
+		hue, saturation := rgbToHueSaturation(command.Color.R, command.Color.G, command.Color.B)
+		state.Color = &channels.ColorState{Mode: "hue", Hue: &hue, Saturation: &saturation}
+	}
+	if command.Transition != nil && *command.Transition > 0 {
+		milliseconds := int(*command.Transition * 1000)
+		state.Transition = &milliseconds
+	}
+	return state
+}
+
+// topic returns the topic for levels under this Sphere's, like "yeelight/<instance>/<light ID>/state"
+func (b *mqttBridge) topic(levels ...string) string {
+	return strings.Join(append([]string{mqttBaseTopic, b.instance}, levels...), "/")
+}
+
+// topicLevels returns the levels of one of this Sphere's topics after its own, the opposite of topic
+func (b *mqttBridge) topicLevels(topic string) []string {
+	return strings.Split(strings.TrimPrefix(topic, b.topic()+"/"), "/")
+}
+
+// statusTopic is "online" or "offline", the availability of everything on this Sphere
+func (b *mqttBridge) statusTopic() string {
+	return b.topic("status")
+}
+
+// lightStatePayload is the state of a light for Home Assistant
+func lightStatePayload(light yeelight.Light) []byte {
+	state := &hassLightState{State: "OFF"}
+	if light.Level > 0 {
+		level := light.Level
+		state.State = "ON"
+		state.Brightness = &level
+	}
+	state.ColorMode = "rgb"
+	state.Color = &hassColor{R: light.R, G: light.G, B: light.B}
+	return mustJSON(state)
+}
+
+// topicSlug makes a name safe to use as a topic level and Home Assistant ID, like "Movie Night" to "movie_night"
+func topicSlug(name string) string {
+	slug := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '_'
+	}, name)
+	if slug == "" {
+		slug = "preset"
+	}
+	return slug
+}
+
+// mustJSON marshals values that can't fail to marshal
+func mustJSON(v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// startMQTTBridge starts bridging to the configured broker, if there is one. The driver lock must be held
+func (d *YeelightDriver) startMQTTBridge() {
+	if d.config.MQTTBroker == "" {
+		return
+	}
+	d.bridge = newMQTTBridge(d.ctx, d, d.config.MQTTBroker, d.mqttInstanceID(), d.config.MQTTUsername, d.config.MQTTPassword)
+	go d.bridge.run()
+}
+
+// mqttInstanceID identifies this Sphere to the broker, in its client ID (brokers drop a connection when another
+// client connects with the same ID), topics and preset unique IDs, so more than one Sphere can bridge to a broker.
+// It comes from the first hub's USN, the IP address of the first hub if none were discovered with one (unique
+// on the network the broker is on), or the host name before any hub is found. The driver lock must be held
+func (d *YeelightDriver) mqttInstanceID() string {
+	var id string
+	for _, hub := range d.config.Hubs {
+		if hub.USN != "" {
+			id = strings.TrimPrefix(hub.USN, "uuid:")
+			break
+		}
+	}
+	if id == "" && len(d.config.Hubs) > 0 {
+		id = d.config.Hubs[0].IP
+	}
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	if id == "" {
+		return "sphere"
+	}
+	return topicSlug(id)
+}
+
+// stopMQTTBridge stops the bridge if it's running. The driver lock must be held
+func (d *YeelightDriver) stopMQTTBridge() {
+	if d.bridge != nil {
+		d.bridge.stop()
+		d.bridge = nil
+	}
+}
+
+// SetMQTTBroker changes the broker the lights are bridged to, restarting the bridge, or turns it off if broker is empty
+func (d *YeelightDriver) SetMQTTBroker(broker, username, password string) error {
+	d.config.MQTTBroker = strings.TrimSpace(broker)
+	d.config.MQTTUsername = strings.TrimSpace(username)
+	d.config.MQTTPassword = password
+	d.stopMQTTBridge()
+	d.startMQTTBridge()
+	// save the new configuration
+	return d.saveConfig()
+}
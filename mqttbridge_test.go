@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/mqtt"
+	"github.com/lindsaymarkward/driver-yeelight/mqtt/mqtttest"
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// startTestBridge bridges a driver to a broker stand-in, connecting again straight away if the connection is lost
+func startTestBridge(t *testing.T, d *YeelightDriver) (*mqtttest.Broker, *mqttBridge) {
+	t.Helper()
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Could not start broker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	d.mu.Lock()
+	d.config.MQTTBroker = broker.Addr()
+	bridge := newMQTTBridge(d.ctx, d, broker.Addr(), d.mqttInstanceID(), "", "")
+	bridge.reconnect = 10 * time.Millisecond
+	d.bridge = bridge
+	go bridge.run()
+	d.mu.Unlock()
+	return broker, bridge
+}
+
+// retainedLight waits for the state a light was last published with to satisfy want, failing the test if it doesn't
+func retainedLight(t *testing.T, broker *mqtttest.Broker, bridge *mqttBridge, id string, want func(state *hassLightState) bool) *hassLightState {
+	t.Helper()
+	state := &hassLightState{}
+	if !broker.WaitFor(3*time.Second, func() bool {
+		payload, ok := broker.Retained(bridge.topic(id, "state"))
+		*state = hassLightState{}
+		return ok && json.Unmarshal(payload, state) == nil && want(state)
+	}) {
+		payload, _ := broker.Retained(bridge.topic(id, "state"))
+		t.Fatalf("%v state is %s", id, payload)
+	}
+	return state
+}
+
+func TestMQTTBridge(t *testing.T) {
+	d, first, _ := newFakeHubDriver(t)
+	broker, bridge := startTestBridge(t, d)
+
+	// lights are announced, with their state
+	isOn := func(state *hassLightState) bool { return state.State == "ON" }
+	state := retainedLight(t, broker, bridge, "A1", isOn)
+	if *state.Brightness != 50 || *state.Color != (hassColor{R: 255}) {
+		t.Errorf("A1 state = %+v, %+v", *state.Brightness, *state.Color)
+	}
+	retainedLight(t, broker, bridge, "B1", isOn)
+	if _, ok := broker.Retained(hassDiscoveryPrefix + "/light/yeelight_A1/config"); !ok {
+		t.Errorf("A1 wasn't announced for discovery")
+	}
+	if status, _ := broker.Retained(bridge.statusTopic()); string(status) != "online" {
+		t.Errorf("status = %q, want online", status)
+	}
+
+	// commands change the light, which is published straight away
+	if !broker.WaitFor(time.Second, func() bool { return broker.Subscribed(bridge.topic("A1", "set")) }) {
+		t.Fatalf("bridge didn't subscribe to light commands")
+	}
+	broker.Publish(bridge.topic("A1", "set"), []byte(`{"state": "ON", "brightness": 80, "color": {"r": 0, "g": 255, "b": 0}}`), 0)
+	retainedLight(t, broker, bridge, "A1", func(state *hassLightState) bool {
+		return state.Brightness != nil && *state.Brightness == 80 && *state.Color == (hassColor{G: 255})
+	})
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", G: 255, Level: 80}) {
+		t.Errorf("A1 = %+v after the command", got)
+	}
+	// a colour keeps the brightness of a light that is on
+	broker.Publish(bridge.topic("A1", "set"), []byte(`{"state": "ON", "color": {"r": 255, "g": 0, "b": 0}}`), 0)
+	retainedLight(t, broker, bridge, "A1", func(state *hassLightState) bool { return *state.Color == (hassColor{R: 255}) })
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", R: 255, Level: 80}) {
+		t.Errorf("A1 = %+v after changing its colour", got)
+	}
+
+	// when the connection is lost, the will marks everything offline until the bridge connects again
+	broker.Drop()
+	if !broker.WaitFor(3*time.Second, func() bool { return len(broker.Connects()) == 2 && broker.Subscribed(bridge.topic("A1", "set")) }) {
+		t.Fatalf("bridge didn't connect again, connected %d times", len(broker.Connects()))
+	}
+	statuses := func() []string {
+		var statuses []string
+		for _, message := range broker.Published() {
+			if message.Topic == bridge.statusTopic() {
+				statuses = append(statuses, string(message.Payload))
+			}
+		}
+		return statuses
+	}
+	if !broker.WaitFor(time.Second, func() bool { return len(statuses()) == 3 }) || statuses()[1] != "offline" || statuses()[2] != "online" {
+		t.Errorf("status was %q, want online, offline when the connection was lost, then online again", statuses())
+	}
+	// and commands still work
+	broker.Publish(bridge.topic("A1", "set"), []byte(`{"state": "OFF"}`), 0)
+	retainedLight(t, broker, bridge, "A1", func(state *hassLightState) bool { return state.State == "OFF" })
+	if got := first.light("A1"); got.Level != 0 {
+		t.Errorf("A1 = %+v after turning it off", got)
+	}
+	// but turns on one that is off
+	broker.Publish(bridge.topic("A1", "set"), []byte(`{"state": "ON", "color": {"r": 0, "g": 0, "b": 255}}`), 0)
+	retainedLight(t, broker, bridge, "A1", func(state *hassLightState) bool { return state.State == "ON" })
+	if got := first.light("A1"); got != (yeelight.Light{ID: "A1", B: 255, Level: 100}) {
+		t.Errorf("A1 = %+v after turning it on with a colour", got)
+	}
+
+	// stopping the bridge marks everything offline and disconnects
+	d.mu.Lock()
+	d.stopMQTTBridge()
+	d.mu.Unlock()
+	if !broker.WaitFor(time.Second, func() bool { status, _ := broker.Retained(bridge.statusTopic()); return string(status) == "offline" }) {
+		t.Errorf("status isn't offline after stopping the bridge")
+	}
+}
+
+func TestMQTTInstanceID(t *testing.T) {
+	d := newTestDriver(t)
+	host, _ := os.Hostname()
+	if got := d.mqttInstanceID(); host != "" && got != topicSlug(host) {
+		t.Errorf("instance ID = %q without hubs, want it from the host name %q", got, host)
+	}
+
+	// a hub's address is unique on the broker's network
+	d.config.Hubs = []*HubConfig{{ID: "1", IP: "10.0.0.1"}, {ID: "2", IP: "10.0.0.2"}}
+	if got := d.mqttInstanceID(); got != "10_0_0_1" {
+		t.Errorf("instance ID = %q, want it from the first hub's IP", got)
+	}
+
+	// but its USN is unique to it wherever it is, so it's used once a hub has been discovered with one
+	d.config.Hubs[1].USN = "uuid:5F1B7C0A-Hub"
+	if got := d.mqttInstanceID(); got != "5f1b7c0a_hub" {
+		t.Errorf("instance ID = %q, want it from the hub's USN", got)
+	}
+}
+
+func TestMQTTSpheresShareBroker(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Could not start broker: %v", err)
+	}
+	defer broker.Close()
+	type sphere struct {
+		d      *YeelightDriver
+		hub    *fakeHub
+		bridge *mqttBridge
+	}
+	var spheres []sphere
+	for _, usn := range []string{"uuid:hub-one", "uuid:hub-two"} {
+		d, hub, _ := newFakeHubDriver(t)
+		d.mu.Lock()
+		d.config.Hubs[0].USN = usn
+		d.config.FadeSeconds = 0
+		d.config.PresetNames = []string{"Evening"}
+		d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "A1", R: 255, G: 136, Level: 40}}}
+		d.config.MQTTBroker = broker.Addr()
+		bridge := newMQTTBridge(d.ctx, d, broker.Addr(), d.mqttInstanceID(), "", "")
+		d.bridge = bridge
+		go bridge.run()
+		d.mu.Unlock()
+		spheres = append(spheres, sphere{d, hub, bridge})
+	}
+	one, two := spheres[0], spheres[1]
+	for _, s := range spheres {
+		if !broker.WaitFor(3*time.Second, func() bool { return broker.Subscribed(s.bridge.topic("preset", "evening", "set")) }) {
+			t.Fatalf("%v didn't subscribe to preset commands", s.bridge.instance)
+		}
+	}
+
+	// each has its own client ID and presets, even with the same names
+	if connects := broker.Connects(); connects[0].ClientID == connects[1].ClientID {
+		t.Errorf("both Spheres connected as %q", connects[0].ClientID)
+	}
+	for _, s := range spheres {
+		topic := hassDiscoveryPrefix + "/scene/yeelight_" + s.bridge.instance + "_preset_evening/config"
+		if !broker.WaitFor(time.Second, func() bool { _, ok := broker.Retained(topic); return ok }) {
+			t.Errorf("%v wasn't announced", topic)
+		}
+	}
+
+	// a preset command only goes to its own Sphere
+	broker.Publish(one.bridge.topic("preset", "evening", "set"), []byte("ON"), 0)
+	if !broker.WaitFor(time.Second, func() bool { return one.hub.light("A1").Level == 40 }) {
+		t.Errorf("Sphere one's A1 = %+v after activating its preset", one.hub.light("A1"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := two.hub.light("A1"); got.Level != 50 {
+		t.Errorf("Sphere two's A1 = %+v after activating Sphere one's preset", got)
+	}
+
+	// and one going offline leaves the other available
+	one.d.mu.Lock()
+	one.d.stopMQTTBridge()
+	one.d.mu.Unlock()
+	if !broker.WaitFor(time.Second, func() bool {
+		status, _ := broker.Retained(one.bridge.statusTopic())
+		return string(status) == "offline"
+	}) {
+		t.Errorf("Sphere one isn't offline after stopping its bridge")
+	}
+	if status, _ := broker.Retained(two.bridge.statusTopic()); string(status) != "online" {
+		t.Errorf("Sphere two's status = %q after Sphere one stopped", status)
+	}
+}
+
+func TestMQTTUpdateDoesntHoldLock(t *testing.T) {
+	d, first, _ := newFakeHubDriver(t)
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("Could not start broker: %v", err)
+	}
+	defer broker.Close()
+	client, err := mqtt.Dial(broker.Addr(), mqtt.Options{ClientID: "test"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	bridge := newMQTTBridge(d.ctx, d, broker.Addr(), "test", "", "")
+	first.setDelay(500 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bridge.update(client)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	d.mu.Lock()
+	d.mu.Unlock()
+	if waited := time.Since(start); waited > 100*time.Millisecond {
+		t.Errorf("waited %v for the driver lock while the hub was slow", waited)
+	}
+	<-done
+	retainedLight(t, broker, bridge, "A1", func(state *hassLightState) bool { return state.State == "ON" })
+}
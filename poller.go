@@ -0,0 +1,140 @@
+package main
+
+// Polling the hubs for light state, so changes made outside the driver (Yeelight app, wall switch) show up on the Sphere
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"github.com/lindsaymarkward/go-ninja/devices"
+	"github.com/lindsaymarkward/go-yeelight"
+	"github.com/ninjasphere/go-ninja/channels"
+)
+
+// defaultPollSeconds is how often light state is polled when the config doesn't say
+const defaultPollSeconds = 10
+
+// statePoller gets the lights from every hub on an interval and updates the state of any device that has changed
+type statePoller struct {
+	driver   *YeelightDriver
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	last     map[string]yeelight.Light // last reading of each light, keyed by light ID (also used for metrics)
+}
+
+// newStatePoller creates a poller for the driver's lights, which stops when ctx is cancelled. Call run to start it
+func newStatePoller(ctx context.Context, d *YeelightDriver, interval time.Duration) *statePoller {
+	ctx, cancel := context.WithCancel(ctx)
+	return &statePoller{
+		driver:   d,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+		last:     make(map[string]yeelight.Light),
+	}
+}
+
+// run polls every interval until stop is called or its context is cancelled
+func (p *statePoller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	p.poll()
+	for {
+		select {
+		case <-ticker.C:
+			p.poll()
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// stop ends the poller's goroutine
+func (p *statePoller) stop() {
+	p.cancel()
+}
+
+// poll gets the current state of all lights and pushes changes to their devices.
+// The hubs are asked without the driver lock, which is only taken to update the devices
+func (p *statePoller) poll() {
+	p.driver.mu.Lock()
+	hubs := p.driver.hubSnapshots()
+	since := p.driver.commands
+	p.driver.mu.Unlock()
+	lights, err := allLights(hubs)
+	if err != nil {
+		log.Printf("Unable to poll lights: %v", err)
+		return
+	}
+	p.driver.mu.Lock()
+	defer p.driver.mu.Unlock()
+	if p.ctx.Err() != nil {
+		// stopped while polling, maybe replaced by a poller with a new interval
+		return
+	}
+	for _, light := range lights {
+		last, known := p.last[light.ID]
+		// keep every reading, as LQI can change when nothing else has
+		p.last[light.ID] = light
+		if known && last.R == light.R && last.G == light.G && last.B == light.B && last.Level == light.Level {
+			continue
+		}
+		device, ok := p.driver.devices[light.ID]
+		if !ok {
+			continue
+		}
+		if p.driver.commandedSince(light.ID, since) {
+			// the reading is from before the command, so the next poll shows the change (if the command didn't)
+			continue
+		}
+		if known {
+			log.Printf("Light %v changed outside the driver: %v", light.ID, light)
+		}
+		device.UpdateLightState(lightState(light))
+	}
+}
+
+// lightState converts a Yeelight light to a go-ninja light state with on/off, brightness and colour
+func lightState(light yeelight.Light) *devices.LightDeviceState {
+	onOff := light.Level > 0
+	brightness := float64(light.Level) / 100
+	hue, saturation := rgbToHueSaturation(light.R, light.G, light.B)
+	return &devices.LightDeviceState{
+		OnOff:      &onOff,
+		Brightness: &brightness,
+		Color: &channels.ColorState{
+			Mode:       "hue",
+			Hue:        &hue,
+			Saturation: &saturation,
+		},
+	}
+}
+
+// rgbToHueSaturation converts 0-255 RGB values to hue and saturation between 0-1, the opposite of yeelight.HSVToRGB
+// (Yeelight uses level for brightness, so value is ignored)
+func rgbToHueSaturation(r, g, b int) (float64, float64) {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	delta := max - min
+	if max == 0 || delta == 0 {
+		return 0, 0
+	}
+	var hue float64
+	switch max {
+	case rf:
+		hue = math.Mod((gf-bf)/delta, 6)
+	case gf:
+		hue = (bf-rf)/delta + 2
+	default:
+		hue = (rf-gf)/delta + 4
+	}
+	hue /= 6
+	if hue < 0 {
+		hue++
+	}
+	return hue, delta / max
+}
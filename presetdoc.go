@@ -0,0 +1,115 @@
+package main
+
+// Exporting presets as JSON documents and importing them, possibly into another house with different lights
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+// Ways to handle an imported preset whose name already exists
+const (
+	importRename    = "rename"
+	importOverwrite = "overwrite"
+	importSkip      = "skip"
+)
+
+// ExportPresets creates a document with the named presets, or all presets if names is empty
+func (d *YeelightDriver) ExportPresets(names []string) (*sunflower.PresetDocument, error) {
+	if len(names) == 0 {
+		names = d.config.PresetNames
+	}
+	doc := &sunflower.PresetDocument{
+		Version:    sunflower.PresetDocumentVersion,
+		Presets:    make(map[string]*sunflower.Preset),
+		LightNames: make(map[string]string),
+	}
+	for _, name := range names {
+		preset, ok := d.config.Presets[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown preset %v", name)
+		}
+		doc.PresetNames = append(doc.PresetNames, name)
+		doc.Presets[name] = preset
+		for _, light := range preset.Lights {
+			if light.ID != "" {
+				doc.LightNames[light.ID] = d.config.Names[light.ID]
+			}
+		}
+	}
+	return doc, nil
+}
+
+// UnknownLights returns the IDs of lights in the document that this driver doesn't have, in preset order
+func (d *YeelightDriver) UnknownLights(doc *sunflower.PresetDocument) []string {
+	var unknown []string
+	for _, name := range doc.PresetNames {
+		for _, light := range doc.Presets[name].Lights {
+			if light.ID != "" && !containsString(d.config.LightIDs, light.ID) && !containsString(unknown, light.ID) {
+				unknown = append(unknown, light.ID)
+			}
+		}
+	}
+	return unknown
+}
+
+// CollidingPresets returns the names of presets in the document that already exist
+func (d *YeelightDriver) CollidingPresets(doc *sunflower.PresetDocument) []string {
+	var colliding []string
+	for _, name := range doc.PresetNames {
+		if _, ok := d.config.Presets[name]; ok {
+			colliding = append(colliding, name)
+		}
+	}
+	return colliding
+}
+
+// ImportPresets adds the presets in a document to the config.
+// lightMap maps light IDs in the document to IDs on this driver (lights mapped to "" or not known are left out),
+// and collisions says what to do with each preset whose name already exists (importRename, importOverwrite or importSkip)
+func (d *YeelightDriver) ImportPresets(doc *sunflower.PresetDocument, lightMap map[string]string, collisions map[string]string) error {
+	for _, name := range doc.PresetNames {
+		newName := name
+		if _, exists := d.config.Presets[name]; exists {
+			switch collisions[name] {
+			case importOverwrite:
+			case importRename:
+				newName = d.uniquePresetName(name)
+			default:
+				log.Printf("Skipping imported preset %v, it already exists", name)
+				continue
+			}
+		}
+		preset := &sunflower.Preset{Lights: make([]sunflower.PresetLight, 0, len(doc.Presets[name].Lights))}
+		for _, light := range doc.Presets[name].Lights {
+			id := light.ID
+			if mapped, ok := lightMap[id]; ok {
+				id = mapped
+			}
+			if !containsString(d.config.LightIDs, id) {
+				continue
+			}
+			light.ID = id
+			preset.Lights = append(preset.Lights, light)
+		}
+		if !containsString(d.config.PresetNames, newName) {
+			d.config.PresetNames = append(d.config.PresetNames, newName)
+		}
+		d.config.Presets[newName] = preset
+		log.Printf("Imported preset %v as %v with %d lights", name, newName, len(preset.Lights))
+	}
+	// save the new configuration
+	return d.saveConfig()
+}
+
+// uniquePresetName adds a number to name until it isn't used by an existing preset, like "Evening (2)"
+func (d *YeelightDriver) uniquePresetName(name string) string {
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%v (%d)", name, n)
+		if _, exists := d.config.Presets[candidate]; !exists {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/lindsaymarkward/driver-yeelight/sunflower"
+)
+
+// newPresetDriver is a driver with lights A1, A2 and B1 and presets Evening and Evening (2)
+func newPresetDriver(t *testing.T) *YeelightDriver {
+	t.Helper()
+	d, _, _ := newFakeHubDriver(t)
+	d.config.PresetNames = []string{"Evening", "Evening (2)"}
+	d.config.Presets["Evening"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "A1", R: 255, Level: 40}}}
+	d.config.Presets["Evening (2)"] = &sunflower.Preset{Lights: []sunflower.PresetLight{{ID: "B1", B: 255, Level: 80}}}
+	return d
+}
+
+func TestUnknownLights(t *testing.T) {
+	d := newPresetDriver(t)
+	doc := &sunflower.PresetDocument{
+		Version:     sunflower.PresetDocumentVersion,
+		PresetNames: []string{"Morning", "Night"},
+		Presets: map[string]*sunflower.Preset{
+			"Morning": {Lights: []sunflower.PresetLight{{ID: "C2"}, {ID: "A1"}, {ID: "C1"}}},
+			// each unknown light once, and lights without an ID are ignored
+			"Night": {Lights: []sunflower.PresetLight{{ID: "C1"}, {ID: ""}, {ID: "B1"}, {ID: "C3"}}},
+		},
+	}
+	if got, want := d.UnknownLights(doc), []string{"C2", "C1", "C3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UnknownLights = %v, want %v in preset order", got, want)
+	}
+	doc.Presets["Morning"].Lights, doc.Presets["Night"].Lights = []sunflower.PresetLight{{ID: "A2"}}, nil
+	if got := d.UnknownLights(doc); len(got) != 0 {
+		t.Errorf("UnknownLights = %v when every light is known", got)
+	}
+}
+
+func TestCollidingPresets(t *testing.T) {
+	d := newPresetDriver(t)
+	doc := &sunflower.PresetDocument{
+		Version:     sunflower.PresetDocumentVersion,
+		PresetNames: []string{"Morning", "Evening (2)", "evening", "Evening"},
+		Presets:     map[string]*sunflower.Preset{},
+	}
+	// in the document's order, with names matched exactly
+	if got, want := d.CollidingPresets(doc), []string{"Evening (2)", "Evening"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CollidingPresets = %v, want %v", got, want)
+	}
+}
+
+func TestUniquePresetName(t *testing.T) {
+	d := newPresetDriver(t)
+	tests := []struct {
+		name, want string
+	}{
+		{"Evening", "Evening (3)"}, // "Evening (2)" is taken
+		{"Morning", "Morning (2)"},
+		{"Evening (2)", "Evening (2) (2)"},
+	}
+	for _, test := range tests {
+		if got := d.uniquePresetName(test.name); got != test.want {
+			t.Errorf("uniquePresetName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestImportPresets(t *testing.T) {
+	from := newPresetDriver(t)
+	doc, err := from.ExportPresets([]string{"Evening"})
+	if err != nil {
+		t.Fatalf("ExportPresets: %v", err)
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, err = sunflower.ParsePresetDocument(data); err != nil {
+		t.Fatalf("ParsePresetDocument: %v", err)
+	}
+
+	// a colliding preset is renamed, with its light mapped to one this driver has
+	d := newPresetDriver(t)
+	if err := d.ImportPresets(doc, map[string]string{"A1": "A2"}, map[string]string{"Evening": importRename}); err != nil {
+		t.Fatalf("ImportPresets: %v", err)
+	}
+	want := []sunflower.PresetLight{{ID: "A2", R: 255, Level: 40}}
+	if got := d.config.Presets["Evening (3)"]; got == nil || !reflect.DeepEqual(got.Lights, want) {
+		t.Errorf("imported preset = %+v, want lights %+v", got, want)
+	}
+	if got := d.config.PresetNames; !reflect.DeepEqual(got, []string{"Evening", "Evening (2)", "Evening (3)"}) {
+		t.Errorf("presets after importing = %v", got)
+	}
+
+	// or skipped, leaving the existing one alone
+	if err := d.ImportPresets(doc, nil, nil); err != nil {
+		t.Fatalf("ImportPresets: %v", err)
+	}
+	if got := d.config.Presets["Evening"].Lights; !reflect.DeepEqual(got, []sunflower.PresetLight{{ID: "A1", R: 255, Level: 40}}) || len(d.config.PresetNames) != 3 {
+		t.Errorf("skipping changed the presets: %v, %+v", d.config.PresetNames, got)
+	}
+}
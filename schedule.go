@@ -0,0 +1,240 @@
+package main
+
+// Scheduled preset activation
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// maxSchedulerSleep limits how long the scheduler sleeps, so it notices clock changes
+const maxSchedulerSleep = time.Minute
+
+// Schedule activates a preset (or turns all lights off) at a time of day on some days of the week.
+// The time is either a fixed time of day or an offset from a solar event (sunrise, sunset, dawn or dusk)
+type Schedule struct {
+	ID            string
+	Preset        string         // name of the preset to activate, unless AllOff is set
+	AllOff        bool           // turn all lights off instead of activating a preset
+	Days          []time.Weekday // days of the week to run on
+	Time          string         // local time of day, like "07:30", when Event is empty
+	Event         string         // Sunrise, Sunset, CivilDawn or CivilDusk, or empty to use Time
+	OffsetMinutes int            // minutes after (or before, if negative) Event
+	Enabled       bool
+}
+
+// site is where on Earth the driver is, for working out solar events
+type site struct {
+	latitude, longitude float64
+}
+
+// clock returns the hour and minute of the schedule's time of day
+func (s *Schedule) clock() (int, int, error) {
+	t, err := time.Parse("15:04", s.Time)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Bad time %q, should look like 07:30", s.Time)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// runsOn returns true if the schedule runs on the given day of the week
+func (s *Schedule) runsOn(day time.Weekday) bool {
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the first time the schedule runs after after, in loc.
+// Times are worked out from the wall clock on each day, so they stay the same across daylight saving changes
+// (a time skipped when clocks go forward runs an hour later, and a time repeated when they go back runs once).
+// Solar events are worked out for each day at the site
+func (s *Schedule) next(after time.Time, loc *time.Location, at site) (time.Time, bool) {
+	if len(s.Days) == 0 {
+		return time.Time{}, false
+	}
+	var hour, minute int
+	if s.Event == "" {
+		var err error
+		if hour, minute, err = s.clock(); err != nil {
+			return time.Time{}, false
+		}
+	}
+	after = after.In(loc)
+	year, month, day := after.Date()
+	for i := 0; i <= 7; i++ {
+		// the date (and so day of the week) at noon is never affected by daylight saving changes
+		date := time.Date(year, month, day+i, 12, 0, 0, 0, loc)
+		if !s.runsOn(date.Weekday()) {
+			continue
+		}
+		var when time.Time
+		if s.Event != "" {
+			event, ok := solarEventTime(s.Event, date.Year(), date.Month(), date.Day(), loc, at.latitude, at.longitude)
+			if !ok {
+				// no sunrise (etc.) today
+				continue
+			}
+			when = event.Add(time.Duration(s.OffsetMinutes) * time.Minute)
+		} else {
+			when = wallClock(date.Year(), date.Month(), date.Day(), hour, minute, loc)
+		}
+		if when.After(after) {
+			return when, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// wallClock returns the time at hour:minute on a day in loc. A time skipped when clocks go forward is
+// moved after the gap (02:30 is 03:30 when 02:00 becomes 03:00), as time.Date picks either side of it
+// depending on the zone. A repeated time is the one time.Date picks, so it only happens once
+func wallClock(year int, month time.Month, day, hour, minute int, loc *time.Location) time.Time {
+	when := time.Date(year, month, day, hour, minute, 0, 0, loc)
+	// how far the clock reads behind what was asked for, comparing the readings as if there were no time zones
+	y, m, d := when.Date()
+	behind := time.Date(year, month, day, hour, minute, 0, 0, time.UTC).Sub(time.Date(y, m, d, when.Hour(), when.Minute(), 0, 0, time.UTC))
+	if behind > 0 {
+		when = when.Add(behind)
+	}
+	return when
+}
+
+// Description is a summary of the schedule for the config screens, like "Preset Bedtime at 22:00 on Mon, Tue"
+func (s *Schedule) Description() string {
+	action := "Preset " + s.Preset
+	if s.AllOff {
+		action = "All lights off"
+	}
+	days := make([]string, len(s.Days))
+	for i, d := range s.Days {
+		days[i] = d.String()[:3]
+	}
+	return fmt.Sprintf("%v at %v on %v", action, s.When(), strings.Join(days, ", "))
+}
+
+// When describes the time of day the schedule runs, like "07:30" or "30 min before sunset"
+func (s *Schedule) When() string {
+	switch {
+	case s.Event == "":
+		return s.Time
+	case s.OffsetMinutes > 0:
+		return fmt.Sprintf("%d min after %v", s.OffsetMinutes, s.Event)
+	case s.OffsetMinutes < 0:
+		return fmt.Sprintf("%d min before %v", -s.OffsetMinutes, s.Event)
+	}
+	return s.Event
+}
+
+// scheduler runs the driver's enabled schedules at the right times
+type scheduler struct {
+	driver  *YeelightDriver
+	changed chan struct{} // tells the scheduler to look at the schedules again
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// newScheduler creates a scheduler for the driver's schedules, which stops when ctx is cancelled. Call run to start it
+func newScheduler(ctx context.Context, d *YeelightDriver) *scheduler {
+	ctx, cancel := context.WithCancel(ctx)
+	return &scheduler{
+		driver:  d,
+		changed: make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// location returns the time zone schedules run in, from the config or the driver's local time zone
+func (s *scheduler) location() *time.Location {
+	if name := s.driver.config.TimeZone; name != "" {
+		loc, err := time.LoadLocation(name)
+		if err == nil {
+			return loc
+		}
+		log.Printf("Unknown time zone %v, using local time: %v", name, err)
+	}
+	return time.Local
+}
+
+// run sleeps until the next schedule is due and runs it, until stop is called or its context is cancelled
+func (s *scheduler) run() {
+	lastCheck := time.Now()
+	for {
+		sleep := maxSchedulerSleep
+		if at, ok := s.nextRun(lastCheck); ok && at.Sub(time.Now()) < sleep {
+			sleep = at.Sub(time.Now())
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-timer.C:
+			now := time.Now()
+			s.runDue(lastCheck, now)
+			lastCheck = now
+		case <-s.changed:
+			timer.Stop()
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// site returns where the driver is, from the config
+func (s *scheduler) site() site {
+	return site{latitude: s.driver.config.Latitude, longitude: s.driver.config.Longitude}
+}
+
+// nextRun returns the earliest time an enabled schedule runs after after
+func (s *scheduler) nextRun(after time.Time) (time.Time, bool) {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	loc, here := s.location(), s.site()
+	var earliest time.Time
+	found := false
+	for _, schedule := range s.driver.config.Schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		if at, ok := schedule.next(after, loc, here); ok && (!found || at.Before(earliest)) {
+			earliest, found = at, true
+		}
+	}
+	return earliest, found
+}
+
+// runDue runs every enabled schedule that was due between from and to
+func (s *scheduler) runDue(from, to time.Time) {
+	s.driver.mu.Lock()
+	defer s.driver.mu.Unlock()
+	loc, here := s.location(), s.site()
+	for _, schedule := range s.driver.config.Schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		if at, ok := schedule.next(from, loc, here); ok && !at.After(to) {
+			log.Printf("Running schedule: %v", schedule.Description())
+			if err := s.driver.runSchedule(schedule); err != nil {
+				log.Printf("Schedule failed: %v", err)
+			}
+		}
+	}
+}
+
+// reload tells the scheduler the schedules have changed
+func (s *scheduler) reload() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// stop ends the scheduler's goroutine
+func (s *scheduler) stop() {
+	s.cancel()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// loadLocation loads a time zone from the system's zone database, failing the test if it can't
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("Could not load time zone %v: %v", name, err)
+	}
+	return loc
+}
+
+func TestScheduleNext(t *testing.T) {
+	sydney := loadLocation(t, "Australia/Sydney")
+	newYork := loadLocation(t, "America/New_York")
+	everyDay := []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	const layout = "2006-01-02 15:04 MST"
+
+	tests := []struct {
+		name     string
+		loc      *time.Location
+		schedule Schedule
+		after    string // in layout, the zone telling apart times that happen twice
+		want     string // in layout, or "" if the schedule never runs
+	}{
+		// clocks go forward at 02:00 on 4 October 2026 in Sydney, and 8 March 2026 in New York
+		{"Sydney before spring forward", sydney, Schedule{Time: "02:30", Days: everyDay}, "2026-10-03 12:00 AEST", "2026-10-04 03:30 AEDT"},
+		{"Sydney after spring forward", sydney, Schedule{Time: "02:30", Days: everyDay}, "2026-10-04 04:00 AEDT", "2026-10-05 02:30 AEDT"},
+		{"Sydney unaffected time", sydney, Schedule{Time: "07:00", Days: everyDay}, "2026-10-04 00:00 AEST", "2026-10-04 07:00 AEDT"},
+		{"New York before spring forward", newYork, Schedule{Time: "02:15", Days: everyDay}, "2026-03-07 12:00 EST", "2026-03-08 03:15 EDT"},
+		{"New York at the start of the gap", newYork, Schedule{Time: "02:00", Days: everyDay}, "2026-03-07 12:00 EST", "2026-03-08 03:00 EDT"},
+		// and back at 03:00 on 5 April 2026 in Sydney, and 02:00 on 1 November 2026 in New York
+		{"Sydney before fall back", sydney, Schedule{Time: "02:30", Days: everyDay}, "2026-04-04 12:00 AEDT", "2026-04-05 02:30 AEST"},
+		{"Sydney between the repeats", sydney, Schedule{Time: "02:30", Days: everyDay}, "2026-04-05 02:45 AEDT", "2026-04-05 02:30 AEST"},
+		{"New York before fall back", newYork, Schedule{Time: "01:30", Days: everyDay}, "2026-10-31 12:00 EDT", "2026-11-01 01:30 EDT"},
+		{"New York after fall back", newYork, Schedule{Time: "01:30", Days: everyDay}, "2026-11-01 01:45 EST", "2026-11-02 01:30 EST"},
+		// only on its days, 4 October 2026 being a Sunday
+		{"next weekday", sydney, Schedule{Time: "07:00", Days: weekdays}, "2026-10-02 08:00 AEST", "2026-10-05 07:00 AEDT"},
+		{"later today", sydney, Schedule{Time: "07:00", Days: weekdays}, "2026-10-05 06:59 AEDT", "2026-10-05 07:00 AEDT"},
+		{"not at the time itself", sydney, Schedule{Time: "07:00", Days: weekdays}, "2026-10-05 07:00 AEDT", "2026-10-06 07:00 AEDT"},
+		{"a week later", newYork, Schedule{Time: "07:00", Days: []time.Weekday{time.Sunday}}, "2026-11-01 07:00 EST", "2026-11-08 07:00 EST"},
+		{"no days", sydney, Schedule{Time: "07:00"}, "2026-10-05 06:00 AEDT", ""},
+		{"bad time", sydney, Schedule{Time: "7am", Days: everyDay}, "2026-10-05 06:00 AEDT", ""},
+	}
+	for _, test := range tests {
+		after, err := time.ParseInLocation(layout, test.after, test.loc)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		got, ok := test.schedule.next(after, test.loc, site{})
+		switch {
+		case test.want == "" && ok:
+			t.Errorf("%v: next = %v, want never", test.name, got.Format(layout))
+		case test.want != "" && (!ok || got.Format(layout) != test.want):
+			t.Errorf("%v: next = %v, %v, want %v", test.name, got.Format(layout), ok, test.want)
+		}
+	}
+}
+
+func TestRunDue(t *testing.T) {
+	tests := []struct {
+		name, zone, time string
+		from, to         string // the local times the scheduler checks between, a minute at a time
+	}{
+		{"skipped time", "America/New_York", "02:30", "2026-03-07 23:00", "2026-03-08 05:00"},
+		{"repeated time", "America/New_York", "01:30", "2026-10-31 23:00", "2026-11-01 05:00"},
+		{"repeated time east of Greenwich", "Australia/Sydney", "02:30", "2026-04-04 23:00", "2026-04-05 05:00"},
+	}
+	for _, test := range tests {
+		d, first, _ := newFakeHubDriver(t)
+		d.config.TimeZone = test.zone
+		d.config.Schedules = []*Schedule{{ID: "1", AllOff: true, Time: test.time, Days: []time.Weekday{time.Sunday}, Enabled: true}}
+		s := newScheduler(d.ctx, d)
+		loc := s.location()
+		from, _ := time.ParseInLocation("2006-01-02 15:04", test.from, loc)
+		to, _ := time.ParseInLocation("2006-01-02 15:04", test.to, loc)
+
+		runs := func() int {
+			count := 0
+			for _, command := range first.sent() {
+				if command == "TurnOffAllLights" {
+					count++
+				}
+			}
+			return count
+		}
+		for check := from; check.Before(to); check = check.Add(time.Minute) {
+			s.runDue(check, check.Add(time.Minute))
+		}
+		if got := runs(); got != 1 {
+			t.Errorf("%v: ran %d times checking a minute at a time, want once", test.name, got)
+		}
+
+		// a window longer than a day (like after the Sphere has been asleep) runs it once too
+		s.runDue(from, to.Add(7*24*time.Hour))
+		if got := runs(); got != 2 {
+			t.Errorf("%v: ran %d times in a long window, want once more", test.name, got-1)
+		}
+		// and a disabled schedule doesn't run
+		d.config.Schedules[0].Enabled = false
+		s.runDue(from, to)
+		if got := runs(); got != 2 {
+			t.Errorf("%v: disabled schedule ran", test.name)
+		}
+	}
+}
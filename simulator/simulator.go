@@ -0,0 +1,312 @@
+// Package simulator is an in-process stand-in for a Yeelight Sunflower hub, for integration tests
+// that have no real hardware.
+//
+// It listens on TCP and speaks the same line-based text protocol go-yeelight uses:
+//
+//	GL,,,,0,              get lights     -> GLB id,type,online,lqi,r,g,b,level,effect;...
+//	C id,r,g,b,level,...  control light  -> CB id,r,g,b,level,...   (id **** controls all lights, empty fields are unchanged)
+//	HB                    heartbeat      -> HACK
+//
+// go-yeelight always connects to the hub on port 10003, so give each simulated hub its own loopback
+// address (127.0.0.1, 127.0.0.2...) on Linux, or use ListenLoopback to pick one. It can also answer SSDP
+// discovery searches.
+package simulator
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// Port is the TCP port the Yeelight hub (and go-yeelight) uses
+const Port = "10003"
+
+// allLights is the light ID that controls every light on the hub
+const allLights = "****"
+
+// Hub is a simulated Yeelight Sunflower hub holding the state of its bulbs
+type Hub struct {
+	mu         sync.Mutex
+	lights     map[string]*yeelight.Light
+	order      []string // IDs in the order lights were added, so GetLights is stable
+	commands   []string
+	heartbeats int
+	offline    bool
+	delay      time.Duration
+	usn        string // sent in SSDP replies
+
+	listener net.Listener
+	ssdp     *net.UDPConn
+	wg       sync.WaitGroup
+}
+
+// hubCount numbers the simulated hubs, giving each its own USN
+var hubCount int32
+
+// NewHub creates a simulated hub with the given bulbs
+func NewHub(lights ...yeelight.Light) *Hub {
+	n := atomic.AddInt32(&hubCount, 1)
+	h := &Hub{lights: make(map[string]*yeelight.Light), usn: fmt.Sprintf("uuid:yeelight-simulator-%d", n)}
+	for _, light := range lights {
+		h.AddLight(light)
+	}
+	return h
+}
+
+// Listen starts answering hub commands on addr, e.g. "127.0.0.1:10003"
+func (h *Hub) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	h.listener = listener
+	h.wg.Add(1)
+	go h.serve()
+	return nil
+}
+
+// ListenLoopback starts answering hub commands on Port at the first free loopback address from 127.0.0.2,
+// so hubs in tests running at the same time (even in other packages) don't clash
+func (h *Hub) ListenLoopback() error {
+	var err error
+	for b := 0; b < 256; b++ {
+		for c := 2; c < 255; c++ {
+			if err = h.Listen(fmt.Sprintf("127.0.%d.%d:%s", b, c, Port)); err == nil {
+				return nil
+			}
+			if !errors.Is(err, syscall.EADDRINUSE) {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+// Addr returns the host:port the hub is listening on
+func (h *Hub) Addr() string {
+	if h.listener == nil {
+		return ""
+	}
+	return h.listener.Addr().String()
+}
+
+// IP returns the IP address the hub is listening on, as the driver would store it in its config
+func (h *Hub) IP() string {
+	host, _, _ := net.SplitHostPort(h.Addr())
+	return host
+}
+
+// USN returns the unique service name the hub sends in SSDP replies
+func (h *Hub) USN() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.usn
+}
+
+// SetUSN changes the unique service name, e.g. so a new Hub can play a real hub that has moved to another address
+func (h *Hub) SetUSN(usn string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.usn = usn
+}
+
+// Close stops the hub (and SSDP responder, if running) and waits for connections to finish
+func (h *Hub) Close() error {
+	var err error
+	if h.listener != nil {
+		err = h.listener.Close()
+	}
+	if h.ssdp != nil {
+		h.ssdp.Close()
+	}
+	h.wg.Wait()
+	return err
+}
+
+// AddLight adds a bulb to the hub, or replaces the state of an existing one
+func (h *Hub) AddLight(light yeelight.Light) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.lights[light.ID]; !ok {
+		h.order = append(h.order, light.ID)
+	}
+	h.lights[light.ID] = &light
+}
+
+// RemoveLight takes a bulb off the hub, as if it had been unpaired
+func (h *Hub) RemoveLight(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.lights, id)
+	for i, v := range h.order {
+		if v == id {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Light returns the current state of one bulb
+func (h *Hub) Light(id string) (yeelight.Light, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	light, ok := h.lights[id]
+	if !ok {
+		return yeelight.Light{}, false
+	}
+	return *light, true
+}
+
+// Lights returns the current state of all bulbs, in the order they were added
+func (h *Hub) Lights() []yeelight.Light {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lights := make([]yeelight.Light, 0, len(h.order))
+	for _, id := range h.order {
+		lights = append(lights, *h.lights[id])
+	}
+	return lights
+}
+
+// Commands returns every command line the hub has received, oldest first
+func (h *Hub) Commands() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.commands...)
+}
+
+// Heartbeats returns the number of heartbeats the hub has answered
+func (h *Hub) Heartbeats() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.heartbeats
+}
+
+// SetOffline makes the hub drop connections without answering (true) or behave normally again (false)
+func (h *Hub) SetOffline(offline bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.offline = offline
+}
+
+// SetDelay makes the hub wait before answering each command, to simulate a slow hub
+func (h *Hub) SetDelay(delay time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.delay = delay
+}
+
+// serve accepts connections until the listener is closed
+func (h *Hub) serve() {
+	defer h.wg.Done()
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		h.wg.Add(1)
+		go h.handle(conn)
+	}
+}
+
+// handle answers each command line on a connection
+func (h *Hub) handle(conn net.Conn) {
+	defer h.wg.Done()
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		h.mu.Lock()
+		offline, delay := h.offline, h.delay
+		h.mu.Unlock()
+		if offline {
+			return
+		}
+		time.Sleep(delay)
+
+		reply, err := h.Execute(line)
+		if err != nil {
+			log.Printf("Simulated hub: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "%s\r\n", reply); err != nil {
+			return
+		}
+	}
+}
+
+// Execute runs a single protocol command against the hub state and returns the reply line (without "\r\n")
+func (h *Hub) Execute(line string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, line)
+
+	switch {
+	case strings.HasPrefix(line, "GL"):
+		records := make([]string, 0, len(h.order))
+		for _, id := range h.order {
+			l := h.lights[id]
+			records = append(records, fmt.Sprintf("%s,1,1,%d,%d,%d,%d,%d,%d", l.ID, l.LQI, l.R, l.G, l.B, l.Level, l.Effect))
+		}
+		return "GLB " + strings.Join(records, ";"), nil
+
+	case strings.HasPrefix(line, "HB"):
+		h.heartbeats++
+		return "HACK", nil
+
+	case strings.HasPrefix(line, "C "):
+		fields := strings.Split(strings.TrimPrefix(line, "C "), ",")
+		if len(fields) < 5 {
+			return "", fmt.Errorf("bad control command %q", line)
+		}
+		id := fields[0]
+		if id == allLights {
+			for _, light := range h.lights {
+				if err := applyFields(light, fields[1:5]); err != nil {
+					return "", err
+				}
+			}
+		} else {
+			light, ok := h.lights[id]
+			if !ok {
+				return "", fmt.Errorf("unknown light %v", id)
+			}
+			if err := applyFields(light, fields[1:5]); err != nil {
+				return "", err
+			}
+		}
+		return "CB " + strings.Join(fields, ","), nil
+
+	default:
+		return "", fmt.Errorf("unknown command %q", line)
+	}
+}
+
+// applyFields sets r, g, b and level on a light from protocol fields, leaving empty fields unchanged
+func applyFields(light *yeelight.Light, fields []string) error {
+	values := []*int{&light.R, &light.G, &light.B, &light.Level}
+	for i, field := range fields {
+		if field == "" {
+			continue
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return fmt.Errorf("bad value %q for light %v", field, light.ID)
+		}
+		*values[i] = v
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package simulator
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// startHub starts a simulated hub on its own loopback address, closed when the test ends
+func startHub(t *testing.T, lights ...yeelight.Light) *Hub {
+	t.Helper()
+	hub := NewHub(lights...)
+	if err := hub.ListenLoopback(); err != nil {
+		t.Fatalf("Could not start simulated hub: %v", err)
+	}
+	t.Cleanup(func() { hub.Close() })
+	return hub
+}
+
+func TestGoYeelightCommands(t *testing.T) {
+	hub := startHub(t,
+		yeelight.Light{ID: "4F1A", LQI: 90, R: 255, G: 136, B: 0, Level: 60},
+		yeelight.Light{ID: "238B", LQI: 70, R: 0, G: 0, B: 255, Level: 0},
+	)
+	ip := hub.IP()
+
+	lights, err := yeelight.GetLights(ip)
+	if err != nil {
+		t.Fatalf("GetLights: %v", err)
+	}
+	if len(lights) != 2 || lights[0] != hub.Lights()[0] || lights[1] != hub.Lights()[1] {
+		t.Fatalf("GetLights = %v, want %v", lights, hub.Lights())
+	}
+
+	steps := []struct {
+		name    string
+		command func() error
+		id      string
+		want    yeelight.Light
+		anyOn   bool // go-yeelight picks the level for turning on, so only check the light is on
+	}{
+		{"SetLight", func() error { return yeelight.SetLight("4F1A", 10, 20, 30, 40, ip) }, "4F1A",
+			yeelight.Light{ID: "4F1A", LQI: 90, R: 10, G: 20, B: 30, Level: 40}, false},
+		{"SetBrightness", func() error { return yeelight.SetBrightness("4F1A", 0.75, ip) }, "4F1A",
+			yeelight.Light{ID: "4F1A", LQI: 90, R: 10, G: 20, B: 30, Level: 75}, false},
+		{"SetColor keeps the level", func() error { return yeelight.SetColor("4F1A", 1, 2, 3, ip) }, "4F1A",
+			yeelight.Light{ID: "4F1A", LQI: 90, R: 1, G: 2, B: 3, Level: 75}, false},
+		{"SetOnOff off", func() error { return yeelight.SetOnOff("4F1A", false, ip) }, "4F1A",
+			yeelight.Light{ID: "4F1A", LQI: 90, R: 1, G: 2, B: 3, Level: 0}, false},
+		{"SetOnOff on", func() error { return yeelight.SetOnOff("238B", true, ip) }, "238B",
+			yeelight.Light{ID: "238B", LQI: 70, R: 0, G: 0, B: 255}, true},
+	}
+	for _, step := range steps {
+		if err := step.command(); err != nil {
+			t.Fatalf("%v: %v", step.name, err)
+		}
+		got, _ := hub.Light(step.id)
+		if step.anyOn && got.Level > 0 {
+			got.Level = 0
+		}
+		if got != step.want {
+			t.Errorf("%v: light = %+v, want %+v", step.name, got, step.want)
+		}
+	}
+
+	if on, err := yeelight.IsOn("238B", ip); err != nil || !on {
+		t.Errorf("IsOn(238B) = %v, %v, want true", on, err)
+	}
+	if err := yeelight.Heartbeat(ip); err != nil {
+		t.Errorf("Heartbeat: %v", err)
+	}
+	if hub.Heartbeats() != 1 {
+		t.Errorf("Heartbeats = %d, want 1", hub.Heartbeats())
+	}
+	if err := yeelight.TurnOffAllLights(ip); err != nil {
+		t.Fatalf("TurnOffAllLights: %v", err)
+	}
+	for _, light := range hub.Lights() {
+		if light.Level != 0 {
+			t.Errorf("light %v is still on (level %d) after all off", light.ID, light.Level)
+		}
+	}
+	commands := hub.Commands()
+	if len(commands) == 0 || !strings.HasPrefix(commands[len(commands)-1], "C ****,") {
+		t.Errorf("hub commands = %q, want all off last", commands)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		line    string
+		reply   string
+		wantErr bool
+		want    yeelight.Light // state of light A afterwards
+	}{
+		{"GL,,,,0,", "GLB A,1,1,5,1,2,3,50,0;B,1,1,0,0,0,0,0,0", false, yeelight.Light{ID: "A", LQI: 5, R: 1, G: 2, B: 3, Level: 50}},
+		{"HB", "HACK", false, yeelight.Light{ID: "A", LQI: 5, R: 1, G: 2, B: 3, Level: 50}},
+		{"C A,,,,20,,0", "CB A,,,,20,,0", false, yeelight.Light{ID: "A", LQI: 5, R: 1, G: 2, B: 3, Level: 20}},
+		{"C ****,9,9,9,,,0", "CB ****,9,9,9,,,0", false, yeelight.Light{ID: "A", LQI: 5, R: 9, G: 9, B: 9, Level: 20}},
+		{"C X,1,1,1,1,,0", "", true, yeelight.Light{ID: "A", LQI: 5, R: 9, G: 9, B: 9, Level: 20}},
+		{"C A,red,1,1,1,,0", "", true, yeelight.Light{ID: "A", LQI: 5, R: 9, G: 9, B: 9, Level: 20}},
+		{"C A,1", "", true, yeelight.Light{ID: "A", LQI: 5, R: 9, G: 9, B: 9, Level: 20}},
+		{"XX", "", true, yeelight.Light{ID: "A", LQI: 5, R: 9, G: 9, B: 9, Level: 20}},
+	}
+	hub := NewHub(yeelight.Light{ID: "A", LQI: 5, R: 1, G: 2, B: 3, Level: 50}, yeelight.Light{ID: "B"})
+	for _, test := range tests {
+		reply, err := hub.Execute(test.line)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Execute(%q) error = %v, want error %v", test.line, err, test.wantErr)
+		}
+		if reply != test.reply {
+			t.Errorf("Execute(%q) = %q, want %q", test.line, reply, test.reply)
+		}
+		if got, _ := hub.Light("A"); got != test.want {
+			t.Errorf("after %q light A = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestOfflineAndDelay(t *testing.T) {
+	hub := startHub(t, yeelight.Light{ID: "A", Level: 50})
+
+	hub.SetOffline(true)
+	if _, err := yeelight.GetLights(hub.IP()); err == nil {
+		t.Errorf("GetLights from an offline hub succeeded")
+	}
+	if err := yeelight.SetLight("A", 1, 2, 3, 4, hub.IP()); err == nil {
+		t.Errorf("SetLight on an offline hub succeeded")
+	}
+	if light, _ := hub.Light("A"); light.Level != 50 {
+		t.Errorf("offline hub changed a light: %+v", light)
+	}
+
+	hub.SetOffline(false)
+	delay := 100 * time.Millisecond
+	hub.SetDelay(delay)
+	start := time.Now()
+	if err := yeelight.Heartbeat(hub.IP()); err != nil {
+		t.Fatalf("Heartbeat after coming back online: %v", err)
+	}
+	if took := time.Since(start); took < delay {
+		t.Errorf("delayed heartbeat took %v, want at least %v", took, delay)
+	}
+}
+
+func TestRemoveLight(t *testing.T) {
+	hub := startHub(t, yeelight.Light{ID: "A"}, yeelight.Light{ID: "B"})
+	hub.RemoveLight("A")
+	lights, err := yeelight.GetLights(hub.IP())
+	if err != nil {
+		t.Fatalf("GetLights: %v", err)
+	}
+	if len(lights) != 1 || lights[0].ID != "B" {
+		t.Errorf("GetLights after removing A = %v", lights)
+	}
+}
+
+func TestSSDP(t *testing.T) {
+	hub := startHub(t, yeelight.Light{ID: "A"})
+
+	// the reply to a search sent straight to the responder
+	if err := hub.ListenSSDP(net.JoinHostPort(hub.IP(), "0")); err != nil {
+		t.Fatalf("ListenSSDP: %v", err)
+	}
+	// the hub replies from its own address rather than the responder's, so don't connect the socket
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: yeelink:yeelight\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), hub.ssdp.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("No SSDP reply: %v", err)
+	}
+	reply := string(buf[:n])
+	for _, want := range []string{"HTTP/1.1 200 OK\r\n", "LOCATION: yeelink://" + hub.Addr() + "\r\n", "ST: yeelink:yeelight\r\n", "USN: " + hub.USN() + "\r\n"} {
+		if !strings.Contains(reply, want) {
+			t.Errorf("SSDP reply %q is missing %q", reply, want)
+		}
+	}
+}
+
+func TestGoYeelightDiscovery(t *testing.T) {
+	hub := startHub(t, yeelight.Light{ID: "A"})
+	if err := hub.ListenSSDP(SSDPAddr); err != nil {
+		t.Skipf("Can't answer SSDP on loopback: %v", err)
+	}
+	ip, err := yeelight.DiscoverHub()
+	if err != nil {
+		// searches only reach loopback with a multicast route, like: ip route add 239.255.255.250 dev lo
+		t.Skipf("No SSDP reply (is there a multicast route to loopback?): %v", err)
+	}
+	if ip != hub.IP() {
+		t.Errorf("DiscoverHub = %v, want %v", ip, hub.IP())
+	}
+}
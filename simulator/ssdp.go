@@ -0,0 +1,98 @@
+package simulator
+
+// SSDP discovery responder, so yeelight.DiscoverHub and sunflower.Discover can find the simulated hub
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// SSDPAddr is the standard SSDP multicast group and port that discovery searches are sent to
+const SSDPAddr = "239.255.255.250:1900"
+
+// ListenSSDP answers SSDP M-SEARCH requests arriving on the loopback interface with the address of this hub.
+// addr is normally SSDPAddr. A unicast address (like the hub's IP with port 0) answers searches sent straight
+// to it, which needs no multicast route. Listen must be called first so the hub has an address to announce
+func (h *Hub) ListenSSDP(addr string) error {
+	if h.listener == nil {
+		return fmt.Errorf("hub must be listening before answering SSDP")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	var conn *net.UDPConn
+	if udpAddr.IP.IsMulticast() {
+		var loopback *net.Interface
+		loopback, err = loopbackInterface()
+		if err != nil {
+			return err
+		}
+		conn, err = net.ListenMulticastUDP("udp4", loopback, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp4", udpAddr)
+	}
+	if err != nil {
+		return err
+	}
+	h.ssdp = conn
+	h.wg.Add(1)
+	go h.serveSSDP()
+	return nil
+}
+
+// SearchAddr returns the address the SSDP responder is listening on, to send searches straight to it
+func (h *Hub) SearchAddr() string {
+	if h.ssdp == nil {
+		return ""
+	}
+	return h.ssdp.LocalAddr().String()
+}
+
+// serveSSDP replies to each search until the connection is closed
+func (h *Hub) serveSSDP() {
+	defer h.wg.Done()
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := h.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || request.Method != "M-SEARCH" {
+			continue
+		}
+		reply := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=1800\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: yeelink://%s\r\n"+
+			"SERVER: Yeelight Sunflower simulator\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s\r\n\r\n",
+			h.Addr(), request.Header.Get("ST"), h.USN())
+		// reply from the hub's own address so discovery sees the right IP
+		replyConn, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.ParseIP(h.IP())}, from)
+		if err != nil {
+			continue
+		}
+		replyConn.Write([]byte(reply))
+		replyConn.Close()
+	}
+}
+
+// loopbackInterface finds the loopback network interface
+func loopbackInterface() (*net.Interface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range interfaces {
+		if i.Flags&net.FlagLoopback != 0 {
+			return &i, nil
+		}
+	}
+	return nil, fmt.Errorf("no loopback interface found")
+}
@@ -0,0 +1,72 @@
+package main
+
+// Offline sunrise, sunset and civil twilight times, using NOAA's general solar position equations
+// (http://www.esrl.noaa.gov/gmd/grad/solcalc/solareqns.PDF), accurate to a minute or two away from the poles
+
+import (
+	"math"
+	"time"
+)
+
+// Solar events that schedules can be relative to
+const (
+	Sunrise   = "sunrise"
+	Sunset    = "sunset"
+	CivilDawn = "dawn" // sun 6° below the horizon in the morning
+	CivilDusk = "dusk" // sun 6° below the horizon in the evening
+)
+
+// zenith angles (in degrees) of the sun for each event, allowing for refraction and the size of the sun at sunrise/sunset
+const (
+	sunriseZenith = 90.833
+	civilZenith   = 96
+)
+
+// solarEventTime returns when event happens on the given date (year, month, day in loc) at latitude and longitude
+// (in degrees, north and east positive). ok is false if the event doesn't happen that day, as near the poles
+func solarEventTime(event string, year int, month time.Month, day int, loc *time.Location, latitude, longitude float64) (t time.Time, ok bool) {
+	zenith := sunriseZenith
+	morning := true
+	switch event {
+	case Sunrise:
+	case Sunset:
+		morning = false
+	case CivilDawn:
+		zenith = civilZenith
+	case CivilDusk:
+		zenith = civilZenith
+		morning = false
+	default:
+		return time.Time{}, false
+	}
+
+	// fractional year (radians) at noon of the day
+	dayOfYear := time.Date(year, month, day, 12, 0, 0, 0, time.UTC).YearDay()
+	daysInYear := time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+	gamma := 2 * math.Pi / float64(daysInYear) * float64(dayOfYear-1)
+
+	// equation of time (minutes) and solar declination (radians)
+	eqTime := 229.18 * (0.000075 + 0.001868*math.Cos(gamma) - 0.032077*math.Sin(gamma) -
+		0.014615*math.Cos(2*gamma) - 0.040849*math.Sin(2*gamma))
+	decl := 0.006918 - 0.399912*math.Cos(gamma) + 0.070257*math.Sin(gamma) -
+		0.006758*math.Cos(2*gamma) + 0.000907*math.Sin(2*gamma) -
+		0.002697*math.Cos(3*gamma) + 0.00148*math.Sin(3*gamma)
+
+	// hour angle of the sun at the zenith angle
+	lat := latitude * math.Pi / 180
+	cosHourAngle := math.Cos(zenith*math.Pi/180)/(math.Cos(lat)*math.Cos(decl)) - math.Tan(lat)*math.Tan(decl)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		// the sun never gets that high (or low) today
+		return time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+	if !morning {
+		hourAngle = -hourAngle
+	}
+
+	// minutes from midnight UTC on the date; this can be outside 0-1440 for places far from Greenwich,
+	// which is right as we want the event on the local date, not the UTC one
+	minutes := 720 - 4*(longitude+hourAngle) - eqTime
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return midnight.Add(time.Duration(minutes * float64(time.Minute))).In(loc), true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSolarEventTime(t *testing.T) {
+	bst := time.FixedZone("BST", 60*60)
+	aedt := time.FixedZone("AEDT", 11*60*60)
+	london := site{latitude: 51.5074, longitude: -0.1278}
+	sydney := site{latitude: -33.8688, longitude: 151.2093}
+	longyearbyen := site{latitude: 78.22, longitude: 15.65}
+
+	tests := []struct {
+		name  string
+		event string
+		date  time.Time // the day, in the local time zone
+		at    site
+		want  string // local time from an almanac, or "" if the event doesn't happen
+	}{
+		// sunrise and sunset from timeanddate.com, civil twilight from NOAA's solar calculator
+		{"London midsummer sunrise", Sunrise, time.Date(2024, time.June, 21, 0, 0, 0, 0, bst), london, "04:43"},
+		{"London midsummer sunset", Sunset, time.Date(2024, time.June, 21, 0, 0, 0, 0, bst), london, "21:21"},
+		{"London midsummer dawn", CivilDawn, time.Date(2024, time.June, 21, 0, 0, 0, 0, bst), london, "03:55"},
+		{"London midsummer dusk", CivilDusk, time.Date(2024, time.June, 21, 0, 0, 0, 0, bst), london, "22:09"},
+		// east of Greenwich, where the local date starts the UTC day before
+		{"Sydney midsummer sunrise", Sunrise, time.Date(2024, time.December, 21, 0, 0, 0, 0, aedt), sydney, "05:41"},
+		{"Sydney midsummer sunset", Sunset, time.Date(2024, time.December, 21, 0, 0, 0, 0, aedt), sydney, "20:05"},
+		{"Sydney midsummer dawn", CivilDawn, time.Date(2024, time.December, 21, 0, 0, 0, 0, aedt), sydney, "05:12"},
+		{"Sydney midsummer dusk", CivilDusk, time.Date(2024, time.December, 21, 0, 0, 0, 0, aedt), sydney, "20:35"},
+		// midnight sun and polar night
+		{"Svalbard midsummer sunrise", Sunrise, time.Date(2024, time.June, 21, 0, 0, 0, 0, time.UTC), longyearbyen, ""},
+		{"Svalbard midwinter sunset", Sunset, time.Date(2024, time.December, 21, 0, 0, 0, 0, time.UTC), longyearbyen, ""},
+		{"unknown event", "noon", time.Date(2024, time.June, 21, 0, 0, 0, 0, bst), london, ""},
+	}
+	for _, test := range tests {
+		loc := test.date.Location()
+		got, ok := solarEventTime(test.event, test.date.Year(), test.date.Month(), test.date.Day(), loc, test.at.latitude, test.at.longitude)
+		if test.want == "" {
+			if ok {
+				t.Errorf("%v = %v, want no event", test.name, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%v: no event, want %v", test.name, test.want)
+			continue
+		}
+		clock, err := time.ParseInLocation("2006-01-02 15:04", test.date.Format("2006-01-02 ")+test.want, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the almanac times are rounded to the minute, so allow half a minute on top of the 2
+		if diff := got.Sub(clock); diff < -150*time.Second || diff > 150*time.Second {
+			t.Errorf("%v = %v, want %v (within 2 minutes)", test.name, got.Format("15:04:05"), test.want)
+		}
+		if got.Location() != loc || got.Day() != test.date.Day() {
+			t.Errorf("%v = %v, want it on %v in %v", test.name, got, test.date.Format("2 Jan"), loc)
+		}
+	}
+}
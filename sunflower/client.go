@@ -0,0 +1,83 @@
+// Package sunflower is what the driver and the yeelight command share for controlling Yeelight Sunflower hubs:
+// the hub client, colours, and presets and the documents they are exported in.
+// Keeping these in one place means the command sets lights exactly the way the driver does
+package sunflower
+
+import (
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// Client is what the driver, devices and configuration screens use to talk to a Yeelight hub.
+// The real implementation wraps go-yeelight; tests can use an in-memory one instead
+type Client interface {
+	GetLights() ([]yeelight.Light, error)
+	SetLight(id string, r, g, b, level int) error
+	SetOnOff(id string, on bool) error
+	SetBrightness(id string, brightness float64) error
+	SetColor(id string, r, g, b int) error
+	IsOn(id string) (bool, error)
+	Heartbeat() error
+	TurnOffAllLights() error
+}
+
+// yeelightHub is a Client that sends commands to a real hub with go-yeelight.
+// ip is called for every command so changes to the configured IP are picked up straight away
+type yeelightHub struct {
+	ip func() string
+}
+
+// NewClient creates a Client for the hub at the address returned by ip
+func NewClient(ip func() string) Client {
+	return &yeelightHub{ip: ip}
+}
+
+// Resolver is a Client whose address (or other settings) is looked up for every command, like one made by NewClient.
+// Resolve returns a Client fixed to what they are now, which can be used without whatever guards them
+type Resolver interface {
+	Resolve() Client
+}
+
+// Resolve returns a Client fixed to client's current address and settings, or client itself if they can't change
+func Resolve(client Client) Client {
+	if r, ok := client.(Resolver); ok {
+		return r.Resolve()
+	}
+	return client
+}
+
+func (h *yeelightHub) Resolve() Client {
+	ip := h.ip()
+	return &yeelightHub{ip: func() string { return ip }}
+}
+
+func (h *yeelightHub) GetLights() ([]yeelight.Light, error) {
+	return yeelight.GetLights(h.ip())
+}
+
+func (h *yeelightHub) SetLight(id string, r, g, b, level int) error {
+	return yeelight.SetLight(id, r, g, b, level, h.ip())
+}
+
+func (h *yeelightHub) SetOnOff(id string, on bool) error {
+	return yeelight.SetOnOff(id, on, h.ip())
+}
+
+func (h *yeelightHub) SetBrightness(id string, brightness float64) error {
+	return yeelight.SetBrightness(id, brightness, h.ip())
+}
+
+func (h *yeelightHub) SetColor(id string, r, g, b int) error {
+	return yeelight.SetColor(id, r, g, b, h.ip())
+}
+
+func (h *yeelightHub) IsOn(id string) (bool, error) {
+	return yeelight.IsOn(id, h.ip())
+}
+
+func (h *yeelightHub) Heartbeat() error {
+	return yeelight.Heartbeat(h.ip())
+}
+
+func (h *yeelightHub) TurnOffAllLights() error {
+	return yeelight.TurnOffAllLights(h.ip())
+}
@@ -0,0 +1,30 @@
+package sunflower
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseColor reads a colour as hex ("#ff8800" or "ff8800") or as R,G,B values ("255,136,0")
+func ParseColor(text string) (int, int, int, error) {
+	text = strings.TrimSpace(text)
+	var r, g, b int
+	if strings.Contains(text, ",") {
+		if _, err := fmt.Sscanf(strings.Replace(text, " ", "", -1), "%d,%d,%d", &r, &g, &b); err != nil {
+			return 0, 0, 0, fmt.Errorf("%q should look like 255,136,0", text)
+		}
+	} else if _, err := fmt.Sscanf(strings.TrimPrefix(text, "#"), "%02x%02x%02x", &r, &g, &b); err != nil || len(strings.TrimPrefix(text, "#")) != 6 {
+		return 0, 0, 0, fmt.Errorf("%q should look like #ff8800", text)
+	}
+	for _, v := range []int{r, g, b} {
+		if v < 0 || v > 255 {
+			return 0, 0, 0, fmt.Errorf("colour values in %q should be 0-255", text)
+		}
+	}
+	return r, g, b, nil
+}
+
+// HexColor formats a colour the way ParseColor reads it, like "#ff8800"
+func HexColor(r, g, b int) string {
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
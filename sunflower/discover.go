@@ -0,0 +1,79 @@
+package sunflower
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// SSDPAddr is the multicast group and port that hubs listen for searches on
+const SSDPAddr = "239.255.255.250:1900"
+
+// DefaultDiscoveryTimeout is how long Discover waits for a hub to answer
+const DefaultDiscoveryTimeout = 3 * time.Second
+
+// searchTarget is the SSDP search target Yeelight hubs answer to
+const searchTarget = "yeelink:yeelight"
+
+// DiscoveredHub is a hub that answered an SSDP search
+type DiscoveredHub struct {
+	IP  string
+	USN string // the hub's unique service name, which stays the same when its IP address changes (empty if it didn't send one)
+}
+
+// Discover searches the network for a Yeelight hub with SSDP, returning the first one to answer
+func Discover() (DiscoveredHub, error) {
+	return DiscoverAt(SSDPAddr, DefaultDiscoveryTimeout)
+}
+
+// DiscoverAt sends an SSDP search to addr (normally SSDPAddr) and returns the first hub to answer within timeout.
+// Unlike yeelight.DiscoverHub, it also reads the USN from the reply, so a hub can be recognised at a new address
+func DiscoverAt(addr string, timeout time.Duration) (DiscoveredHub, error) {
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return DiscoveredHub{}, err
+	}
+	// replies come from the hub's address rather than the one searched, so the socket isn't connected
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return DiscoveredHub{}, err
+	}
+	defer conn.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + SSDPAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 1\r\n" +
+		"ST: " + searchTarget + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), to); err != nil {
+		return DiscoveredHub{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return DiscoveredHub{}, fmt.Errorf("No hub answered the SSDP search: %v", err)
+		}
+		// other devices may answer too, so skip replies that aren't from a hub
+		if hub, ok := parseSearchReply(buf[:n]); ok {
+			return hub, nil
+		}
+	}
+}
+
+// parseSearchReply gets the hub from an SSDP search reply, like "LOCATION: yeelink://192.168.1.20:10003"
+func parseSearchReply(reply []byte) (DiscoveredHub, bool) {
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(reply)), nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		return DiscoveredHub{}, false
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || location.Scheme != "yeelink" || location.Hostname() == "" {
+		return DiscoveredHub{}, false
+	}
+	return DiscoveredHub{IP: location.Hostname(), USN: response.Header.Get("USN")}, true
+}
@@ -0,0 +1,59 @@
+package sunflower
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/driver-yeelight/simulator"
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+func TestParseSearchReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  DiscoveredHub
+		ok    bool
+	}{
+		{"HTTP/1.1 200 OK\r\nLOCATION: yeelink://192.168.1.20:10003\r\nST: yeelink:yeelight\r\nUSN: uuid:hub-1\r\n\r\n",
+			DiscoveredHub{IP: "192.168.1.20", USN: "uuid:hub-1"}, true},
+		// without a USN, the hub can still be used by its address
+		{"HTTP/1.1 200 OK\r\nLocation: yeelink://192.168.1.20:10003\r\n\r\n", DiscoveredHub{IP: "192.168.1.20"}, true},
+		// other devices answering the search
+		{"HTTP/1.1 200 OK\r\nLOCATION: http://192.168.1.1:80/desc.xml\r\nUSN: uuid:router\r\n\r\n", DiscoveredHub{}, false},
+		{"HTTP/1.1 200 OK\r\nUSN: uuid:hub-1\r\n\r\n", DiscoveredHub{}, false},
+		{"HTTP/1.1 404 Not Found\r\nLOCATION: yeelink://192.168.1.20:10003\r\n\r\n", DiscoveredHub{}, false},
+		{"NOTIFY * HTTP/1.1\r\n\r\n", DiscoveredHub{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseSearchReply([]byte(test.reply))
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseSearchReply(%q) = %+v, %v, want %+v, %v", test.reply, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestDiscoverAt(t *testing.T) {
+	hub := simulator.NewHub(yeelight.Light{ID: "A"})
+	if err := hub.ListenLoopback(); err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	if err := hub.ListenSSDP(net.JoinHostPort(hub.IP(), "0")); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := DiscoverAt(hub.SearchAddr(), time.Second)
+	if err != nil {
+		t.Fatalf("DiscoverAt: %v", err)
+	}
+	if found.IP != hub.IP() || found.USN != hub.USN() {
+		t.Errorf("DiscoverAt = %+v, want %v %v", found, hub.IP(), hub.USN())
+	}
+
+	// nothing answering
+	hub.Close()
+	if _, err := DiscoverAt(hub.SearchAddr(), 200*time.Millisecond); err == nil {
+		t.Errorf("DiscoverAt with no hub answering succeeded")
+	}
+}
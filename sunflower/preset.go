@@ -0,0 +1,101 @@
+package sunflower
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// PresetDocumentVersion is the version of PresetDocument this package writes and the newest it can read
+const PresetDocumentVersion = 1
+
+// Preset is a collection of light states that can be set together
+type Preset struct {
+	//	Name   string	// name is the key in the map of Presets
+	Lights []PresetLight
+}
+
+// PresetLight is the state of one light in a preset, only what's needed to set it again.
+// The field names match yeelight.Light, which presets stored before config version 2, so old presets still load
+type PresetLight struct {
+	ID      string
+	R, G, B int
+	Level   int
+}
+
+// NewPresetLight makes a preset entry from a light's state
+func NewPresetLight(light yeelight.Light) PresetLight {
+	return PresetLight{ID: light.ID, R: light.R, G: light.G, B: light.B, Level: light.Level}
+}
+
+// Light returns the state to set the light to
+func (p PresetLight) Light() yeelight.Light {
+	return yeelight.Light{ID: p.ID, R: p.R, G: p.G, B: p.B, Level: p.Level}
+}
+
+// ApplyPreset sets each light in a preset straight away, carrying on past lights that fail.
+// If any fail, the error is a LightErrors saying what went wrong with each of them
+func ApplyPreset(hub Client, preset *Preset) error {
+	var failed LightErrors
+	for _, light := range preset.Lights {
+		if err := hub.SetLight(light.ID, light.R, light.G, light.B, light.Level); err != nil {
+			failed = append(failed, LightError{ID: light.ID, Err: err})
+		}
+	}
+	return failed.OrNil()
+}
+
+// LightError is why one light couldn't be set
+type LightError struct {
+	ID  string
+	Err error
+}
+
+// LightErrors are the lights that couldn't be set when setting several together, like a preset or a group
+type LightErrors []LightError
+
+func (e LightErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("Could not set light %v: %v", e[0].ID, e[0].Err)
+	}
+	failures := make([]string, len(e))
+	for i, failure := range e {
+		failures[i] = fmt.Sprintf("%v (%v)", failure.ID, failure.Err)
+	}
+	return fmt.Sprintf("Could not set %d lights: %v", len(e), strings.Join(failures, ", "))
+}
+
+// OrNil returns nil if nothing failed, so callers don't return a non-nil error holding an empty list
+func (e LightErrors) OrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// PresetDocument is a set of presets exported from a driver, for importing into another one
+type PresetDocument struct {
+	Version     int
+	PresetNames []string           // in display order
+	Presets     map[string]*Preset // keyed by name
+	LightNames  map[string]string  // names of the lights in the presets, keyed by light ID, to help map them on import
+}
+
+// ParsePresetDocument reads an exported preset document, checking it's a version we understand
+func ParsePresetDocument(data []byte) (*PresetDocument, error) {
+	doc := &PresetDocument{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("Not a preset document: %v", err)
+	}
+	if doc.Version < 1 || doc.Version > PresetDocumentVersion {
+		return nil, fmt.Errorf("Preset document version %d is not supported (this driver reads up to version %d)", doc.Version, PresetDocumentVersion)
+	}
+	for _, name := range doc.PresetNames {
+		if doc.Presets[name] == nil {
+			return nil, fmt.Errorf("Preset %v is listed but missing from the document", name)
+		}
+	}
+	return doc, nil
+}
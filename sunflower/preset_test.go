@@ -0,0 +1,25 @@
+package sunflower
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsePresetDocumentVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+	}{
+		{"current", `{"Version": 1, "PresetNames": ["Evening"], "Presets": {"Evening": {"Lights": []}}}`, true},
+		{"too new", fmt.Sprintf(`{"Version": %d, "PresetNames": [], "Presets": {}}`, PresetDocumentVersion+1), false},
+		{"no version", `{"PresetNames": [], "Presets": {}}`, false},
+		{"missing preset", `{"Version": 1, "PresetNames": ["Evening"], "Presets": {}}`, false},
+		{"not JSON", `Evening`, false},
+	}
+	for _, test := range tests {
+		if _, err := ParsePresetDocument([]byte(test.data)); (err == nil) != test.ok {
+			t.Errorf("%v: ParsePresetDocument error = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
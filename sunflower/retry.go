@@ -0,0 +1,243 @@
+package sunflower
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// Defaults for RetryOptions fields that are left at zero
+const (
+	DefaultTimeout  = 5 * time.Second
+	DefaultAttempts = 3
+	DefaultBackoff  = 250 * time.Millisecond
+	maxBackoff      = 5 * time.Second
+)
+
+// ErrTimeout is returned when the hub doesn't answer a command within the timeout
+var ErrTimeout = fmt.Errorf("Hub did not respond in time")
+
+// abandonedTimeouts is how many timeouts a change that timed out is waited for before later changes go ahead
+// without it, assuming it has been lost along with its connection
+const abandonedTimeouts = 4
+
+// RetryOptions say how long to wait for each command to a hub, and how often to try it again after transient errors
+type RetryOptions struct {
+	Timeout  time.Duration // for each attempt
+	Attempts int           // including the first, so 1 means no retries
+	Backoff  time.Duration // wait before the first retry, roughly doubling (with jitter) for each one after
+}
+
+func (o RetryOptions) withDefaults() RetryOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.Attempts <= 0 {
+		o.Attempts = DefaultAttempts
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = DefaultBackoff
+	}
+	return o
+}
+
+// delay is how long to wait after a failed attempt (counting from 1) before trying again:
+// the backoff doubled for each attempt, capped, then a random amount between half and all of that
+// so lights that failed together don't all retry at the same moment
+func (o RetryOptions) delay(attempt int) time.Duration {
+	delay := o.Backoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// IsTransient returns true for errors worth trying again: the hub not answering in time, refusing or dropping
+// the connection, or the network being unreachable. Anything else (like a reply the hub couldn't make sense of)
+// is permanent, as sending the same command again would fail the same way
+func IsTransient(err error) bool {
+	switch err := err.(type) {
+	case nil:
+		return false
+	case *retriedError:
+		return IsTransient(err.err)
+	case *net.DNSError:
+		return err.IsTimeout || err.IsTemporary
+	case *net.AddrError, *net.ParseError:
+		return false
+	case *net.OpError:
+		// failures to look up or parse the address are wrapped in an OpError too
+		switch err.Err.(type) {
+		case *net.DNSError, *net.AddrError, *net.ParseError:
+			return IsTransient(err.Err)
+		}
+		return true
+	case syscall.Errno:
+		switch err {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE,
+			syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return true
+		}
+		return false
+	case *os.SyscallError:
+		return IsTransient(err.Err)
+	case net.Error:
+		// checked after the types above, which all have a Timeout method too
+		return err.Timeout()
+	}
+	return err == ErrTimeout || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// retryClient is a Client that gives up on commands that take too long and tries again after transient errors.
+// Every command sets an absolute state (or only reads), so sending one twice does no harm. But a change that timed
+// out is still on its way to the hub, and would undo a newer change that overtook it, so changes are sent one at a time
+type retryClient struct {
+	client  Client
+	options func() RetryOptions
+	changes chan struct{} // holds a value while a change is being sent, shared with the clients Resolve returns
+}
+
+// NewRetryClient wraps a Client with timeouts and retries. options is called for every command, like the IP
+// function given to NewClient, so changes to the settings apply straight away
+func NewRetryClient(client Client, options func() RetryOptions) Client {
+	return &retryClient{client: client, options: options, changes: make(chan struct{}, 1)}
+}
+
+// Resolve returns a Client fixed to the options and address c has now
+func (c *retryClient) Resolve() Client {
+	options := c.options()
+	return &retryClient{client: Resolve(c.client), options: func() RetryOptions { return options }, changes: c.changes}
+}
+
+// retry runs command until it succeeds, fails with a permanent error or runs out of attempts.
+// The address is resolved first, as an attempt that times out carries on after the caller has moved on.
+// A change (rather than a read) waits for the one before it to reach the hub first, with the wait counting
+// towards each attempt's timeout
+func (c *retryClient) retry(change bool, command func(client Client) (interface{}, error)) (interface{}, error) {
+	options := c.options().withDefaults()
+	client := Resolve(c.client)
+	var changes chan struct{} // reads go straight away
+	if change {
+		changes = c.changes
+	}
+	for attempt := 1; ; attempt++ {
+		result, err := withTimeout(options.Timeout, changes, func() (interface{}, error) { return command(client) })
+		if err == nil || !IsTransient(err) {
+			return result, err
+		}
+		if attempt >= options.Attempts {
+			if attempt > 1 {
+				return nil, &retriedError{err: err, attempts: attempt}
+			}
+			return nil, err
+		}
+		time.Sleep(options.delay(attempt))
+	}
+}
+
+// retriedError is the last error from a command that failed every attempt
+type retriedError struct {
+	err      error
+	attempts int
+}
+
+func (e *retriedError) Error() string {
+	return fmt.Sprintf("%v (tried %d times)", e.err, e.attempts)
+}
+
+// withTimeout runs command, returning ErrTimeout if it takes longer than timeout.
+// go-yeelight can't be cancelled, so a command that times out is left to finish (or fail) on its own.
+// With changes, the command first waits for a turn to send (within the timeout), and a command that times out
+// keeps its turn until it finishes, or for abandonedTimeouts timeouts if it never does
+func withTimeout(timeout time.Duration, changes chan struct{}, command func() (interface{}, error)) (interface{}, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	release := func() {}
+	if changes != nil {
+		select {
+		case changes <- struct{}{}:
+		case <-timer.C:
+			return nil, ErrTimeout
+		}
+		var once sync.Once
+		release = func() { once.Do(func() { <-changes }) }
+	}
+
+	type reply struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan reply, 1) // buffered so an abandoned command doesn't block forever
+	go func() {
+		result, err := command()
+		release()
+		done <- reply{result, err}
+	}()
+	select {
+	case r := <-done:
+		return r.result, r.err
+	case <-timer.C:
+		time.AfterFunc(abandonedTimeouts*timeout, release)
+		return nil, ErrTimeout
+	}
+}
+
+func (c *retryClient) GetLights() ([]yeelight.Light, error) {
+	result, err := c.retry(false, func(client Client) (interface{}, error) { return client.GetLights() })
+	lights, _ := result.([]yeelight.Light)
+	return lights, err
+}
+
+func (c *retryClient) SetLight(id string, r, g, b, level int) error {
+	_, err := c.retry(true, func(client Client) (interface{}, error) { return nil, client.SetLight(id, r, g, b, level) })
+	return err
+}
+
+func (c *retryClient) SetOnOff(id string, on bool) error {
+	_, err := c.retry(true, func(client Client) (interface{}, error) { return nil, client.SetOnOff(id, on) })
+	return err
+}
+
+func (c *retryClient) SetBrightness(id string, brightness float64) error {
+	_, err := c.retry(true, func(client Client) (interface{}, error) { return nil, client.SetBrightness(id, brightness) })
+	return err
+}
+
+func (c *retryClient) SetColor(id string, r, g, b int) error {
+	_, err := c.retry(true, func(client Client) (interface{}, error) { return nil, client.SetColor(id, r, g, b) })
+	return err
+}
+
+func (c *retryClient) IsOn(id string) (bool, error) {
+	result, err := c.retry(false, func(client Client) (interface{}, error) { return client.IsOn(id) })
+	on, _ := result.(bool)
+	return on, err
+}
+
+func (c *retryClient) Heartbeat() error {
+	_, err := c.retry(false, func(client Client) (interface{}, error) { return nil, client.Heartbeat() })
+	return err
+}
+
+func (c *retryClient) TurnOffAllLights() error {
+	_, err := c.retry(true, func(client Client) (interface{}, error) { return nil, client.TurnOffAllLights() })
+	return err
+}
+
+// Close closes the underlying client, if it can be closed
+func (c *retryClient) Close() error {
+	if closer, ok := c.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package sunflower
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lindsaymarkward/go-yeelight"
+)
+
+// errHang makes a scriptedHub command hang until the test ends
+var errHang = errors.New("hang")
+
+// scriptedHub is a Client that answers commands in turn as scripted: hanging (errHang), failing with an error,
+// or succeeding (nil, and every command once the script runs out)
+type scriptedHub struct {
+	mu       sync.Mutex
+	script   []error
+	calls    int
+	resolves int
+	hang     chan struct{} // closed when the test ends, to let hanging commands finish
+}
+
+func newScriptedHub(t *testing.T, script ...error) *scriptedHub {
+	h := &scriptedHub{script: script, hang: make(chan struct{})}
+	t.Cleanup(func() { close(h.hang) })
+	return h
+}
+
+// Resolve counts how often the retry client fixes the hub's address, which it does before each command
+func (h *scriptedHub) Resolve() Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.resolves++
+	return h
+}
+
+func (h *scriptedHub) counts() (calls, resolves int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls, h.resolves
+}
+
+func (h *scriptedHub) next() error {
+	h.mu.Lock()
+	var err error
+	if h.calls < len(h.script) {
+		err = h.script[h.calls]
+	}
+	h.calls++
+	h.mu.Unlock()
+	if err == errHang {
+		<-h.hang
+		return io.EOF
+	}
+	return err
+}
+
+func (h *scriptedHub) GetLights() ([]yeelight.Light, error) {
+	if err := h.next(); err != nil {
+		return nil, err
+	}
+	return []yeelight.Light{{ID: "4F1A", Level: 60}}, nil
+}
+
+func (h *scriptedHub) SetLight(id string, r, g, b, level int) error      { return h.next() }
+func (h *scriptedHub) SetOnOff(id string, on bool) error                 { return h.next() }
+func (h *scriptedHub) SetBrightness(id string, brightness float64) error { return h.next() }
+func (h *scriptedHub) SetColor(id string, r, g, b int) error             { return h.next() }
+func (h *scriptedHub) Heartbeat() error                                  { return h.next() }
+func (h *scriptedHub) TurnOffAllLights() error                           { return h.next() }
+
+func (h *scriptedHub) IsOn(id string) (bool, error) {
+	err := h.next()
+	return err == nil, err
+}
+
+// fastRetries are options for tests, short enough that retrying doesn't slow them down
+func fastRetries(attempts int) func() RetryOptions {
+	return func() RetryOptions {
+		return RetryOptions{Timeout: 50 * time.Millisecond, Attempts: attempts, Backoff: time.Millisecond}
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	hub := newScriptedHub(t, syscall.ECONNREFUSED, io.EOF)
+	lights, err := NewRetryClient(hub, fastRetries(3)).GetLights()
+	if err != nil || len(lights) != 1 {
+		t.Fatalf("GetLights = %v, %v after two transient errors", lights, err)
+	}
+	if calls, resolves := hub.counts(); calls != 3 || resolves != 1 {
+		t.Errorf("GetLights tried %d times resolving %d times, want 3 tries resolving once", calls, resolves)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	hub := newScriptedHub(t, syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET, nil)
+	err := NewRetryClient(hub, fastRetries(3)).SetOnOff("4F1A", true)
+	if err == nil || !strings.Contains(err.Error(), "tried 3 times") {
+		t.Fatalf("SetOnOff = %v, want to give up after 3 tries", err)
+	}
+	if !IsTransient(err) {
+		t.Errorf("IsTransient(%v) = false after running out of attempts", err)
+	}
+	if calls, _ := hub.counts(); calls != 3 {
+		t.Errorf("SetOnOff tried %d times, want 3", calls)
+	}
+}
+
+func TestRetryPermanentError(t *testing.T) {
+	permanent := errors.New("Unexpected reply from hub")
+	hub := newScriptedHub(t, permanent)
+	if err := NewRetryClient(hub, fastRetries(3)).SetLight("4F1A", 255, 0, 0, 50); err != permanent {
+		t.Fatalf("SetLight = %v, want %v", err, permanent)
+	}
+	if calls, _ := hub.counts(); calls != 1 {
+		t.Errorf("SetLight tried %d times after a permanent error, want 1", calls)
+	}
+}
+
+func TestRetryTimeout(t *testing.T) {
+	// one attempt gives up when the hub doesn't answer
+	hub := newScriptedHub(t, errHang)
+	start := time.Now()
+	if err := NewRetryClient(hub, fastRetries(1)).Heartbeat(); err != ErrTimeout {
+		t.Fatalf("Heartbeat = %v, want %v", err, ErrTimeout)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond || took > time.Second {
+		t.Errorf("Heartbeat timed out after %v, want 50ms", took)
+	}
+
+	// and the next attempt is answered
+	hub = newScriptedHub(t, errHang)
+	if on, err := NewRetryClient(hub, fastRetries(2)).IsOn("4F1A"); err != nil || !on {
+		t.Fatalf("IsOn = %v, %v after a timeout", on, err)
+	}
+	if calls, resolves := hub.counts(); calls != 2 || resolves != 1 {
+		t.Errorf("IsOn tried %d times resolving %d times, want 2 tries resolving once", calls, resolves)
+	}
+}
+
+// slowHub is a scriptedHub whose SetLight takes level milliseconds, recording the levels in the order they're applied
+type slowHub struct {
+	*scriptedHub
+	applied []int
+}
+
+func (h *slowHub) Resolve() Client {
+	h.scriptedHub.Resolve()
+	return h
+}
+
+func (h *slowHub) SetLight(id string, r, g, b, level int) error {
+	if err := h.next(); err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(level) * time.Millisecond)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.applied = append(h.applied, level)
+	return nil
+}
+
+func (h *slowHub) appliedLevels() []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]int(nil), h.applied...)
+}
+
+func TestChangeAfterTimeout(t *testing.T) {
+	hub := &slowHub{scriptedHub: newScriptedHub(t)}
+	options := func() RetryOptions { return RetryOptions{Timeout: 100 * time.Millisecond, Attempts: 1} }
+	client := NewRetryClient(hub, options)
+
+	// a change that times out still reaches the hub later, so the next one waits for it rather than being undone by it
+	if err := client.SetLight("4F1A", 0, 0, 0, 150); err != ErrTimeout {
+		t.Fatalf("slow SetLight = %v, want %v", err, ErrTimeout)
+	}
+	if err := client.SetLight("4F1A", 0, 0, 0, 1); err != nil {
+		t.Fatalf("SetLight after a timeout = %v", err)
+	}
+	if got := hub.appliedLevels(); len(got) != 2 || got[0] != 150 || got[1] != 1 {
+		t.Errorf("hub applied levels %v, want the timed out change first", got)
+	}
+}
+
+func TestChangeAfterLostCommand(t *testing.T) {
+	hub := newScriptedHub(t, errHang)
+	client := NewRetryClient(hub, fastRetries(1))
+	if err := client.SetOnOff("4F1A", true); err != ErrTimeout {
+		t.Fatalf("SetOnOff = %v, want %v", err, ErrTimeout)
+	}
+
+	// changes wait for a command that never finishes, while reads go ahead
+	if err := client.SetOnOff("4F1A", false); err != ErrTimeout {
+		t.Errorf("SetOnOff while the last change hangs = %v, want %v", err, ErrTimeout)
+	}
+	if err := client.Heartbeat(); err != nil {
+		t.Errorf("Heartbeat while a change hangs = %v", err)
+	}
+	// until it's given up as lost
+	time.Sleep(abandonedTimeouts * 50 * time.Millisecond)
+	if err := client.SetOnOff("4F1A", false); err != nil {
+		t.Errorf("SetOnOff after giving up on the lost change = %v", err)
+	}
+	if calls, _ := hub.counts(); calls != 3 {
+		t.Errorf("hub was sent %d commands, want 3 without the one that waited", calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrTimeout, true},
+		{io.EOF, true},
+		{io.ErrUnexpectedEOF, true},
+		{syscall.ECONNREFUSED, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.EHOSTUNREACH}, true},
+		{&retriedError{err: io.EOF, attempts: 3}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.AddrError{Err: "missing port", Addr: "hub"}}, false},
+		{&net.DNSError{Err: "no such host", Name: "hub", IsNotFound: true}, false},
+		{&net.ParseError{Type: "IP address", Text: "hub"}, false},
+		{syscall.EINVAL, false},
+		{errors.New("Unexpected reply from hub"), false},
+	}
+	for _, test := range tests {
+		if got := IsTransient(test.err); got != test.want {
+			t.Errorf("IsTransient(%#v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	options := RetryOptions{Backoff: 100 * time.Millisecond}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{6, 3200 * time.Millisecond},
+		{7, maxBackoff},
+		{20, maxBackoff},
+	}
+	for _, test := range tests {
+		// jittered between half and all of the doubled backoff
+		for i := 0; i < 100; i++ {
+			if got := options.delay(test.attempt); got < test.max/2 || got > test.max {
+				t.Errorf("delay(%d) = %v, want between %v and %v", test.attempt, got, test.max/2, test.max)
+				break
+			}
+		}
+	}
+}
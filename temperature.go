@@ -0,0 +1,96 @@
+package main
+
+// Colour temperature (Kelvin) to RGB for the Sunflower's LEDs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TemperaturePoint is the RGB mix that gives a colour temperature on a bulb
+type TemperaturePoint struct {
+	Kelvin  int
+	R, G, B int
+}
+
+// defaultCalibration is used for bulbs without their own calibration table.
+// It starts from black-body colours and can be adjusted per bulb in the config
+var defaultCalibration = []TemperaturePoint{
+	{Kelvin: 2000, R: 255, G: 137, B: 14},
+	{Kelvin: 2700, R: 255, G: 167, B: 87},
+	{Kelvin: 3000, R: 255, G: 180, B: 107},
+	{Kelvin: 3500, R: 255, G: 196, B: 137},
+	{Kelvin: 4000, R: 255, G: 209, B: 163},
+	{Kelvin: 5000, R: 255, G: 228, B: 206},
+	{Kelvin: 5500, R: 255, G: 236, B: 224},
+	{Kelvin: 6500, R: 255, G: 254, B: 250},
+}
+
+// temperatureToRGB finds the RGB mix for a colour temperature using a calibration table (sorted by Kelvin),
+// interpolating between points and clamping to the ends of the table
+func temperatureToRGB(kelvin float64, table []TemperaturePoint) (int, int, int) {
+	if len(table) == 0 {
+		table = defaultCalibration
+	}
+	if kelvin <= float64(table[0].Kelvin) {
+		return table[0].R, table[0].G, table[0].B
+	}
+	last := table[len(table)-1]
+	if kelvin >= float64(last.Kelvin) {
+		return last.R, last.G, last.B
+	}
+	i := sort.Search(len(table), func(i int) bool { return float64(table[i].Kelvin) >= kelvin })
+	low, high := table[i-1], table[i]
+	f := (kelvin - float64(low.Kelvin)) / float64(high.Kelvin-low.Kelvin)
+	mix := func(a, b int) int {
+		return int(float64(a) + f*float64(b-a) + 0.5)
+	}
+	return mix(low.R, high.R), mix(low.G, high.G), mix(low.B, high.B)
+}
+
+// formatCalibration turns a calibration table into text for the config screen, like "2700:255,167,87 3000:255,180,107"
+func formatCalibration(table []TemperaturePoint) string {
+	points := make([]string, len(table))
+	for i, p := range table {
+		points[i] = fmt.Sprintf("%d:%d,%d,%d", p.Kelvin, p.R, p.G, p.B)
+	}
+	return strings.Join(points, " ")
+}
+
+// parseCalibration reads a calibration table in the format of formatCalibration, sorted by Kelvin
+func parseCalibration(text string) ([]TemperaturePoint, error) {
+	var table []TemperaturePoint
+	for _, field := range strings.Fields(text) {
+		parts := strings.Split(field, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q should look like 2700:255,167,87", field)
+		}
+		rgb := strings.Split(parts[1], ",")
+		if len(rgb) != 3 {
+			return nil, fmt.Errorf("%q should have three colour values", field)
+		}
+		var values [4]int
+		for i, s := range append([]string{parts[0]}, rgb...) {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number in %q", s, field)
+			}
+			if i > 0 && (v < 0 || v > 255) {
+				return nil, fmt.Errorf("colour values in %q should be 0-255", field)
+			}
+			values[i] = v
+		}
+		table = append(table, TemperaturePoint{Kelvin: values[0], R: values[1], G: values[2], B: values[3]})
+	}
+	sort.Sort(byKelvin(table))
+	return table, nil
+}
+
+// byKelvin sorts calibration points by colour temperature
+type byKelvin []TemperaturePoint
+
+func (t byKelvin) Len() int           { return len(t) }
+func (t byKelvin) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byKelvin) Less(i, j int) bool { return t[i].Kelvin < t[j].Kelvin }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTemperatureToRGB(t *testing.T) {
+	calibrated := []TemperaturePoint{
+		{Kelvin: 3000, R: 200, G: 100, B: 50},
+		{Kelvin: 6000, R: 100, G: 200, B: 250},
+	}
+	tests := []struct {
+		name    string
+		kelvin  float64
+		table   []TemperaturePoint
+		r, g, b int
+	}{
+		// the default table, for bulbs without their own
+		{"below the default range", 1000, nil, 255, 137, 14},
+		{"default lowest", 2000, nil, 255, 137, 14},
+		{"default point", 4000, nil, 255, 209, 163},
+		{"between default points", 2850, nil, 255, 174, 97},
+		{"default highest", 6500, nil, 255, 254, 250},
+		{"above the default range", 10000, nil, 255, 254, 250},
+		// and a bulb's own
+		{"below a calibrated range", 2000, calibrated, 200, 100, 50},
+		{"calibrated lowest", 3000, calibrated, 200, 100, 50},
+		{"between calibrated points", 4500, calibrated, 150, 150, 150},
+		{"rounded between calibrated points", 3001, calibrated, 200, 100, 50},
+		{"calibrated highest", 6000, calibrated, 100, 200, 250},
+		{"above a calibrated range", 6500, calibrated, 100, 200, 250},
+		{"one point", 9000, []TemperaturePoint{{Kelvin: 2700, R: 1, G: 2, B: 3}}, 1, 2, 3},
+	}
+	for _, test := range tests {
+		if r, g, b := temperatureToRGB(test.kelvin, test.table); r != test.r || g != test.g || b != test.b {
+			t.Errorf("%v: temperatureToRGB(%v) = %d,%d,%d, want %d,%d,%d", test.name, test.kelvin, r, g, b, test.r, test.g, test.b)
+		}
+	}
+}
+
+func TestParseCalibration(t *testing.T) {
+	// sorted by Kelvin, and formatted back the same way
+	table, err := parseCalibration(" 6000:100,200,250  3000:200,100,50 ")
+	if err != nil {
+		t.Fatalf("parseCalibration: %v", err)
+	}
+	want := []TemperaturePoint{{Kelvin: 3000, R: 200, G: 100, B: 50}, {Kelvin: 6000, R: 100, G: 200, B: 250}}
+	if !reflect.DeepEqual(table, want) {
+		t.Errorf("parseCalibration = %+v, want %+v", table, want)
+	}
+	if got := formatCalibration(table); got != "3000:200,100,50 6000:100,200,250" {
+		t.Errorf("formatCalibration = %q", got)
+	}
+
+	for _, text := range []string{"3000", "3000:200,100", "warm:200,100,50", "3000:256,100,50", "3000:200,-1,50"} {
+		if _, err := parseCalibration(text); err == nil {
+			t.Errorf("parseCalibration(%q) succeeded", text)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// Keeping the names of the Ninja Things for our lights in step with the names in the config,
+// so lights show our names (not hex IDs) in the phone app
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+const (
+	thingModelTopic   = "$home/services/ThingModel"
+	thingCallTimeout  = 10 * time.Second
+	thingSyncAttempts = 6                // the ThingModel service and our Things can take a while to appear after startup
+	thingSyncRetry    = 20 * time.Second // time between attempts
+)
+
+// serviceClient is the part of go-ninja's ServiceClient used to call the ThingModel service
+type serviceClient interface {
+	Call(method string, args interface{}, reply interface{}, timeout time.Duration) error
+}
+
+// thingModelClient returns a client for the Sphere's ThingModel service, or nil if it isn't available
+func (d *YeelightDriver) thingModelClient() serviceClient {
+	if client := d.Conn.GetServiceClient(thingModelTopic); client != nil {
+		return client
+	}
+	return nil
+}
+
+// thingNames returns the name each of our devices' Things should have, keyed by device NaturalID.
+// The driver lock must be held
+func (d *YeelightDriver) thingNames() map[string]string {
+	names := make(map[string]string)
+	for _, id := range d.config.LightIDs {
+		if name := d.config.Names[id]; name != "" {
+			names[id] = name
+		}
+	}
+	for name, device := range d.groupDevices {
+		names[device.GetDeviceInfo().NaturalID] = name
+	}
+	return names
+}
+
+// ownsThingName returns true if a Thing's name is one we gave it (given the names we last set) or a default,
+// rather than one the user set in the app
+func ownsThingName(naturalID, name string, ours map[string]string) bool {
+	return name == "" || strings.EqualFold(name, naturalID) || name == ours[naturalID] || isDefaultThingName(naturalID, name)
+}
+
+// isDefaultThingName returns true for the names Things got before names were synced: the Sphere's own
+// default for a light, like "Lt 143F", or the name earlier versions of the driver gave new lights, like "Yee143F"
+func isDefaultThingName(naturalID, name string) bool {
+	for _, prefix := range []string{"Lt ", "Yee"} {
+		if strings.EqualFold(name, prefix+naturalID) {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncThingNames renames the Things for our lights and groups to match the config.
+// Names set in the phone app are left alone unless force is set.
+// It returns how many devices don't have a Thing yet, which happens for a while after they are first exported.
+// The ThingModel service is called without the driver lock, so the driver lock must not be held
+func (d *YeelightDriver) SyncThingNames(force bool) (int, error) {
+	d.thingSync.Lock()
+	defer d.thingSync.Unlock()
+
+	d.mu.Lock()
+	wanted := d.thingNames()
+	ours := make(map[string]string)
+	for naturalID, name := range d.config.ThingNames {
+		ours[naturalID] = name
+	}
+	d.mu.Unlock()
+
+	client := d.thingModel()
+	if client == nil {
+		return 0, fmt.Errorf("ThingModel service is not available")
+	}
+	var things []*model.Thing
+	if err := client.Call("fetchAll", nil, &things, thingCallTimeout); err != nil {
+		return 0, fmt.Errorf("Could not fetch things: %v", err)
+	}
+
+	found := 0
+	renamed := make(map[string]string)
+	var err error
+	for _, thing := range things {
+		if thing.Device == nil {
+			continue
+		}
+		naturalID := thing.Device.NaturalID
+		name, ok := wanted[naturalID]
+		if !ok {
+			continue
+		}
+		found++
+		if thing.Name == name {
+			continue
+		}
+		if !force && !ownsThingName(naturalID, thing.Name, ours) {
+			log.Printf("Leaving thing %v named %q, it was renamed in the app", naturalID, thing.Name)
+			continue
+		}
+		log.Printf("Renaming thing %v from %q to %q", naturalID, thing.Name, name)
+		thing.Name = name
+		if err = client.Call("update", []interface{}{thing.ID, thing}, nil, thingCallTimeout); err != nil {
+			err = fmt.Errorf("Could not rename thing %v: %v", naturalID, err)
+			break
+		}
+		renamed[naturalID] = name
+	}
+	if len(renamed) > 0 {
+		// remember the names we set, so we can tell them from names set in the app
+		d.mu.Lock()
+		if d.config.ThingNames == nil {
+			d.config.ThingNames = make(map[string]string)
+		}
+		for naturalID, name := range renamed {
+			d.config.ThingNames[naturalID] = name
+		}
+		if saveErr := d.saveConfig(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+		d.mu.Unlock()
+	}
+	return len(wanted) - found, err
+}
+
+// syncThingNamesInBackground runs SyncThingNames in a goroutine, trying again while the service isn't ready
+// or some devices don't have Things yet, until the driver stops
+func (d *YeelightDriver) syncThingNamesInBackground(force bool) {
+	ctx := d.ctx
+	go func() {
+		for attempt := 1; ; attempt++ {
+			pending, err := d.SyncThingNames(force)
+			if err == nil && pending == 0 {
+				return
+			}
+			if err != nil {
+				log.Printf("Thing name sync failed (attempt %d): %v", attempt, err)
+			}
+			if attempt == thingSyncAttempts {
+				if pending > 0 {
+					log.Printf("Gave up syncing thing names, %d devices still have no thing", pending)
+				}
+				return
+			}
+			select {
+			case <-time.After(thingSyncRetry):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+// fakeThingModel stands in for the ThingModel service, keeping the names Things are renamed to
+type fakeThingModel struct {
+	things  []*model.Thing
+	renamed map[string]string // Thing ID to new name
+}
+
+func (f *fakeThingModel) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	switch method {
+	case "fetchAll":
+		*reply.(*[]*model.Thing) = f.things
+	case "update":
+		update := args.([]interface{})
+		f.renamed[update[0].(string)] = update[1].(*model.Thing).Name
+	}
+	return nil
+}
+
+func TestOwnsThingName(t *testing.T) {
+	ours := map[string]string{"143F": "Lounge"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"", true},
+		{"143F", true},
+		{"143f", true},
+		{"Lounge", true},
+		{"Lt 143F", true},
+		{"lt 143f", true},
+		{"Yee143F", true},
+		{"Lt 238B", false},
+		{"Reading lamp", false},
+	}
+	for _, test := range tests {
+		if got := ownsThingName("143F", test.name, ours); got != test.want {
+			t.Errorf("ownsThingName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSyncThingNames(t *testing.T) {
+	d := newTestDriver(t)
+	d.config.LightIDs = []string{"143F", "238B"}
+	d.config.Names = map[string]string{"143F": "Lounge", "238B": "Hall"}
+	things := &fakeThingModel{
+		things: []*model.Thing{
+			{ID: "t1", Name: "Lt 143F", Device: &model.Device{NaturalID: "143F"}},
+			{ID: "t2", Name: "Reading lamp", Device: &model.Device{NaturalID: "238B"}},
+		},
+		renamed: make(map[string]string),
+	}
+	d.thingModel = func() serviceClient { return things }
+
+	// the default name is ours to change, but the one set in the app is left alone
+	if pending, err := d.SyncThingNames(false); err != nil || pending != 0 {
+		t.Fatalf("SyncThingNames = %d, %v", pending, err)
+	}
+	if len(things.renamed) != 1 || things.renamed["t1"] != "Lounge" {
+		t.Errorf("renamed %v, want only t1 to Lounge", things.renamed)
+	}
+	if got := d.config.ThingNames["143F"]; got != "Lounge" {
+		t.Errorf("remembered name %q for 143F, want Lounge", got)
+	}
+}